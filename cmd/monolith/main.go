@@ -3,27 +3,40 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	rauth "github.com/hyphengolang/noughts-and-crosses/internal/auth/repository"
 	auth "github.com/hyphengolang/noughts-and-crosses/internal/auth/service"
 	"github.com/hyphengolang/noughts-and-crosses/internal/conf"
 	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	rgame "github.com/hyphengolang/noughts-and-crosses/internal/game/repository"
+	sgame "github.com/hyphengolang/noughts-and-crosses/internal/game/service"
 	mail "github.com/hyphengolang/noughts-and-crosses/internal/mailing/service"
+	match "github.com/hyphengolang/noughts-and-crosses/internal/match/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
 	rreg "github.com/hyphengolang/noughts-and-crosses/internal/reg/repository"
 	sreg "github.com/hyphengolang/noughts-and-crosses/internal/reg/service"
 	"github.com/hyphengolang/noughts-and-crosses/internal/smtp"
 	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	keys "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt/jwk"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/cors"
 )
 
 func run() error {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	nc, err := nats.Connect(conf.NATSURI, nats.UserJWTAndSeed(conf.NATSToken, conf.NATSSeed), nats.ErrorHandler(func(nc *nats.Conn, s *nats.Subscription, err error) {
 		if s != nil {
@@ -37,7 +50,12 @@ func run() error {
 	}
 	defer nc.Close()
 
-	ec, err := nats.NewEncodedConn(nc, nats.GOB_ENCODER)
+	enc := events.JSON_ENCODER
+	if conf.NATSEncoding == "protobuf" {
+		enc = events.PROTOBUF_ENCODER
+	}
+
+	ec, err := nats.NewEncodedConn(nc, enc)
 	if err != nil {
 		return err
 	}
@@ -60,7 +78,7 @@ func run() error {
 		opt := cors.Options{
 			AllowedOrigins:   []string{conf.ClientURI},
 			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Last-Event-ID"}, // EventSource sends `Last-Event-ID` when it reconnects
 			ExposedHeaders:   []string{"Link"},
 			AllowCredentials: true,
 			MaxAge:           300, // Maximum value not ignored by any of major browsers
@@ -71,40 +89,135 @@ func run() error {
 		mux.Post("/health", handlePing)
 	}
 
-	msv := newMailingService(ec)
+	// each service has a broker of its own, which drains its subscriptions
+	var brokers []events.Broker
+	broker := func() events.Broker {
+		b := events.NewClient(ec)
+		brokers = append(brokers, b)
+		return b
+	}
+
+	msv, err := newMailingService(broker())
+	if err != nil {
+		return err
+	}
 	mux.Mount("/mail", msv)
 
-	rsv := newRegService(ec, conn)
+	tk := newTokenClient()
+	mux.Get("/.well-known/jwks.json", token.JWKSHandler(tk))
+
+	rsv, err := newRegService(broker(), conn, tk)
+	if err != nil {
+		return err
+	}
 	mux.Mount("/registry", rsv)
 
-	asv := newAuthService(ec)
+	asv, err := newAuthService(broker(), conn, tk)
+	if err != nil {
+		return err
+	}
+	defer asv.Close()
 	mux.Mount("/auth", asv)
 
+	gsv, err := newGameService(broker(), conn, tk)
+	if err != nil {
+		return err
+	}
+	mux.Mount("/games", gsv)
+
+	mmsv, err := newMatchService(broker(), tk)
+	if err != nil {
+		return err
+	}
+	mux.Mount("/match", mmsv)
+
+	// events written to the outbox are published until the signal
+	go outbox.NewRelay(conn, events.NewClient(ec), outbox.WithStreams(events.StreamMail, events.StreamGames)).Run(ctx)
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", conf.PORT), Handler: mux}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
 	log.Println("Listening on port", conf.PORT)
-	return http.ListenAndServe(fmt.Sprintf(":%d", conf.PORT), mux)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	// messages already received are handled before the connection closes
+	for _, b := range brokers {
+		if err := b.Drain(ctx); err != nil {
+			log.Printf("drain: %v", err)
+		}
+	}
+	return nil
 }
 
 func main() {
+	flag.Parse()
+
 	if err := run(); err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func newMailingService(nc *nats.EncodedConn) *mail.Service {
+func newTokenClient() token.Client {
+	opts := []token.ClientOption{token.WithLeeway(conf.JWTLeeway)}
+	switch {
+	case strings.HasSuffix(conf.JWTKeyFile, ".json"):
+		opts = append(opts, token.WithSource(keys.SetFile(conf.JWTKeyFile)))
+	case conf.JWTKeyFile != "":
+		opts = append(opts, token.WithSource(keys.PEMFile(conf.JWTKeyFile)))
+	default:
+		opts = append(opts, token.WithPEM(conf.JWTSecret))
+	}
+	if conf.JWTIssuer != "" {
+		opts = append(opts, token.WithIssuer(conf.JWTIssuer))
+	}
+	if conf.JWTAudience != "" {
+		opts = append(opts, token.WithAudience(conf.JWTAudience))
+	}
+	switch {
+	case conf.JWTRotation > 0 && conf.JWTKeyFile != "":
+		// every instance reads the file, so it is rotated there
+		log.Println("JWT_ROTATION is ignored, rotate the keys of JWT_KEY_FILE instead")
+	case conf.JWTRotation > 0:
+		log.Println("JWT_ROTATION generates keys no other instance knows, run a single instance or share JWT_KEY_FILE")
+		// old keys must outlive the longest lived token, the refresh token
+		opts = append(opts, token.WithRotation(conf.JWTRotation, 7*24*time.Hour))
+	}
+	return token.NewTokenClient(opts...)
+}
+
+func newMailingService(ec events.Broker) (*mail.Service, error) {
 	em := smtp.NewMailer(conf.SMTPUsername, conf.SMTPPassword, conf.SMTPHost, 587)
-	ec := events.NewClient(nc)
 	return mail.New(em, ec)
 }
 
-func newRegService(nc *nats.EncodedConn, pg *pgxpool.Pool) *sreg.Service {
-	ec := events.NewClient(nc)
-	return sreg.New(ec, rreg.New(pg))
+func newRegService(ec events.Broker, pg *pgxpool.Pool, tk token.Client) (*sreg.Service, error) {
+	return sreg.New(ec, tk, rreg.New(pg))
+}
+
+func newAuthService(ec events.Broker, pg *pgxpool.Pool, tk token.Client) (*auth.Service, error) {
+	return auth.New(ec, tk, rauth.New(pg))
+}
+
+func newGameService(ec events.Broker, pg *pgxpool.Pool, tk token.Client) (*sgame.Service, error) {
+	return sgame.New(ec, tk, rgame.New(pg))
 }
 
-func newAuthService(nc *nats.EncodedConn) *auth.Service {
-	tk := token.NewTokenClient(token.WithPEM(conf.JWTSecret))
-	ec := events.NewClient(nc)
-	return auth.New(ec, tk)
+func newMatchService(ec events.Broker, tk token.Client) (*match.Service, error) {
+	return match.New(ec, tk)
 }
 
 func handlePing(w http.ResponseWriter, r *http.Request) {
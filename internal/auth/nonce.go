@@ -0,0 +1,7 @@
+package auth
+
+import "github.com/hyphengolang/noughts-and-crosses/internal/errs"
+
+// ErrLinkUsed is returned when a magic link is confirmed a second time,
+// or was never issued by this service
+var ErrLinkUsed = errs.New(errs.TokenInvalid, "link was already used or has expired")
@@ -0,0 +1,229 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/auth"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Repo interface {
+	SetSession(ctx context.Context, args pgx.QueryRewriter) error
+	RotateSession(ctx context.Context, args pgx.QueryRewriter) (*auth.Session, error)
+	RevokeSession(ctx context.Context, args pgx.QueryRewriter) error
+	RevokeProfileSessions(ctx context.Context, args pgx.QueryRewriter) error
+
+	SetNonce(ctx context.Context, args pgx.QueryRewriter) error
+	ConsumeNonce(ctx context.Context, args pgx.QueryRewriter) error
+	DeleteExpiredNonces(ctx context.Context) (int64, error)
+}
+
+type repo struct {
+	c pg.Conn[auth.Session]
+}
+
+type UUIDArgs struct {
+	ID uuid.UUID
+}
+
+func (a UUIDArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id": a.ID,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+type SetSessionArgs struct {
+	ID        uuid.UUID
+	ProfileID uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (a SetSessionArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":         a.ID,
+		"profile_id": a.ProfileID,
+		"expires_at": a.ExpiresAt,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// SetSession starts a new family of sessions on login
+func (r *repo) SetSession(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	INSERT INTO auth.sessions (id, family_id, profile_id, expires_at)
+	VALUES (@id, @id, @profile_id, @expires_at)`
+
+	_, err := r.c.ExecContext(ctx, q, args)
+	return err
+}
+
+type RotateSessionArgs struct {
+	ID uuid.UUID
+	// NextID is the `jti` of the refresh token that replaces this one
+	NextID    uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (a RotateSessionArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":         a.ID,
+		"next_id":    a.NextID,
+		"expires_at": a.ExpiresAt,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// RotateSession replaces a session with the next one in its family. A session
+// can only be replaced once; trying again means the old refresh token has
+// been reused, so the whole family is revoked and `auth.ErrSessionReused`
+// is returned.
+func (r *repo) RotateSession(ctx context.Context, args pgx.QueryRewriter) (*auth.Session, error) {
+	const q = `
+	WITH old AS (
+		UPDATE auth.sessions
+		SET replaced_by = @next_id
+		WHERE id = @id
+		AND replaced_by IS NULL
+		AND revoked_at IS NULL
+		AND expires_at > now()
+		RETURNING family_id, profile_id
+	)
+	INSERT INTO auth.sessions (id, family_id, profile_id, expires_at)
+	SELECT @next_id, family_id, profile_id, @expires_at FROM old
+	RETURNING id, family_id, profile_id, expires_at`
+
+	const reused = `
+	UPDATE auth.sessions
+	SET revoked_at = now()
+	WHERE family_id = (
+		SELECT family_id FROM auth.sessions
+		WHERE id = @id AND replaced_by IS NOT NULL
+	)
+	AND revoked_at IS NULL`
+
+	s, err := r.c.QueryRowContext(ctx, func(r pgx.Row, s *auth.Session) error {
+		return r.Scan(&s.ID, &s.FamilyID, &s.ProfileID, &s.ExpiresAt)
+	}, q, args)
+	switch {
+	case err == nil:
+		return s, nil
+	case !errors.Is(err, pgx.ErrNoRows):
+		return nil, err
+	}
+
+	count, err := r.c.ExecContext(ctx, reused, args)
+	switch {
+	case err != nil:
+		return nil, err
+	case count == 0:
+		// unknown, expired or already revoked
+		return nil, auth.ErrSessionInvalid
+	default:
+		return nil, auth.ErrSessionReused
+	}
+}
+
+// RevokeSession logs out of every session in the family of `UUIDArgs`
+func (r *repo) RevokeSession(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	UPDATE auth.sessions
+	SET revoked_at = now()
+	WHERE family_id = (SELECT family_id FROM auth.sessions WHERE id = @id)
+	AND revoked_at IS NULL`
+
+	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return pg.ErrNoRowsAffected
+	}
+	return nil
+}
+
+// RevokeProfileSessions logs out of every session of the profile in `UUIDArgs`
+func (r *repo) RevokeProfileSessions(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	UPDATE auth.sessions
+	SET revoked_at = now()
+	WHERE profile_id = @id
+	AND revoked_at IS NULL`
+
+	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return pg.ErrNoRowsAffected
+	}
+	return nil
+}
+
+type NonceArgs struct {
+	ID        uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (a NonceArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":         a.ID,
+		"expires_at": a.ExpiresAt,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// SetNonce records the `jti` of a magic link when it is sent
+func (r *repo) SetNonce(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	INSERT INTO auth.nonces (id, expires_at)
+	VALUES (@id, @expires_at)`
+
+	_, err := r.c.ExecContext(ctx, q, args)
+	return err
+}
+
+// ConsumeNonce marks the nonce of `UUIDArgs` as used. Only the first call
+// for a nonce succeeds, any other returns `auth.ErrLinkUsed`.
+func (r *repo) ConsumeNonce(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	UPDATE auth.nonces
+	SET consumed_at = now()
+	WHERE id = @id
+	AND consumed_at IS NULL
+	AND expires_at > now()`
+
+	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return auth.ErrLinkUsed
+	}
+	return nil
+}
+
+// DeleteExpiredNonces forgets nonces whose links have expired, as
+// the token itself can no longer be used by then
+func (r *repo) DeleteExpiredNonces(ctx context.Context) (int64, error) {
+	const q = `DELETE FROM auth.nonces WHERE expires_at <= now()`
+
+	return r.c.ExecContext(ctx, q, pgx.NamedArgs{})
+}
+
+func New(rwc *pgxpool.Pool) Repo {
+	r := &repo{c: pg.NewConn[auth.Session](rwc)}
+	return r
+}
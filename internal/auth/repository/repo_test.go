@@ -0,0 +1,183 @@
+package repo_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/auth"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/auth/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/docker"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	authRepo  repo.Repo
+	container *docker.PostgresContainer
+)
+
+func init() {
+	ctx := context.TODO()
+
+	m := `
+	CREATE SCHEMA IF NOT EXISTS auth;
+
+	CREATE TABLE IF NOT EXISTS auth.sessions (
+		id UUID PRIMARY KEY,
+		family_id UUID NOT NULL,
+		profile_id UUID NOT NULL,
+		replaced_by UUID,
+		revoked_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS sessions_family ON auth.sessions (family_id);
+
+	CREATE TABLE IF NOT EXISTS auth.nonces (
+		id UUID PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL,
+		consumed_at TIMESTAMPTZ
+	);
+
+	CREATE INDEX IF NOT EXISTS nonces_expires_at ON auth.nonces (expires_at);
+	`
+
+	var (
+		conn *pgxpool.Pool
+		err  error
+	)
+
+	container, conn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize test repo
+	authRepo = repo.New(conn)
+}
+
+func TestSessionRepository(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	var (
+		johnDoe = uuid.New()
+		login   = uuid.New()
+		second  = uuid.New()
+		third   = uuid.New()
+		expires = time.Now().Add(time.Hour)
+	)
+
+	t.Run("start a session", func(t *testing.T) {
+		err := authRepo.SetSession(ctx, repo.SetSessionArgs{ID: login, ProfileID: johnDoe, ExpiresAt: expires})
+		is.NoErr(err) // login
+	})
+
+	t.Run("rotate the refresh token", func(t *testing.T) {
+		s, err := authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: login, NextID: second, ExpiresAt: expires})
+		is.NoErr(err)                  // rotate
+		is.Equal(s.ID, second)         // new session
+		is.Equal(s.FamilyID, login)    // same family
+		is.Equal(s.ProfileID, johnDoe) // same user
+	})
+
+	t.Run("reusing a rotated token revokes the family", func(t *testing.T) {
+		_, err := authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: login, NextID: uuid.New(), ExpiresAt: expires})
+		is.Equal(err, auth.ErrSessionReused) // reuse detected
+
+		_, err = authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: second, NextID: third, ExpiresAt: expires})
+		is.Equal(err, auth.ErrSessionInvalid) // latest token was revoked too
+	})
+
+	t.Run("logout revokes the session", func(t *testing.T) {
+		other := uuid.New()
+		is.NoErr(authRepo.SetSession(ctx, repo.SetSessionArgs{ID: other, ProfileID: johnDoe, ExpiresAt: expires})) // login again
+
+		err := authRepo.RevokeSession(ctx, repo.UUIDArgs{ID: other})
+		is.NoErr(err) // logout
+
+		_, err = authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: other, NextID: uuid.New(), ExpiresAt: expires})
+		is.Equal(err, auth.ErrSessionInvalid) // cannot refresh after logout
+	})
+
+	t.Run("expired sessions cannot be rotated", func(t *testing.T) {
+		old := uuid.New()
+		is.NoErr(authRepo.SetSession(ctx, repo.SetSessionArgs{ID: old, ProfileID: johnDoe, ExpiresAt: time.Now().Add(-time.Minute)})) // expired login
+
+		_, err := authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: old, NextID: uuid.New(), ExpiresAt: expires})
+		is.Equal(err, auth.ErrSessionInvalid) // expired
+	})
+
+	t.Run("closing a profile revokes all of its sessions", func(t *testing.T) {
+		janeDoe, a, b := uuid.New(), uuid.New(), uuid.New()
+		is.NoErr(authRepo.SetSession(ctx, repo.SetSessionArgs{ID: a, ProfileID: janeDoe, ExpiresAt: expires})) // login
+		is.NoErr(authRepo.SetSession(ctx, repo.SetSessionArgs{ID: b, ProfileID: janeDoe, ExpiresAt: expires})) // login elsewhere
+
+		err := authRepo.RevokeProfileSessions(ctx, repo.UUIDArgs{ID: janeDoe})
+		is.NoErr(err) // revoke
+
+		for _, id := range []uuid.UUID{a, b} {
+			_, err = authRepo.RotateSession(ctx, repo.RotateSessionArgs{ID: id, NextID: uuid.New(), ExpiresAt: expires})
+			is.Equal(err, auth.ErrSessionInvalid) // cannot refresh
+		}
+
+		err = authRepo.RevokeProfileSessions(ctx, repo.UUIDArgs{ID: janeDoe})
+		is.Equal(err, pg.ErrNoRowsAffected) // nothing left to revoke
+	})
+
+	t.Run("database errors are not reported as no rows", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := authRepo.RevokeSession(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.True(errors.Is(err, context.Canceled)) // logout failed
+
+		err = authRepo.RevokeProfileSessions(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.True(errors.Is(err, context.Canceled)) // revoke failed
+	})
+}
+
+func TestNonceRepository(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	var (
+		link    = uuid.New()
+		expired = uuid.New()
+	)
+
+	t.Run("record a link", func(t *testing.T) {
+		err := authRepo.SetNonce(ctx, repo.NonceArgs{ID: link, ExpiresAt: time.Now().Add(time.Minute)})
+		is.NoErr(err) // link sent
+	})
+
+	t.Run("links are used once", func(t *testing.T) {
+		err := authRepo.ConsumeNonce(ctx, repo.UUIDArgs{ID: link})
+		is.NoErr(err) // first use
+
+		err = authRepo.ConsumeNonce(ctx, repo.UUIDArgs{ID: link})
+		is.Equal(err, auth.ErrLinkUsed) // replayed
+	})
+
+	t.Run("unknown links are rejected", func(t *testing.T) {
+		err := authRepo.ConsumeNonce(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.Equal(err, auth.ErrLinkUsed) // never sent
+	})
+
+	t.Run("expired links are swept", func(t *testing.T) {
+		is.NoErr(authRepo.SetNonce(ctx, repo.NonceArgs{ID: expired, ExpiresAt: time.Now().Add(-time.Minute)})) // expired link
+
+		err := authRepo.ConsumeNonce(ctx, repo.UUIDArgs{ID: expired})
+		is.Equal(err, auth.ErrLinkUsed) // too late
+
+		n, err := authRepo.DeleteExpiredNonces(ctx)
+		is.NoErr(err)         // sweep
+		is.Equal(n, int64(1)) // only the expired link
+	})
+}
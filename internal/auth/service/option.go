@@ -0,0 +1,10 @@
+package service
+
+import "time"
+
+type Option func(*Service)
+
+// WithSweepPeriod sets how often the nonces of expired magic links are deleted.
+func WithSweepPeriod(d time.Duration) Option {
+	return func(s *Service) { s.sweep = d }
+}
@@ -3,13 +3,21 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 
+	"github.com/hyphengolang/noughts-and-crosses/internal/auth"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/auth/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
 	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
 	"github.com/hyphengolang/noughts-and-crosses/internal/service"
 	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
 
@@ -20,31 +28,50 @@ type Service struct {
 	m service.Router
 	e events.Broker
 	t token.Client
+	r repo.Repo
+
+	// sweep is how often expired magic links are forgotten
+	sweep time.Duration
+	// stop ends the sweep
+	stop context.CancelFunc
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
-func New(e events.Broker, t token.Client) *Service {
+func New(e events.Broker, t token.Client, r repo.Repo, opts ...Option) (*Service, error) {
 	s := &Service{
-		m: service.NewRouter(),
-		e: e,
-		t: t,
+		m:     service.NewRouter(),
+		e:     e,
+		t:     t,
+		r:     r,
+		sweep: 10 * time.Minute,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if err := s.listen(); err != nil {
+		return nil, err
 	}
-	go s.listen()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop = cancel
+	go s.sweepNonces(ctx)
 	s.routes()
-	return s
+	return s, nil
 }
 
+// Close stops deleting the nonces of expired magic links.
+func (s *Service) Close() { s.stop() }
+
 func (s *Service) routes() {
 	s.m.Post("/login", s.handleLogin())
-	// s.m.Delete("/login", s.handleLogout())
+	s.m.Delete("/login", s.handleLogout())
 	// should rename to `/login/verify` to
 	// avoid confusion or `/token/verify`
 	s.m.Get("/login", s.handleConfirmLogin())
 
-	// s.m.Get("/token", s.handleRefreshToken())
+	s.m.Get("/token", s.handleRefreshToken())
 }
 
 func (s *Service) handleLogin() http.HandlerFunc {
@@ -62,13 +89,14 @@ func (s *Service) handleLogin() http.HandlerFunc {
 			return
 		}
 
-		tk, err := s.t.SignToken(r.Context(), token.WithEnd(5*time.Minute), token.WithClaims(token.PrivateClaims{"email": q.Email}))
+		tk, err := s.signLink(r.Context(), q.Email, token.PurposeLogin)
 		if err != nil {
 			s.m.Respond(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		if err := s.e.Conn().Publish(events.EventSendLoginConfirm, events.DataLoginConfirm{Email: q.Email, Token: tk}); err != nil {
+		// kept by the mail stream until it is sent
+		if err := events.TopicSendLoginConfirm.Store(r.Context(), s.e, events.DataLoginConfirm{Email: q.Email, Token: tk}); err != nil {
 			s.m.Respond(w, r, err, http.StatusInternalServerError)
 			return
 		}
@@ -79,170 +107,393 @@ func (s *Service) handleLogin() http.HandlerFunc {
 	}
 }
 
+const (
+	linkTTL         = 5 * time.Minute
+	accessTokenTTL  = 30 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+var (
+	ErrNoProfile = errs.New(errs.NotFound, "no profile exists for this email")
+	ErrBanned    = errs.New(errs.PermissionDenied, "profile has been banned")
+)
+
 func (s *Service) handleConfirmLogin() http.HandlerFunc {
 	type P struct {
 		Username     string  `json:"username"`
 		AccessToken  string  `json:"accessToken"`
 		RefreshToken string  `json:"refreshToken"`
+		CSRFToken    string  `json:"csrfToken"`
 		PhotoURL     *string `json:"photoUrl"` //optional
 	}
 
+	// getProfile asks the registry who the email belongs to
+	getProfile := func(ctx context.Context, email string) (*events.DataProfile, error) {
+		profile, err := events.EndpointGetProfileByEmail.Request(ctx, s.e, events.DataEmail{Email: email})
+		if err != nil {
+			return nil, err
+		}
+
+		if profile.ID == uuid.Nil {
+			return nil, ErrNoProfile
+		}
+		return &profile, nil
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		tk, err := s.t.ParseRequest(r)
+		tk, err := s.t.ParseRequest(r, token.RequirePurpose(token.PurposeLogin))
 		if err != nil {
-			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			s.m.Respond(w, r, errs.Token(err), http.StatusUnauthorized)
 			return
 		}
 
-		// TODO: ASK REGISTRY IF USER EXISTS OR NOT
 		email, _ := tk.PrivateClaims()["email"].(string)
+		if email == "" {
+			s.m.Respond(w, r, errs.New(errs.TokenInvalid, "token is not a login link"), http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.consumeLink(r.Context(), tk); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, auth.ErrLinkUsed) {
+				status = http.StatusUnauthorized
+			}
+			s.m.Respond(w, r, err, status)
+			return
+		}
+
+		data, err := getProfile(r.Context(), email)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNoProfile) {
+				status = http.StatusNotFound
+			}
+			s.m.Respond(w, r, err, status)
+			return
+		}
+
+		if data.Banned {
+			s.m.Respond(w, r, ErrBanned, http.StatusForbidden)
+			return
+		}
+
+		claims := token.PrivateClaims{"username": data.Username, "email": email}
+		if data.PhotoURL != nil {
+			claims["photoUrl"] = *data.PhotoURL
+		}
+		// space separated, as in RFC 8693. Refreshed tokens keep the
+		// scopes granted at login.
+		if len(data.Scopes) > 0 {
+			claims["scope"] = strings.Join(data.Scopes, " ")
+		}
+
+		// the first refresh token starts a new family of sessions
+		jti := uuid.New()
+		accessToken, refreshToken, err := s.signTokens(r.Context(), data.ID, jti, claims)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
 
-		// TODO define a structure for this package
-		// raw, err := s.e.Request(&nats.Msg{Data: []byte(email)}, 5*time.Second)
-		// if err != nil {
-		// 	s.m.Respond(w, r, err, http.StatusNotFound)
-		// 	return
-		// }
-
-		// should include username, photoUrl & uid to be added to a jwt.
-		// data := struct {
-		// 	ID       uuid.UUID
-		// 	Username string
-		// 	PhotoURL *string //optional
-		// }{}
-		// if err := events.Decode(raw, &data); err != nil {
-		// 	s.m.Respond(w, r, err, http.StatusInternalServerError)
-		// 	return
-		// }
-
-		// claims := jot.PrivateClaims{}
-		// claims := jot.PrivateClaims{
-		// 	"username": data.Username,
-		// 	"photoUrl": data.PhotoURL,
-		// }
-		// accessToken, _ := s.tk.GenerateToken(r.Context(), jot.WithEnd(30*time.Minute), jot.WithPrivateClaims(claims), jot.WithSubject(data.ID.String()))
-		// if err != nil {
-		// 	s.m.Respond(w, r, err, http.StatusInternalServerError)
-		// 	return
-		// }
-		// claims["email"] = email
-		// refreshToken, _ := s.tk.GenerateToken(r.Context(), jot.WithEnd(7*24*time.Hour), jot.WithPrivateClaims(claims), jot.WithSubject(data.ID.String()))
-		// if err != nil {
-		// 	s.m.Respond(w, r, err, http.StatusInternalServerError)
-		// 	return
-		// }
+		args := repo.SetSessionArgs{
+			ID:        jti,
+			ProfileID: data.ID,
+			ExpiresAt: time.Now().Add(refreshTokenTTL),
+		}
+
+		if err := s.r.SetSession(r.Context(), args); err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		csrf, err := s.setSessionCookies(w, r, accessToken, refreshToken)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
 
 		s.m.Respond(w, r, P{
-			// AccessToken:  string(accessToken),
-			// RefreshToken: string(refreshToken),
-			Username: "tmp:" + email,
-			// Username:     data.Username,
-			// PhotoURL:     data.PhotoURL,
+			AccessToken:  string(accessToken),
+			RefreshToken: string(refreshToken),
+			CSRFToken:    csrf,
+			Username:     data.Username,
+			PhotoURL:     data.PhotoURL,
 		}, http.StatusOK)
 	}
 }
 
-func (s *Service) handleLogout() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		s.m.Respond(w, r, nil, http.StatusNotImplemented)
+// signLink issues a magic link for the email. Its `jti` is recorded
+// so that the link can only be confirmed once.
+func (s *Service) signLink(ctx context.Context, email string, purpose token.Purpose) ([]byte, error) {
+	jti := uuid.New()
+	tk, err := s.t.SignToken(ctx, token.WithEnd(linkTTL), token.WithClaims(token.PrivateClaims{"email": email}), token.WithID(jti.String()), token.WithPurpose(purpose))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.r.SetNonce(ctx, repo.NonceArgs{ID: jti, ExpiresAt: time.Now().Add(linkTTL)}); err != nil {
+		return nil, err
 	}
+	return tk, nil
 }
 
-func (s *Service) handleRefreshToken() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		s.m.Respond(w, r, nil, http.StatusNotImplemented)
+// consumeLink marks a magic link as used, returning `auth.ErrLinkUsed`
+// if it already was or if this service never issued it
+func (s *Service) consumeLink(ctx context.Context, tk jwt.Token) error {
+	jti, err := uuid.Parse(tk.JwtID())
+	if err != nil {
+		return auth.ErrLinkUsed
 	}
+	return s.r.ConsumeNonce(ctx, repo.UUIDArgs{ID: jti})
 }
 
-func (s *Service) listen() {
-	// responds back to `mailing`
-	s.e.Conn().Subscribe(events.EventGenerateSignupToken, s.generateSignupToken())
-	// responds back to `registry`
-	s.e.Conn().Subscribe(events.EventVerifySignupToken, s.verifySignupToken())
-	// responds back to `registry`
-	s.e.Conn().Subscribe(events.EventCreateProfileValidation, s.verifyCreateProfileToken())
+// sweepNonces periodically deletes the nonces of expired magic links
+// until ctx is done
+func (s *Service) sweepNonces(ctx context.Context) {
+	t := time.NewTicker(s.sweep)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := s.r.DeleteExpiredNonces(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("sweep nonces: %v", err)
+			}
+		}
+	}
 }
 
-func (s *Service) verifyCreateProfileToken() nats.MsgHandler {
-	type D struct{ events.Data[struct{}] }
+// signTokens issues an access token and a refresh token for the user. Only
+// the refresh token has a `jti`, which is the id of its session, and only
+// it carries the email.
+func (s *Service) signTokens(ctx context.Context, uid, jti uuid.UUID, claims token.PrivateClaims) (accessToken, refreshToken []byte, err error) {
+	access := token.PrivateClaims{}
+	for k, v := range claims {
+		if k != "email" {
+			access[k] = v
+		}
+	}
 
-	return func(msg *nats.Msg) {
-		var d D
+	accessToken, err = s.t.SignToken(ctx, token.WithEnd(accessTokenTTL), token.WithClaims(access), token.WithSubject(uid.String()), token.WithPurpose(token.PurposeAccess))
+	if err != nil {
+		return nil, nil, err
+	}
 
-		var payload events.DataAuthToken
-		if err := events.Unmarshal(msg.Data, &payload); err != nil {
-			msg.Respond(d.Errorf("failed to decode data: %v", err))
-			return
+	refreshToken, err = s.t.SignToken(ctx, token.WithEnd(refreshTokenTTL), token.WithClaims(claims), token.WithSubject(uid.String()), token.WithID(jti.String()), token.WithPurpose(token.PurposeRefresh))
+	if err != nil {
+		return nil, nil, err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// setSessionCookies lets browsers keep the tokens out of reach of scripts.
+// It returns the CSRF token that must be sent back with the cookies.
+func (s *Service) setSessionCookies(w http.ResponseWriter, r *http.Request, accessToken, refreshToken []byte) (string, error) {
+	csrf, err := service.NewCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.m.SetCookie(w, r, service.NewCookie(service.AccessTokenCookie, string(accessToken), accessTokenTTL))
+	s.m.SetCookie(w, r, service.NewCookie(service.RefreshTokenCookie, string(refreshToken), refreshTokenTTL))
+
+	c := service.NewCookie(service.CSRFCookie, csrf, refreshTokenTTL)
+	// read by scripts to set the `X-CSRF-Token` header
+	c.HttpOnly = false
+	s.m.SetCookie(w, r, c)
+	return csrf, nil
+}
+
+func (s *Service) clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{service.AccessTokenCookie, service.RefreshTokenCookie, service.CSRFCookie} {
+		s.m.SetCookie(w, r, service.NewCookie(name, "", -1))
+	}
+}
+
+// sessionFromRequest reads the session id from the refresh token in the
+// request, sent either as a bearer token or as a cookie
+func (s *Service) sessionFromRequest(r *http.Request) (jwt.Token, uuid.UUID, error) {
+	// refreshing changes the session even though it is a GET
+	if r.Header.Get("Authorization") == "" {
+		if err := service.VerifyCSRF(r); err != nil {
+			return nil, uuid.Nil, err
 		}
+	}
 
-		tk, err := s.t.ParseToken(payload.Token)
+	tk, err := service.ParseRequest(s.t, r, service.RefreshTokenCookie, token.RequirePurpose(token.PurposeRefresh))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	jti, err := uuid.Parse(tk.JwtID())
+	if err != nil || tk.Subject() == "" {
+		return nil, uuid.Nil, errs.New(errs.TokenInvalid, "token is not a refresh token")
+	}
+	return tk, jti, nil
+}
+
+// handleLogout revokes the session of the refresh token and
+// every session rotated from the same login
+func (s *Service) handleLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, jti, err := s.sessionFromRequest(r)
 		if err != nil {
-			msg.Respond(d.Errorf("failed to parse token: %v", err))
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
 			return
 		}
 
-		if email := tk.PrivateClaims()["email"]; email != payload.Email {
-			msg.Respond(d.Errorf("something went wrong with the verifying identity"))
+		if err := s.r.RevokeSession(r.Context(), repo.UUIDArgs{ID: jti}); err != nil {
+			if errors.Is(err, pg.ErrNoRowsAffected) {
+				s.m.Respond(w, r, auth.ErrSessionInvalid, http.StatusUnauthorized)
+				return
+			}
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		// emails match so this is ok!
-		if err := msg.Respond(d.Bytes()); err != nil {
-			log.Printf("messages response: %v", err)
-		}
-
+		s.clearSessionCookies(w, r)
+		s.m.Respond(w, r, nil, http.StatusNoContent)
 	}
 }
 
-func (s *Service) verifySignupToken() nats.MsgHandler {
-	type D struct{ events.Data[string] }
+// handleRefreshToken swaps a refresh token for a new access token and a new
+// refresh token. The old refresh token cannot be used again; if it is, the
+// session it belonged to is revoked as the token has probably been stolen.
+func (s *Service) handleRefreshToken() http.HandlerFunc {
+	type P struct {
+		AccessToken  string `json:"accessToken"`
+		RefreshToken string `json:"refreshToken"`
+		CSRFToken    string `json:"csrfToken,omitempty"`
+	}
 
-	return func(msg *nats.Msg) {
-		var d D
+	return func(w http.ResponseWriter, r *http.Request) {
+		tk, jti, err := s.sessionFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
 
-		var payload events.DataToken
-		if err := s.e.Conn().Enc.Decode(msg.Subject, msg.Data, &payload); err != nil {
-			msg.Respond(d.Errorf("decode msg: %v", err))
+		uid, err := uuid.Parse(tk.Subject())
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
 			return
 		}
 
-		jwt, err := s.t.ParseToken(payload.Token)
+		// sign first so that a failure cannot leave the session rotated
+		// to a token the client never receives
+		next := uuid.New()
+		accessToken, refreshToken, err := s.signTokens(r.Context(), uid, next, tk.PrivateClaims())
 		if err != nil {
-			msg.Respond(d.Errorf("parse token: %v", err))
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		args := repo.RotateSessionArgs{
+			ID:        jti,
+			NextID:    next,
+			ExpiresAt: time.Now().Add(refreshTokenTTL),
+		}
+
+		if _, err := s.r.RotateSession(r.Context(), args); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, auth.ErrSessionInvalid) || errors.Is(err, auth.ErrSessionReused) {
+				status = http.StatusUnauthorized
+			}
+			s.m.Respond(w, r, err, status)
 			return
 		}
 
-		d.Value = jwt.PrivateClaims()["email"].(string)
-		if err := msg.Respond(d.Bytes()); err != nil {
-			log.Printf("messages response: %v", err)
+		// cookie sessions are given new cookies
+		var csrf string
+		if r.Header.Get("Authorization") == "" {
+			if csrf, err = s.setSessionCookies(w, r, accessToken, refreshToken); err != nil {
+				s.m.Respond(w, r, err, http.StatusInternalServerError)
+				return
+			}
 		}
+
+		s.m.Respond(w, r, P{
+			AccessToken:  string(accessToken),
+			RefreshToken: string(refreshToken),
+			CSRFToken:    csrf,
+		}, http.StatusOK)
 	}
 }
 
-func (s *Service) generateSignupToken() nats.MsgHandler {
-	type D struct{ events.Data[[]byte] }
+func (s *Service) listen() error {
+	// login links are sent by `mailing`, which may not be running yet
+	if err := events.StreamMail.Add(s.e); err != nil {
+		return err
+	}
+	// responds back to `mailing`
+	if err := events.EndpointGenerateSignupToken.Handle(s.e, s.generateSignupToken()); err != nil {
+		return err
+	}
+	// responds back to `registry`
+	if err := events.EndpointVerifySignupToken.Handle(s.e, s.verifySignupToken()); err != nil {
+		return err
+	}
+	// responds back to `registry`
+	if err := events.EndpointCreateProfileValidation.Handle(s.e, s.verifyCreateProfileToken()); err != nil {
+		return err
+	}
+	// one instance ends the sessions of each banned or deleted profile
+	return events.TopicProfileClosed.QueueSubscribe(s.e, "workers", s.handleProfileClosed())
+}
 
-	return func(msg *nats.Msg) {
-		var d D
+func (s *Service) handleProfileClosed() func(d *events.DataProfileClosed) {
+	return func(d *events.DataProfileClosed) {
+		err := s.r.RevokeProfileSessions(context.Background(), repo.UUIDArgs{ID: d.ID})
+		if err != nil && !errors.Is(err, pg.ErrNoRowsAffected) {
+			log.Printf("revoke sessions of %s: %v", d.ID, err)
+		}
+	}
+}
 
-		var payload events.DataEmail
-		if err := events.Unmarshal(msg.Data, &payload); err != nil {
-			// log.Println(err)
-			msg.Respond(d.Errorf("decode error %v", err))
-			return
+func (s *Service) verifyCreateProfileToken() func(ctx context.Context, q events.DataAuthToken) (struct{}, error) {
+	return func(ctx context.Context, q events.DataAuthToken) (struct{}, error) {
+		tk, err := s.t.ParseToken(q.Token, token.RequirePurpose(token.PurposeSignup))
+		if err != nil {
+			return struct{}{}, errs.Token(fmt.Errorf("failed to parse token: %w", err))
+		}
+
+		if email := tk.PrivateClaims()["email"]; email != q.Email {
+			return struct{}{}, errs.New(errs.PermissionDenied, "something went wrong with the verifying identity")
 		}
 
-		tk, err := s.t.SignToken(context.Background(), token.WithEnd(5*time.Minute), token.WithClaims(token.PrivateClaims{"email": payload.Email}))
+		// emails match so this is ok!
+		return struct{}{}, nil
+	}
+}
+
+func (s *Service) verifySignupToken() func(ctx context.Context, q events.DataToken) (string, error) {
+	return func(ctx context.Context, q events.DataToken) (string, error) {
+		jwt, err := s.t.ParseToken(q.Token, token.RequirePurpose(token.PurposeSignup))
 		if err != nil {
-			// log.Println(err)
-			msg.Respond(d.Errorf("sign token: %v", err))
-			return
+			return "", errs.Token(fmt.Errorf("parse token: %w", err))
+		}
+
+		email, _ := jwt.PrivateClaims()["email"].(string)
+		if email == "" {
+			return "", errs.New(errs.TokenInvalid, "token is not a signup link")
+		}
+
+		if err := s.consumeLink(ctx, jwt); err != nil {
+			// keeps the code of `auth.ErrLinkUsed`
+			return "", fmt.Errorf("consume link: %w", err)
 		}
+		return email, nil
+	}
+}
 
-		// set value
-		d.Value = tk
-		if err := msg.Respond(d.Bytes()); err != nil {
-			log.Printf("messages response: %v", err)
+func (s *Service) generateSignupToken() func(ctx context.Context, q events.DataEmail) ([]byte, error) {
+	return func(ctx context.Context, q events.DataEmail) ([]byte, error) {
+		tk, err := s.signLink(ctx, q.Email, token.PurposeSignup)
+		if err != nil {
+			return nil, fmt.Errorf("sign token: %w", err)
 		}
+		return tk, nil
 	}
 }
@@ -0,0 +1,532 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/auth"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/auth/repository"
+	srv "github.com/hyphengolang/noughts-and-crosses/internal/auth/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// memRepo is an in-memory stand-in for the Postgres repository
+type memRepo struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*session
+	// nonces maps to whether the link was used
+	nonces map[uuid.UUID]bool
+	// sweeps counts the deletes of expired nonces
+	sweeps int
+}
+
+type session struct {
+	auth.Session
+	replaced, revoked bool
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{sessions: map[uuid.UUID]*session{}, nonces: map[uuid.UUID]bool{}}
+}
+
+func (m *memRepo) SetSession(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetSessionArgs)
+	m.sessions[a.ID] = &session{Session: auth.Session{ID: a.ID, FamilyID: a.ID, ProfileID: a.ProfileID, ExpiresAt: a.ExpiresAt}}
+	return nil
+}
+
+func (m *memRepo) RotateSession(ctx context.Context, args pgx.QueryRewriter) (*auth.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.RotateSessionArgs)
+	s, ok := m.sessions[a.ID]
+	switch {
+	case !ok, s.revoked:
+		return nil, auth.ErrSessionInvalid
+	case s.replaced:
+		m.revoke(s.FamilyID)
+		return nil, auth.ErrSessionReused
+	}
+
+	s.replaced = true
+	next := &session{Session: auth.Session{ID: a.NextID, FamilyID: s.FamilyID, ProfileID: s.ProfileID, ExpiresAt: a.ExpiresAt}}
+	m.sessions[a.NextID] = next
+	return &next.Session, nil
+}
+
+func (m *memRepo) RevokeSession(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[args.(repo.UUIDArgs).ID]
+	if !ok {
+		return pg.ErrNoRowsAffected
+	}
+	m.revoke(s.FamilyID)
+	return nil
+}
+
+func (m *memRepo) RevokeProfileSessions(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for _, s := range m.sessions {
+		if s.ProfileID == args.(repo.UUIDArgs).ID && !s.revoked {
+			s.revoked = true
+			count++
+		}
+	}
+
+	if count == 0 {
+		return pg.ErrNoRowsAffected
+	}
+	return nil
+}
+
+// active counts the sessions of the profile that have not been revoked
+func (m *memRepo) active(profile uuid.UUID) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, s := range m.sessions {
+		if s.ProfileID == profile && !s.revoked {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memRepo) revoke(family uuid.UUID) {
+	for _, s := range m.sessions {
+		if s.FamilyID == family {
+			s.revoked = true
+		}
+	}
+}
+
+func (m *memRepo) SetNonce(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nonces[args.(repo.NonceArgs).ID] = false
+	return nil
+}
+
+func (m *memRepo) ConsumeNonce(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := args.(repo.UUIDArgs).ID
+	if used, ok := m.nonces[id]; !ok || used {
+		return auth.ErrLinkUsed
+	}
+	m.nonces[id] = true
+	return nil
+}
+
+func (m *memRepo) DeleteExpiredNonces(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweeps++
+	return 0, nil
+}
+
+func (m *memRepo) swept() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sweeps
+}
+
+type tokens struct {
+	Username     string `json:"username"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	CSRFToken    string `json:"csrfToken"`
+}
+
+// cookies returns the cookies set by the response by name
+func cookies(res *http.Response) map[string]*http.Cookie {
+	m := map[string]*http.Cookie{}
+	for _, c := range res.Cookies() {
+		m[c.Name] = c
+	}
+	return m
+}
+
+// runJetStream starts a NATS server with JetStream, which keeps the mail
+func runJetStream(t *testing.T) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	ns := natsserver.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestConfirmLogin(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	johnDoe := uuid.New()
+
+	// stands in for the registry
+	_, err = ec.Subscribe(events.EventGetProfileByEmail, func(subj, reply string, q *events.DataEmail) {
+		var d events.Data[events.DataProfile]
+		switch q.Email {
+		case "john@doe.com":
+			d.Value = events.DataProfile{ID: johnDoe, Username: "john123doe", Scopes: []string{"games:play", "users:read"}}
+		case "banned@doe.com":
+			d.Value = events.DataProfile{ID: uuid.New(), Username: "banned", Banned: true}
+		}
+		ec.Publish(reply, d)
+	})
+	is.NoErr(err) // answer profile requests
+
+	tk := token.NewTokenClient()
+	mem := newMemRepo()
+	s, err := srv.New(events.NewClient(ec), tk, mem)
+	is.NoErr(err) // subscribe
+	t.Cleanup(s.Close)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	do := func(method, path, bearer string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err) // send request
+		return res
+	}
+
+	// stands in for mailing
+	links := make(chan *events.DataLoginConfirm, 1)
+	_, err = ec.BindRecvChan(events.EventSendLoginConfirm, links)
+	is.NoErr(err) // receive login links
+
+	// link asks for a magic link to be sent to the email
+	link := func(email string) string {
+		res, err := http.Post(ts.URL+"/login", "application/json", strings.NewReader(`{"email":"`+email+`"}`))
+		is.NoErr(err)                           // request login
+		is.Equal(res.StatusCode, http.StatusOK) // link sent
+
+		select {
+		case d := <-links:
+			is.Equal(d.Email, email) // sent to the email
+			return string(d.Token)
+		case <-time.After(time.Second):
+			t.Fatal("login link was not sent")
+			return ""
+		}
+	}
+
+	confirm := func(email string) *http.Response {
+		return do(http.MethodGet, "/login", link(email))
+	}
+
+	login := func() tokens {
+		res := confirm("john@doe.com")
+		is.Equal(res.StatusCode, http.StatusOK) // logged in
+
+		var p tokens
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+		return p
+	}
+
+	t.Run("issue tokens for a registered email", func(t *testing.T) {
+		p := login()
+		is.Equal(p.Username, "john123doe") // username from the registry
+
+		access, err := tk.ParseToken([]byte(p.AccessToken))
+		is.NoErr(err)                                                      // access token is valid
+		is.Equal(access.Subject(), johnDoe.String())                       // subject is the profile id
+		is.Equal(access.PrivateClaims()["scope"], "games:play users:read") // scopes of the role
+
+		refresh, err := tk.ParseToken([]byte(p.RefreshToken))
+		is.NoErr(err)                                            // refresh token is valid
+		is.True(refresh.Expiration().After(access.Expiration())) // refresh token lives longer
+	})
+
+	t.Run("no profile for the email", func(t *testing.T) {
+		res := confirm("jane@doe.com")
+		is.Equal(res.StatusCode, http.StatusNotFound) // nobody to log in
+	})
+
+	t.Run("banned users cannot log in", func(t *testing.T) {
+		res := confirm("banned@doe.com")
+		is.Equal(res.StatusCode, http.StatusForbidden) // banned
+	})
+
+	t.Run("links can only be used once", func(t *testing.T) {
+		l := link("john@doe.com")
+
+		res := do(http.MethodGet, "/login", l)
+		is.Equal(res.StatusCode, http.StatusOK) // logged in
+
+		res = do(http.MethodGet, "/login", l)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // replayed
+	})
+
+	t.Run("links must be issued by the service", func(t *testing.T) {
+		l, err := tk.SignToken(context.Background(), token.WithEnd(time.Minute), token.WithClaims(token.PrivateClaims{"email": "john@doe.com"}), token.WithPurpose(token.PurposeLogin))
+		is.NoErr(err) // sign a link without a nonce
+
+		res := do(http.MethodGet, "/login", string(l))
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // unknown link
+
+		res = do(http.MethodGet, "/login", login().RefreshToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // not a link
+	})
+
+	t.Run("signup links cannot log in", func(t *testing.T) {
+		var d struct{ events.Data[[]byte] }
+		err := ec.Request(events.EventGenerateSignupToken, events.DataEmail{Email: "john@doe.com"}, &d, time.Second)
+		is.NoErr(err) // request signup link
+
+		res := do(http.MethodGet, "/login", string(d.Value))
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // wrong purpose
+	})
+
+	t.Run("refresh rotates the refresh token", func(t *testing.T) {
+		first := login()
+
+		res := do(http.MethodGet, "/token", first.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusOK) // refreshed
+
+		var second tokens
+		is.NoErr(json.NewDecoder(res.Body).Decode(&second))
+		is.True(second.RefreshToken != first.RefreshToken) // rotated
+
+		res = do(http.MethodGet, "/token", second.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusOK) // the new token works
+	})
+
+	t.Run("reusing a refresh token revokes the session", func(t *testing.T) {
+		first := login()
+
+		res := do(http.MethodGet, "/token", first.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusOK) // refreshed
+
+		var second tokens
+		is.NoErr(json.NewDecoder(res.Body).Decode(&second))
+
+		res = do(http.MethodGet, "/token", first.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // reuse detected
+
+		res = do(http.MethodGet, "/token", second.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // whole family revoked
+	})
+
+	t.Run("access tokens cannot refresh", func(t *testing.T) {
+		res := do(http.MethodGet, "/token", login().AccessToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no session id
+	})
+
+	t.Run("login sets session cookies", func(t *testing.T) {
+		res := confirm("john@doe.com")
+		is.Equal(res.StatusCode, http.StatusOK) // logged in
+
+		var p tokens
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+
+		c := cookies(res)
+		for _, name := range []string{service.AccessTokenCookie, service.RefreshTokenCookie, service.CSRFCookie} {
+			is.True(c[name] != nil)                             // cookie is set
+			is.True(c[name].Secure)                             // only over https
+			is.Equal(c[name].SameSite, http.SameSiteStrictMode) // not sent cross-site
+		}
+		is.Equal(c[service.AccessTokenCookie].Value, p.AccessToken)   // access token cookie
+		is.Equal(c[service.RefreshTokenCookie].Value, p.RefreshToken) // refresh token cookie
+		is.True(c[service.AccessTokenCookie].HttpOnly)                // hidden from scripts
+		is.True(c[service.RefreshTokenCookie].HttpOnly)               // hidden from scripts
+		is.True(!c[service.CSRFCookie].HttpOnly)                      // read by scripts
+		is.Equal(c[service.CSRFCookie].Value, p.CSRFToken)            // returned in the body too
+	})
+
+	t.Run("cookie sessions need the CSRF header", func(t *testing.T) {
+		res := confirm("john@doe.com")
+		is.Equal(res.StatusCode, http.StatusOK) // logged in
+		c := cookies(res)
+
+		refresh := func(csrf string) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/token", nil)
+			req.AddCookie(c[service.RefreshTokenCookie])
+			req.AddCookie(c[service.CSRFCookie])
+			if csrf != "" {
+				req.Header.Set(service.CSRFHeader, csrf)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			is.NoErr(err) // send request
+			return res
+		}
+
+		res = refresh("")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no CSRF header
+
+		res = refresh("forged")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // wrong CSRF header
+
+		res = refresh(c[service.CSRFCookie].Value)
+		is.Equal(res.StatusCode, http.StatusOK) // refreshed
+
+		next := cookies(res)
+		is.True(next[service.RefreshTokenCookie] != nil)                                       // new refresh cookie
+		is.True(next[service.RefreshTokenCookie].Value != c[service.RefreshTokenCookie].Value) // rotated
+
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/login", nil)
+		req.AddCookie(next[service.RefreshTokenCookie])
+		req.AddCookie(next[service.CSRFCookie])
+		req.Header.Set(service.CSRFHeader, next[service.CSRFCookie].Value)
+
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err)                                                 // logout
+		is.Equal(res.StatusCode, http.StatusNoContent)                // logged out
+		is.Equal(cookies(res)[service.RefreshTokenCookie].MaxAge, -1) // cookie cleared
+	})
+
+	t.Run("logout revokes the session", func(t *testing.T) {
+		p := login()
+
+		res := do(http.MethodDelete, "/login", p.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusNoContent) // logged out
+
+		res = do(http.MethodGet, "/token", p.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // cannot refresh
+	})
+
+	t.Run("closing the profile revokes its sessions", func(t *testing.T) {
+		p := login()
+
+		err := ec.Publish(events.EventProfileClosed, events.DataProfileClosed{ID: johnDoe})
+		is.NoErr(err) // ban john
+
+		// the event is handled in the background
+		deadline := time.Now().Add(5 * time.Second)
+		for mem.active(johnDoe) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("sessions were not revoked")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		res := do(http.MethodGet, "/token", p.RefreshToken)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // cannot refresh
+	})
+}
+
+func TestSignupLink(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	// the server has subscriptions of its own
+	n := ns.NumSubscriptions()
+
+	tk := token.NewTokenClient()
+	s, err := srv.New(events.NewClient(ec), tk, newMemRepo())
+	is.NoErr(err) // subscribe
+	t.Cleanup(s.Close)
+
+	// wait for the service to subscribe in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for ns.NumSubscriptions() < n+4 {
+		if time.Now().After(deadline) {
+			t.Fatal("service did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var link struct{ events.Data[[]byte] }
+	err = ec.Request(events.EventGenerateSignupToken, events.DataEmail{Email: "john@doe.com"}, &link, time.Second)
+	is.NoErr(err)              // request signup link
+	is.NoErr(link.Err)         // link generated
+	is.True(link.Value != nil) // link has a token
+
+	verify := func() (string, error) {
+		var reply struct{ events.Data[string] }
+		err := ec.Request(events.EventVerifySignupToken, events.DataToken{Token: link.Value}, &reply, time.Second)
+		is.NoErr(err) // request verification
+		return reply.Value, reply.Err
+	}
+
+	email, err := verify()
+	is.NoErr(err)                   // first use is accepted
+	is.Equal(email, "john@doe.com") // email from the link
+
+	_, err = verify()
+	is.True(err != nil) // replay is rejected
+}
+
+func TestSweepNonces(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	mem := newMemRepo()
+	s, err := srv.New(events.NewClient(ec), token.NewTokenClient(), mem, srv.WithSweepPeriod(10*time.Millisecond))
+	is.NoErr(err) // start sweeping
+
+	deadline := time.Now().Add(time.Second)
+	for mem.swept() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("nonces were not swept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Close()
+	// a sweep already under way may still finish
+	time.Sleep(20 * time.Millisecond)
+	n := mem.swept()
+
+	time.Sleep(50 * time.Millisecond)
+	is.Equal(mem.swept(), n) // no sweeps after close
+}
@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+)
+
+var (
+	ErrSessionInvalid = errs.New(errs.Unauthenticated, "session is invalid or has expired")
+	ErrSessionReused  = errs.New(errs.Unauthenticated, "refresh token was already used, session revoked")
+)
+
+// Session is the server-side record of a refresh token. ID is the token's
+// `jti`. Every token rotated from the same login shares a family, so that
+// a stolen token being reused can revoke all of them at once.
+type Session struct {
+	ID        uuid.UUID
+	FamilyID  uuid.UUID
+	ProfileID uuid.UUID
+	ExpiresAt time.Time
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"strconv"
+	"time"
 )
 
 var (
@@ -15,8 +16,14 @@ var (
 	NATSURI      string
 	NATSToken    string
 	NATSSeed     string
+	NATSEncoding string
 	DBURL        string
 	JWTSecret    string
+	JWTKeyFile   string
+	JWTRotation  time.Duration
+	JWTIssuer    string
+	JWTAudience  string
+	JWTLeeway    time.Duration
 )
 
 func init() {
@@ -31,7 +38,18 @@ func init() {
 	flag.StringVar(&NATSURI, "nats-uri", os.Getenv("NATS_URI"), "nats uri")
 	flag.StringVar(&NATSToken, "nats-token", os.Getenv("NATS_TOKEN"), "nats token")
 	flag.StringVar(&NATSSeed, "nats-seed", os.Getenv("NATS_SEED"), "nats seed")
+	flag.StringVar(&NATSEncoding, "nats-encoding", os.Getenv("NATS_ENCODING"), "encoding of messages on the bus, json (default) or protobuf")
 	flag.StringVar(&JWTSecret, "jwt-secret", os.Getenv("JWT_SECRET"), "jwt secret")
+	flag.StringVar(&JWTKeyFile, "jwt-key-file", os.Getenv("JWT_KEY_FILE"), "pem or jwk set (.json) file of jwt keys, read instead of the secret")
 
-	flag.Parse()
+	rotation, _ := time.ParseDuration(os.Getenv("JWT_ROTATION"))
+	flag.DurationVar(&JWTRotation, "jwt-rotation", rotation, "how often to rotate the jwt signing key, 0 to never; only for a single instance")
+	flag.StringVar(&JWTIssuer, "jwt-issuer", os.Getenv("JWT_ISSUER"), "jwt issuer")
+	flag.StringVar(&JWTAudience, "jwt-audience", os.Getenv("JWT_AUDIENCE"), "jwt audience")
+
+	leeway, _ := time.ParseDuration(os.Getenv("JWT_LEEWAY"))
+	flag.DurationVar(&JWTLeeway, "jwt-leeway", leeway, "clock skew allowed when validating jwt times")
+
+	// NOTE flags are parsed by `main` so that importing this
+	// package does not clash with the flags of `go test`
 }
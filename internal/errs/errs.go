@@ -0,0 +1,159 @@
+// Package errs gives errors a stable code that survives both HTTP responses
+// and NATS replies, so that callers can act on the kind of failure rather
+// than on its message.
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// Code identifies a kind of failure. Codes never change once published,
+// unlike messages.
+type Code string
+
+const (
+	Internal         Code = "internal"
+	InvalidArgument  Code = "invalid_argument"
+	Unauthenticated  Code = "unauthenticated"
+	TokenExpired     Code = "token_expired"
+	TokenInvalid     Code = "token_invalid"
+	PermissionDenied Code = "permission_denied"
+	NotFound         Code = "not_found"
+	Conflict         Code = "conflict"
+	Unavailable      Code = "unavailable"
+)
+
+// Status is the HTTP status of a response failing with the code
+func (c Code) Status() int {
+	switch c {
+	case InvalidArgument:
+		return http.StatusBadRequest
+	case Unauthenticated, TokenExpired, TokenInvalid:
+		return http.StatusUnauthorized
+	case PermissionDenied:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// CodeFor is the code of a response that failed with the HTTP status
+func CodeFor(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return InvalidArgument
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusConflict:
+		return Conflict
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	default:
+		return Internal
+	}
+}
+
+// Error is an error with a code. It is used as a value, not a pointer.
+// The cause is not sent over NATS.
+type Error struct {
+	Code Code   `json:"code"`
+	Msg  string `json:"message"`
+
+	err error
+}
+
+func (e Error) Error() string { return e.Msg }
+
+func (e Error) Unwrap() error { return e.err }
+
+// New returns an error with the code and message
+func New(code Code, msg string) error {
+	return Error{Code: code, Msg: msg}
+}
+
+// Errorf returns an error with the code and a formatted message.
+// The `%w` directive is not kept, use `Wrap` instead.
+func Errorf(code Code, format string, a ...any) error {
+	return Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// Wrap gives `err` the code, keeping its message, unless
+// it already has one. A nil `err` stays nil.
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return Error{Code: code, Msg: err.Error(), err: err}
+}
+
+// From returns `err` as an `Error`, recognising the errors of the
+// packages that services share. Anything else is `Internal`.
+func From(err error) Error {
+	var e Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	code := Internal
+	switch {
+	case errors.Is(err, pgx.ErrNoRows), errors.Is(err, pg.ErrNoRowsAffected):
+		code = NotFound
+	case pg.IsUniqueViolation(err):
+		code = Conflict
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, nats.ErrNoResponders), errors.Is(err, context.DeadlineExceeded):
+		code = Unavailable
+	}
+	return Error{Code: code, Msg: err.Error(), err: err}
+}
+
+// CodeOf returns the code of `err`, which is `Internal` if it has none
+func CodeOf(err error) Code {
+	return From(err).Code
+}
+
+// Is reports whether `err` has the code
+func Is(err error, code Code) bool {
+	return err != nil && CodeOf(err) == code
+}
+
+// Status is the HTTP status of a response that failed with `err`
+func Status(err error) int {
+	return CodeOf(err).Status()
+}
+
+// Token gives an error from parsing a token its code. A token is only
+// found to have expired once its signature is verified, so `TokenExpired`
+// is never given to a forged token; every other failure is `TokenInvalid`.
+func Token(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, jwt.ErrTokenExpired()) {
+		return Wrap(TokenExpired, err)
+	}
+	return Wrap(TokenInvalid, err)
+}
@@ -0,0 +1,57 @@
+package errs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/nats-io/nats.go"
+)
+
+func TestCode(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("known errors", func(t *testing.T) {
+		is.Equal(errs.CodeOf(pgx.ErrNoRows), errs.NotFound)                                  // no rows
+		is.Equal(errs.CodeOf(fmt.Errorf("delete: %w", pg.ErrNoRowsAffected)), errs.NotFound) // wrapped
+		is.Equal(errs.CodeOf(nats.ErrTimeout), errs.Unavailable)                             // no reply
+		is.Equal(errs.CodeOf(errors.New("boom")), errs.Internal)                             // anything else
+	})
+
+	t.Run("wrapping keeps the first code", func(t *testing.T) {
+		err := errs.Wrap(errs.Conflict, errs.New(errs.NotFound, "gone"))
+		is.Equal(errs.CodeOf(err), errs.NotFound) // not replaced
+		is.Equal(errs.Status(err), http.StatusNotFound)
+
+		err = fmt.Errorf("get: %w", errs.Wrap(errs.InvalidArgument, errors.New("bad")))
+		is.True(errs.Is(err, errs.InvalidArgument)) // found through fmt.Errorf
+		is.True(!errs.Is(nil, errs.Internal))       // nil has no code
+	})
+
+	t.Run("sentinel errors can be compared", func(t *testing.T) {
+		errGone := errs.New(errs.NotFound, "gone")
+		is.True(errors.Is(fmt.Errorf("get: %w", errGone), errGone)) // same error
+	})
+
+	t.Run("expired tokens are told apart", func(t *testing.T) {
+		tk := token.NewTokenClient()
+
+		p, err := tk.SignToken(context.Background(), token.WithEnd(-time.Minute))
+		is.NoErr(err) // sign an expired token
+		_, err = tk.ParseToken(p)
+		is.Equal(errs.CodeOf(errs.Token(err)), errs.TokenExpired) // expired
+
+		_, err = token.NewTokenClient().ParseToken(p)
+		is.Equal(errs.CodeOf(errs.Token(err)), errs.TokenInvalid) // signed by another key
+
+		is.NoErr(errs.Token(nil)) // no error
+	})
+}
@@ -1,17 +1,35 @@
 package events
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/nats-io/nats.go"
 )
 
+// Broker is the connection of one service to the bus. Subscriptions made
+// through a `Topic` or an `Endpoint` belong to the broker, which drains
+// them when the service shuts down.
 type Broker interface {
 	Conn() *nats.EncodedConn
+	// Drain stops the subscriptions of the broker once the messages they
+	// have received are handled, or returns when `ctx` is done
+	Drain(ctx context.Context) error
+
+	subscribe(subject, queue string, cb nats.Handler) error
+	consume(stream string, c *nats.ConsumerConfig, cb nats.MsgHandler) error
 }
 
 var _ Broker = (*pubsub)(nil)
 
 type pubsub struct {
 	ec *nats.EncodedConn
+
+	mu   sync.Mutex
+	subs []*nats.Subscription
 }
 
 func NewClient(ec *nats.EncodedConn) Broker {
@@ -20,6 +38,78 @@ func NewClient(ec *nats.EncodedConn) Broker {
 
 func (ps *pubsub) Conn() *nats.EncodedConn { return ps.ec }
 
+func (ps *pubsub) subscribe(subject, queue string, cb nats.Handler) error {
+	sub, err := ps.ec.QueueSubscribe(subject, queue, cb)
+	if err != nil {
+		return fmt.Errorf("subscribe to %q: %w", subject, err)
+	}
+
+	ps.track(sub)
+	return nil
+}
+
+// consume binds to the durable consumer `c` of the stream, creating it
+// first. A consumer the library creates would be deleted on drain.
+func (ps *pubsub) consume(stream string, c *nats.ConsumerConfig, cb nats.MsgHandler) error {
+	js, err := ps.ec.Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	_, err = js.ConsumerInfo(stream, c.Durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(stream, c)
+	case err == nil:
+		_, err = js.UpdateConsumer(stream, c)
+	}
+	if err != nil {
+		return fmt.Errorf("add consumer %s: %w", c.Durable, err)
+	}
+
+	sub, err := js.QueueSubscribe(c.FilterSubject, c.DeliverGroup, cb, nats.Bind(stream, c.Durable), nats.ManualAck())
+	if err != nil {
+		return fmt.Errorf("subscribe to %q: %w", c.FilterSubject, err)
+	}
+
+	ps.track(sub)
+	return nil
+}
+
+func (ps *pubsub) track(sub *nats.Subscription) {
+	ps.mu.Lock()
+	ps.subs = append(ps.subs, sub)
+	ps.mu.Unlock()
+}
+
+func (ps *pubsub) Drain(ctx context.Context) error {
+	ps.mu.Lock()
+	subs := ps.subs
+	ps.subs = nil
+	ps.mu.Unlock()
+
+	var err error
+	for _, sub := range subs {
+		if e := sub.Drain(); e != nil && !errors.Is(e, nats.ErrBadSubscription) && err == nil {
+			err = fmt.Errorf("drain %q: %w", sub.Subject, e)
+		}
+	}
+
+	// a drained subscription becomes invalid once its last message is handled
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for _, sub := range subs {
+		for sub.IsValid() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick.C:
+			}
+		}
+	}
+	return err
+}
+
 // func (ps *pubsub) Subscribe(subject string, cb nats.MsgHandler) {
 // 	_, err := ps.ec.Subscribe(subject, cb)
 // 	if err != nil {
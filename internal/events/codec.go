@@ -0,0 +1,145 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// Names of the encoders registered with NATS, to be given to
+// `nats.NewEncodedConn` in place of `nats.GOB_ENCODER`
+const (
+	JSON_ENCODER     = "events.json"
+	PROTOBUF_ENCODER = "events.protobuf"
+)
+
+func init() {
+	nats.RegisterEncoder(JSON_ENCODER, NewEncoder(JSON{}))
+	nats.RegisterEncoder(PROTOBUF_ENCODER, NewEncoder(Protobuf{}))
+}
+
+// ErrSchemaVersion is returned when a message is newer than its receiver
+var ErrSchemaVersion = errors.New("unsupported schema version")
+
+// Envelope describes a message on the bus, whatever the language of its
+// sender. The payload is written alongside it by a `Codec`.
+type Envelope struct {
+	// Type is the subject the message was published on. A reply
+	// has the type of the request that it answers.
+	Type string `json:"type"`
+	// Version is the version of the schema of the payload
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	// CorrelationID is shared by a request and its reply. It is the
+	// id of the message when the message is not a reply.
+	CorrelationID string    `json:"correlationId"`
+	Time          time.Time `json:"time"`
+}
+
+// Codec writes an envelope and its payload in a format that
+// consumers outside of Go can read
+type Codec interface {
+	Marshal(env Envelope, v any) ([]byte, error)
+	// Unmarshal reads the envelope, and the payload into `v` unless it is nil
+	Unmarshal(p []byte, env *Envelope, v any) error
+}
+
+// Versioner is implemented by payloads whose schema has changed since
+// the first version. Payloads that do not implement it are version 1.
+type Versioner interface {
+	SchemaVersion() int
+}
+
+func schemaVersion(v any) int {
+	if v, ok := v.(Versioner); ok {
+		return v.SchemaVersion()
+	}
+	return 1
+}
+
+// Raw is a payload that was encoded as JSON before it was sent, such as one
+// read back from storage. It is sent as it is, with the version it was
+// written with.
+type Raw struct {
+	Payload json.RawMessage
+	Version int
+}
+
+func (r Raw) MarshalJSON() ([]byte, error) { return r.Payload, nil }
+
+func (r Raw) SchemaVersion() int { return r.Version }
+
+var _ nats.Encoder = (*Encoder)(nil)
+
+// Encoder puts each value sent over a `nats.EncodedConn` in an `Envelope`
+type Encoder struct {
+	c Codec
+}
+
+func NewEncoder(c Codec) *Encoder {
+	return &Encoder{c: c}
+}
+
+// reply is a value that answers a request
+type reply struct {
+	typ, correlationID string
+	v                  any
+}
+
+func (e *Encoder) Encode(subject string, v any) ([]byte, error) {
+	env := Envelope{
+		Type:    subject,
+		Version: schemaVersion(v),
+		ID:      uuid.NewString(),
+		Time:    time.Now().UTC(),
+	}
+	env.CorrelationID = env.ID
+
+	if r, ok := v.(reply); ok {
+		env.Type, env.CorrelationID, env.Version = r.typ, r.correlationID, schemaVersion(r.v)
+		v = r.v
+	}
+	return e.c.Marshal(env, v)
+}
+
+// Decode reads the payload into `vPtr`, unless it was written with a
+// newer version of its schema than `vPtr` knows of
+func (e *Encoder) Decode(subject string, data []byte, vPtr any) error {
+	var env Envelope
+	if err := e.c.Unmarshal(data, &env, nil); err != nil {
+		return fmt.Errorf("decode envelope on %q: %w", subject, err)
+	}
+
+	if want := schemaVersion(vPtr); env.Version > want {
+		return fmt.Errorf("%w: %q is version %d, want %d", ErrSchemaVersion, env.Type, env.Version, want)
+	}
+	return e.c.Unmarshal(data, &env, vPtr)
+}
+
+// Open reads the envelope of a message sent with an `Encoder`
+func Open(ec *nats.EncodedConn, data []byte) (Envelope, error) {
+	var env Envelope
+	e, ok := ec.Enc.(*Encoder)
+	if !ok {
+		return env, fmt.Errorf("%T does not write an envelope", ec.Enc)
+	}
+	return env, e.c.Unmarshal(data, &env, nil)
+}
+
+// Respond answers the request with `v`, giving the reply the type and
+// correlation id of the request
+func Respond(ec *nats.EncodedConn, msg *nats.Msg, v any) error {
+	if env, err := Open(ec, msg.Data); err == nil {
+		v = reply{typ: env.Type, correlationID: env.CorrelationID, v: v}
+	}
+
+	p, err := ec.Enc.Encode(msg.Reply, v)
+	if err != nil {
+		return err
+	}
+	return msg.Respond(p)
+}
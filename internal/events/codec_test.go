@@ -0,0 +1,140 @@
+package events_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/prelude/testing/is"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// version2 is a payload whose schema has changed once
+type version2 struct{ Email string }
+
+func (version2) SchemaVersion() int { return 2 }
+
+func TestCodec(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("json can be read without Go types", func(t *testing.T) {
+		p, err := events.NewEncoder(events.JSON{}).Encode(events.EventSendSignupConfirm, events.DataEmail{Email: "john@doe.com"})
+		is.NoErr(err) // encode
+
+		// what a consumer in another language sees
+		var v struct {
+			Type          string            `json:"type"`
+			Version       int               `json:"version"`
+			ID            string            `json:"id"`
+			CorrelationID string            `json:"correlationId"`
+			Time          string            `json:"time"`
+			Payload       map[string]string `json:"payload"`
+		}
+		is.NoErr(json.Unmarshal(p, &v)) // plain json
+
+		is.Equal(v.Type, "user.email.signup")        // type
+		is.Equal(v.Version, 1)                       // schema version
+		is.True(v.ID != "")                          // id
+		is.Equal(v.CorrelationID, v.ID)              // not a reply
+		is.Equal(v.Payload["email"], "john@doe.com") // payload
+		_, err = time.Parse(time.RFC3339Nano, v.Time)
+		is.NoErr(err) // timestamp
+	})
+
+	for name, enc := range map[string]*events.Encoder{
+		"json":     events.NewEncoder(events.JSON{}),
+		"protobuf": events.NewEncoder(events.Protobuf{}),
+	} {
+		t.Run(name+" round-trips a reply", func(t *testing.T) {
+			type D struct {
+				events.Data[events.DataProfile]
+			}
+
+			var input D
+			input.Value.Username = "johndoe"
+			input.Value.Scopes = []string{"games:play"}
+
+			p, err := enc.Encode("_INBOX.reply", input.Fail(errs.New(errs.NotFound, "no profile")))
+			is.NoErr(err) // encode
+
+			var output D
+			is.NoErr(enc.Decode("_INBOX.reply", p, &output))      // decode
+			is.Equal(output.Value.Username, "johndoe")            // value
+			is.Equal(output.Value.Scopes, []string{"games:play"}) // slice
+			is.Equal(errs.CodeOf(output.Err), errs.NotFound)      // code survives
+			is.Equal(output.Err.Error(), "no profile")            // message survives
+		})
+
+		t.Run(name+" rejects newer schemas", func(t *testing.T) {
+			p, err := enc.Encode(events.EventSendSignupConfirm, version2{Email: "john@doe.com"})
+			is.NoErr(err) // encode
+
+			var v events.DataEmail
+			err = enc.Decode(events.EventSendSignupConfirm, p, &v)
+			is.True(errors.Is(err, events.ErrSchemaVersion)) // version 1 cannot read version 2
+
+			var w version2
+			is.NoErr(enc.Decode(events.EventSendSignupConfirm, p, &w)) // same version
+			is.Equal(w.Email, "john@doe.com")
+		})
+	}
+
+	t.Run("protobuf messages are sent as they are", func(t *testing.T) {
+		enc := events.NewEncoder(events.Protobuf{})
+
+		p, err := enc.Encode("analytics", structpb.NewStringValue("hello"))
+		is.NoErr(err) // encode
+
+		var v structpb.Value
+		is.NoErr(enc.Decode("analytics", p, &v)) // decode
+		is.Equal(v.GetStringValue(), "hello")
+	})
+}
+
+func TestRespond(t *testing.T) {
+	is := is.New(t)
+
+	ns := natsserver.RunRandClientPortServer()
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	_, err = ec.Subscribe(events.EventGetProfileByEmail, func(msg *nats.Msg) {
+		var q events.DataEmail
+		is.NoErr(ec.Enc.Decode(msg.Subject, msg.Data, &q)) // decode request
+
+		var d events.Data[string]
+		d.Value = q.Email
+		is.NoErr(events.Respond(ec, msg, d)) // reply
+	})
+	is.NoErr(err) // answer requests
+
+	p, err := ec.Enc.Encode(events.EventGetProfileByEmail, events.DataEmail{Email: "john@doe.com"})
+	is.NoErr(err) // encode request
+
+	msg, err := nc.Request(events.EventGetProfileByEmail, p, time.Second)
+	is.NoErr(err) // request
+
+	req, err := events.Open(ec, p)
+	is.NoErr(err) // envelope of request
+	res, err := events.Open(ec, msg.Data)
+	is.NoErr(err) // envelope of reply
+
+	is.Equal(res.Type, events.EventGetProfileByEmail) // type of the request
+	is.Equal(res.CorrelationID, req.ID)               // correlated
+	is.True(res.ID != req.ID)                         // own id
+
+	var d events.Data[string]
+	is.NoErr(ec.Enc.Decode(msg.Subject, msg.Data, &d)) // decode reply
+	is.Equal(d.Value, "john@doe.com")
+}
@@ -1,54 +1,58 @@
 package events
 
 import (
-	"encoding/gob"
-	"fmt"
-	"log"
+	"encoding/json"
 
-	"github.com/nats-io/nats.go"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
 )
 
-func init() {
-	gob.Register(Err{})
-	// log.SetFlags(log.LstdFlags | log.Lshortfile)
+// Data is the reply to a request. Err is always an `errs.Error`,
+// so the requester can tell failures apart by their code.
+type Data[T any] struct {
+	Value T
+	Err   error
 }
 
-type Err struct {
-	Msg string
+// Errorf sets the error of the result and returns it to be sent.
+// The `%w` directive not allowed, as uses `fmt.Sprintf` under the hood.
+// The error has the `errs.Internal` code, use `Fail` to give another.
+func (d *Data[T]) Errorf(format string, a ...any) Data[T] {
+	d.Err = errs.Errorf(errs.Internal, format, a...)
+	return *d
 }
 
-func (e Err) Error() string {
-	return e.Msg
+// Fail sets the error of the result to `err`, keeping its code,
+// and returns it to be sent
+func (d *Data[T]) Fail(err error) Data[T] {
+	d.Err = errs.From(err)
+	return *d
 }
 
-type Data[T any] struct {
-	Value T
-	Err   error
+// dataJSON is the form of `Data` on the bus, where the
+// error is `null` unless the request failed
+type dataJSON[T any] struct {
+	Value T           `json:"value"`
+	Err   *errs.Error `json:"error"`
 }
 
-// BErrof is a byte slice encoding of the result using gob encoding.
-// The `%w` directive not allowed, as uses `fmt.Sprintf` under the hood
-func (d *Data[T]) Errorf(format string, a ...any) []byte {
-	d.Err = &Err{fmt.Sprintf(format, a...)}
-	return d.Bytes()
+func (d Data[T]) MarshalJSON() ([]byte, error) {
+	v := dataJSON[T]{Value: d.Value}
+	if d.Err != nil {
+		e := errs.From(d.Err)
+		v.Err = &e
+	}
+	return json.Marshal(v)
 }
 
-// FIXME I am being naughty and not error handling
-// If this causes an error then
-func (r Data[T]) Msg(subj string) *nats.Msg {
-	p, err := Marshal(r)
-	if err != nil {
-		log.Print(err)
+func (d *Data[T]) UnmarshalJSON(p []byte) error {
+	var v dataJSON[T]
+	if err := json.Unmarshal(p, &v); err != nil {
+		return err
 	}
-	return &nats.Msg{Subject: subj, Data: p}
-}
 
-// Encodes the result into a byte slice
-// using gob encoding
-func (d Data[T]) Bytes() []byte {
-	p, err := Marshal(d)
-	if err != nil {
-		log.Print(err)
+	d.Value, d.Err = v.Value, nil
+	if v.Err != nil {
+		d.Err = *v.Err
 	}
-	return p
+	return nil
 }
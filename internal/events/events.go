@@ -1,30 +1,14 @@
 package events
 
 import (
-	"bytes"
-	"encoding/gob"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/nats-io/nats.go"
 )
 
-// Unmarshal is a helper to decode byte slices back to their
-// original struct. It performs the reverse task of `Encode`
-func Unmarshal(p []byte, v any) error {
-	return gob.NewDecoder(bytes.NewReader(p)).Decode(v)
-}
-
-// Marshal uses gob encoding to convert any struct type to
-// a bytes slice. Custom types may need to be registered first
-func Marshal(v any) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
-}
-
 // Redirect is a helper to re-use the previous message data for a different subject
 func Redirect(subj string, src *nats.Msg) (dst *nats.Msg) {
 	return &nats.Msg{Subject: subj, Data: src.Data}
@@ -39,31 +23,131 @@ const (
 	EventGenerateSignupToken     = "token.generate.signup"
 	EventVerifySignupToken       = "token.verify.signup"
 	EventCreateProfileValidation = "token.decode"
+	EventGameLobby               = "game.lobby"
+	EventMatchTicket             = "match.ticket"
+	EventMatchCancel             = "match.cancel"
+	EventMatchFound              = "match.found"
+	EventGameFinished            = "game.finished"
+	EventGetRating               = "registry.rating.get"
+	EventGetProfileByEmail       = "registry.profile.email"
+	EventProfileClosed           = "registry.profile.closed"
 )
 
+// GameSubject returns the subject that carries updates for a single game
+func GameSubject(id uuid.UUID) string {
+	return "game." + id.String() + ".state"
+}
+
+// TicketSubject returns the subject a waiting player hears about their match on
+func TicketSubject(id uuid.UUID) string {
+	return "match." + id.String() + ".ready"
+}
+
+// The payloads below are tagged so that their fields keep their names
+// on the bus when the Go fields are renamed.
+
 type DataJWTToken struct {
-	Token jwt.Token
+	Token jwt.Token `json:"token"`
 }
 
 // DatEmail could be a `string` type alias
 type DataEmail struct {
-	Email string
+	Email string `json:"email"`
 }
 
 type DataLoginConfirm struct {
-	Email string
-	Token []byte
+	Email string `json:"email"`
+	Token []byte `json:"token"`
+}
+
+// DataProfile is the part of a profile that goes into an access token.
+// ID is uuid.Nil when no profile has the email that was asked for.
+type DataProfile struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+	PhotoURL *string   `json:"photoUrl"` // optional
+	// Scopes are granted by the role of the profile
+	Scopes []string `json:"scopes"`
+	Banned bool     `json:"banned"`
+}
+
+// DataProfileClosed is published when a profile is banned or deleted,
+// so that its sessions can be ended
+type DataProfileClosed struct {
+	ID uuid.UUID `json:"id"`
 }
 
 // NOTE DataToken could be a `[]byte` type alias
 type DataToken struct {
-	Token []byte
+	Token []byte `json:"token"`
 }
 
 // NOTE This data type is the same as `DataLoginConfirm` so not exactly DRY
 type DataAuthToken struct {
-	Token []byte
-	Email string
+	Token []byte `json:"token"`
+	Email string `json:"email"`
+}
+
+// DataGameState is published whenever a game changes, either because
+// an opponent joined or because a move was played
+type DataGameState struct {
+	ID     uuid.UUID   `json:"id"`
+	Seq    int         `json:"seq"` // number of moves played so far
+	X      uuid.UUID   `json:"x"`
+	O      uuid.UUID   `json:"o"`
+	Config game.Config `json:"config"`
+	Board  game.Board  `json:"board"`
+	Next   int         `json:"next"` // sub-board the next move must be played on, or -1
+	Turn   game.Player `json:"turn"`
+	Status game.Status `json:"status"`
+	Winner game.Player `json:"winner"`
+	Move   *game.Move  `json:"move"` // nil when no move caused the update
+}
+
+// DataTicket asks matchmaking to pair a player with an opponent
+type DataTicket struct {
+	ID     uuid.UUID   `json:"id"`
+	Player uuid.UUID   `json:"player"`
+	Config game.Config `json:"config"`
+	Rating int         `json:"rating"`
+	Band   int         `json:"band"` // widest rating difference accepted, 0 for any
+	// Queued is when the player started waiting
+	Queued  time.Time `json:"queued"`
+	Expires time.Time `json:"expires"`
+}
+
+// DataMatch pairs two tickets. It is published once by matchmaking
+// for the game service to create the game, then again by the game
+// service on each `TicketSubject` once the game is ready.
+type DataMatch struct {
+	ID      uuid.UUID    `json:"id"` // id of the game to create
+	Config  game.Config  `json:"config"`
+	X       uuid.UUID    `json:"x"`
+	O       uuid.UUID    `json:"o"`
+	Tickets [2]uuid.UUID `json:"tickets"`
+}
+
+// DataGameResult is published once when a game between two people ends
+type DataGameResult struct {
+	ID      uuid.UUID    `json:"id"`
+	Variant game.Variant `json:"variant"`
+	X       uuid.UUID    `json:"x"`
+	O       uuid.UUID    `json:"o"`
+	Winner  game.Player  `json:"winner"` // NoPlayer for a draw
+}
+
+// DataRatingQuery asks the registry for a player's rating in a variant
+type DataRatingQuery struct {
+	ID      uuid.UUID    `json:"id"`
+	Variant game.Variant `json:"variant"`
+}
+
+// DataLobby announces games being created, started and finished
+type DataLobby struct {
+	ID     uuid.UUID   `json:"id"`
+	Kind   string      `json:"kind"` // "created", "started" or "finished"
+	Status game.Status `json:"status"`
+	Winner game.Player `json:"winner"`
 }
 
 // TODO implement Error interface
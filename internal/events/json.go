@@ -0,0 +1,38 @@
+package events
+
+import "encoding/json"
+
+var _ Codec = JSON{}
+
+// JSON writes the envelope as a JSON object, with the payload in its
+// `payload` member:
+//
+//	{"type":"user.email.signup","version":1,"id":"...","correlationId":"...","time":"...","payload":{"email":"..."}}
+type JSON struct{}
+
+type jsonEnvelope struct {
+	Envelope
+	Payload json.RawMessage `json:"payload"`
+}
+
+func (JSON) Marshal(env Envelope, v any) ([]byte, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonEnvelope{Envelope: env, Payload: p})
+}
+
+func (JSON) Unmarshal(p []byte, env *Envelope, v any) error {
+	var w jsonEnvelope
+	if err := json.Unmarshal(p, &w); err != nil {
+		return err
+	}
+
+	*env = w.Envelope
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(w.Payload, v)
+}
@@ -0,0 +1,162 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ Codec = Protobuf{}
+
+// Protobuf writes the envelope as the `Envelope` message of envelope.proto.
+// A payload that is a protobuf message is sent as a `google.protobuf.Any`;
+// any other payload is sent as the `google.protobuf.Value` of its JSON form,
+// so that it can be read without a schema of its own.
+type Protobuf struct{}
+
+// field numbers of envelope.proto
+const (
+	fieldType protowire.Number = iota + 1
+	fieldVersion
+	fieldID
+	fieldCorrelationID
+	fieldTime
+	fieldValue
+	fieldMessage
+)
+
+func (Protobuf) Marshal(env Envelope, v any) ([]byte, error) {
+	ts, err := proto.Marshal(timestamppb.New(env.Time))
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, fieldType, protowire.BytesType)
+	b = protowire.AppendString(b, env.Type)
+	b = protowire.AppendTag(b, fieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(env.Version))
+	b = protowire.AppendTag(b, fieldID, protowire.BytesType)
+	b = protowire.AppendString(b, env.ID)
+	b = protowire.AppendTag(b, fieldCorrelationID, protowire.BytesType)
+	b = protowire.AppendString(b, env.CorrelationID)
+	b = protowire.AppendTag(b, fieldTime, protowire.BytesType)
+	b = protowire.AppendBytes(b, ts)
+
+	if m, ok := v.(proto.Message); ok {
+		a, err := anypb.New(m)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := proto.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+
+		b = protowire.AppendTag(b, fieldMessage, protowire.BytesType)
+		return protowire.AppendBytes(b, p), nil
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var val structpb.Value
+	if err := val.UnmarshalJSON(j); err != nil {
+		return nil, err
+	}
+
+	p, err := proto.Marshal(&val)
+	if err != nil {
+		return nil, err
+	}
+
+	b = protowire.AppendTag(b, fieldValue, protowire.BytesType)
+	return protowire.AppendBytes(b, p), nil
+}
+
+func (Protobuf) Unmarshal(p []byte, env *Envelope, v any) error {
+	var value, message []byte
+	for len(p) > 0 {
+		num, typ, n := protowire.ConsumeTag(p)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		p = p[n:]
+
+		switch {
+		case num == fieldVersion && typ == protowire.VarintType:
+			x, n := protowire.ConsumeVarint(p)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			env.Version, p = int(x), p[n:]
+		case typ == protowire.BytesType && num <= fieldMessage:
+			x, n := protowire.ConsumeBytes(p)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			p = p[n:]
+
+			switch num {
+			case fieldType:
+				env.Type = string(x)
+			case fieldID:
+				env.ID = string(x)
+			case fieldCorrelationID:
+				env.CorrelationID = string(x)
+			case fieldTime:
+				var ts timestamppb.Timestamp
+				if err := proto.Unmarshal(x, &ts); err != nil {
+					return err
+				}
+				env.Time = ts.AsTime()
+			case fieldValue:
+				value = x
+			case fieldMessage:
+				message = x
+			}
+		default:
+			// skip fields added by newer senders
+			n := protowire.ConsumeFieldValue(num, typ, p)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			p = p[n:]
+		}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if m, ok := v.(proto.Message); ok {
+		var a anypb.Any
+		if err := proto.Unmarshal(message, &a); err != nil {
+			return err
+		}
+		return a.UnmarshalTo(m)
+	}
+
+	if message != nil {
+		return fmt.Errorf("cannot read a protobuf message into %T", v)
+	}
+
+	var val structpb.Value
+	if err := proto.Unmarshal(value, &val); err != nil {
+		return err
+	}
+
+	j, err := val.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
@@ -0,0 +1,193 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// HeaderError holds why a dead letter could not be handled
+const HeaderError = "Error"
+
+// DefaultBackoff is how long a durable consumer waits before each
+// redelivery of a message it failed to handle
+var DefaultBackoff = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// Stream is a JetStream stream. It keeps the messages of its subjects,
+// and their dead letters, until a durable consumer has handled them.
+type Stream struct {
+	Name     string
+	Subjects []string
+	MaxAge   time.Duration
+}
+
+// StreamMail keeps the emails waiting to be sent, so that none
+// are lost while the mailing service is down
+var StreamMail = Stream{
+	Name:     "MAIL",
+	Subjects: []string{EventSendLoginConfirm, EventSendSignupConfirm},
+	MaxAge:   7 * 24 * time.Hour,
+}
+
+// StreamGames keeps the results of finished games until the
+// registry has rated them, so that no rating update is lost
+var StreamGames = Stream{
+	Name:     "GAMES",
+	Subjects: []string{EventGameFinished},
+	MaxAge:   7 * 24 * time.Hour,
+}
+
+// DeadLetterSubject returns where messages of `subject` go once
+// every attempt to handle them has failed
+func DeadLetterSubject(subject string) string {
+	return "dead." + subject
+}
+
+// Captures reports whether the stream keeps the messages of `subject`
+func (s Stream) Captures(subject string) bool {
+	for _, subj := range s.Subjects {
+		if subj == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Stream) config() *nats.StreamConfig {
+	c := &nats.StreamConfig{
+		Name:      s.Name,
+		Retention: nats.WorkQueuePolicy,
+		MaxAge:    s.MaxAge,
+	}
+	for _, subj := range s.Subjects {
+		c.Subjects = append(c.Subjects, subj, DeadLetterSubject(subj))
+	}
+	return c
+}
+
+// Add creates the stream, or updates its subjects if it exists
+func (s Stream) Add(b Broker) error {
+	js, err := b.Conn().Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	_, err = js.StreamInfo(s.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = js.AddStream(s.config())
+	case err == nil:
+		_, err = js.UpdateStream(s.config())
+	}
+	if err != nil {
+		return fmt.Errorf("add stream %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// Store publishes `v` to the stream that keeps the topic, returning once
+// JetStream has stored it, so that it is kept while no consumer is running.
+// A context without a deadline is given the `DefaultTimeout`.
+func (t Topic[T]) Store(ctx context.Context, b Broker, v T) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	p, err := b.Conn().Enc.Encode(string(t), v)
+	if err != nil {
+		return err
+	}
+
+	js, err := b.Conn().Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	_, err = js.PublishMsg(&nats.Msg{Subject: string(t), Data: p}, nats.Context(ctx))
+	return err
+}
+
+// Durable calls `h` with every message of the topic kept by the stream,
+// sharing them among the members of the durable consumer `name`. A message
+// `h` fails to handle is redelivered after each wait in `backoff`, after
+// which it is sent to the `DeadLetterSubject` of the topic.
+func (t Topic[T]) Durable(b Broker, s Stream, name string, backoff []time.Duration, h func(ctx context.Context, v *T) error) error {
+	js, err := b.Conn().Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	c := &nats.ConsumerConfig{
+		Durable:        name,
+		DeliverSubject: "deliver." + s.Name + "." + name,
+		DeliverGroup:   name,
+		FilterSubject:  string(t),
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        DefaultTimeout * 2,
+		// the handler gives up after the backoff, but a message must
+		// still be redelivered until its dead letter is stored
+		MaxDeliver: -1,
+	}
+
+	return b.consume(s.Name, c, func(msg *nats.Msg) {
+		var v T
+		if err := b.Conn().Enc.Decode(msg.Subject, msg.Data, &v); err != nil {
+			// it would fail every time
+			t.deadLetter(js, msg, fmt.Errorf("decode %s: %w", t, err), backoff)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+
+		err := h(ctx, &v)
+		if err == nil {
+			if err := msg.Ack(); err != nil {
+				log.Printf("ack %s: %v", t, err)
+			}
+			return
+		}
+
+		meta, merr := msg.Metadata()
+		if merr != nil || int(meta.NumDelivered) > len(backoff) {
+			t.deadLetter(js, msg, err, backoff)
+			return
+		}
+
+		if err := msg.NakWithDelay(backoff[meta.NumDelivered-1]); err != nil {
+			log.Printf("nak %s: %v", t, err)
+		}
+	})
+}
+
+func (t Topic[T]) deadLetter(js nats.JetStreamContext, msg *nats.Msg, cause error, backoff []time.Duration) {
+	log.Printf("dead letter %s: %v", t, cause)
+
+	dead := nats.NewMsg(DeadLetterSubject(msg.Subject))
+	dead.Data = msg.Data
+	dead.Header.Set(HeaderError, cause.Error())
+
+	if _, err := js.PublishMsg(dead); err != nil {
+		log.Printf("publish dead letter %s: %v", t, err)
+
+		// try again after the longest backoff
+		delay := DefaultTimeout
+		if len(backoff) > 0 {
+			delay = backoff[len(backoff)-1]
+		}
+		if err := msg.NakWithDelay(delay); err != nil {
+			log.Printf("nak %s: %v", t, err)
+		}
+		return
+	}
+
+	if err := msg.Term(); err != nil {
+		log.Printf("term %s: %v", t, err)
+	}
+}
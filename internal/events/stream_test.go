@@ -0,0 +1,195 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/prelude/testing/is"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func newJetStreamBroker(t *testing.T) events.Broker {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	ns := natsserver.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.NewClient(ec)
+}
+
+func TestDurable(t *testing.T) {
+	is := is.New(t)
+
+	b := newJetStreamBroker(t)
+	is.NoErr(events.StreamMail.Add(b)) // add stream
+	is.NoErr(events.StreamMail.Add(b)) // adding again is fine
+
+	backoff := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+
+	t.Run("messages wait for a consumer", func(t *testing.T) {
+		is.NoErr(events.TopicSendLoginConfirm.Publish(b, events.DataLoginConfirm{Email: "john@doe.com"}))
+		is.NoErr(b.Conn().Flush()) // published while nobody listens
+
+		received := make(chan string, 1)
+		err := events.TopicSendLoginConfirm.Durable(b, events.StreamMail, "login", backoff, func(ctx context.Context, v *events.DataLoginConfirm) error {
+			received <- v.Email
+			return nil
+		})
+		is.NoErr(err) // consume
+
+		select {
+		case email := <-received:
+			is.Equal(email, "john@doe.com") // kept by the stream
+		case <-time.After(time.Second):
+			t.Fatal("message was lost")
+		}
+	})
+
+	t.Run("store waits for the stream", func(t *testing.T) {
+		ctx := context.Background()
+
+		const topic events.Topic[int] = "test.unstored"
+		is.True(topic.Store(ctx, b, 1) != nil) // no stream keeps the topic
+
+		s := events.Stream{Name: "STORE", Subjects: []string{string(topic)}}
+		is.NoErr(s.Add(b))               // add stream
+		is.NoErr(topic.Store(ctx, b, 1)) // stored
+
+		js, err := b.Conn().Conn.JetStream()
+		is.NoErr(err) // jetstream
+		info, err := js.StreamInfo(s.Name)
+		is.NoErr(err)                        // stream info
+		is.Equal(info.State.Msgs, uint64(1)) // kept by the stream
+	})
+
+	t.Run("failures are retried then dead lettered", func(t *testing.T) {
+		dead := make(chan *nats.Msg, 1)
+		sub, err := b.Conn().Conn.ChanSubscribe(events.DeadLetterSubject(events.EventSendSignupConfirm), dead)
+		is.NoErr(err) // watch dead letters
+		t.Cleanup(func() { sub.Unsubscribe() })
+
+		var attempts atomic.Int32
+		err = events.TopicSendSignupConfirm.Durable(b, events.StreamMail, "signup", backoff, func(ctx context.Context, v *events.DataEmail) error {
+			attempts.Add(1)
+			return errors.New("smtp is down")
+		})
+		is.NoErr(err) // consume
+
+		is.NoErr(events.TopicSendSignupConfirm.Publish(b, events.DataEmail{Email: "jane@doe.com"}))
+
+		select {
+		case msg := <-dead:
+			is.Equal(msg.Header.Get(events.HeaderError), "smtp is down") // why it failed
+
+			var v events.DataEmail
+			is.NoErr(b.Conn().Enc.Decode(msg.Subject, msg.Data, &v)) // original message
+			is.Equal(v.Email, "jane@doe.com")
+		case <-time.After(2 * time.Second):
+			t.Fatal("no dead letter")
+		}
+
+		is.Equal(attempts.Load(), int32(len(backoff)+1)) // one attempt and a retry for each backoff
+	})
+
+	t.Run("a retry that succeeds is acked", func(t *testing.T) {
+		const topic events.Topic[int] = "test.retry"
+		s := events.Stream{Name: "TEST", Subjects: []string{string(topic)}}
+		is.NoErr(s.Add(b)) // add stream
+
+		done := make(chan int, 2)
+		var attempts atomic.Int32
+		err := topic.Durable(b, s, "retry", backoff, func(ctx context.Context, v *int) error {
+			if attempts.Add(1) == 1 {
+				return errors.New("try again")
+			}
+			done <- *v
+			return nil
+		})
+		is.NoErr(err) // consume
+
+		is.NoErr(topic.Publish(b, 7))
+
+		select {
+		case v := <-done:
+			is.Equal(v, 7) // handled on the retry
+		case <-time.After(time.Second):
+			t.Fatal("message was not retried")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		is.Equal(attempts.Load(), int32(2)) // not delivered again once acked
+	})
+
+	t.Run("a dead letter that cannot be stored is retried", func(t *testing.T) {
+		const topic events.Topic[int] = "test.dead"
+		s := events.Stream{Name: "DEAD", Subjects: []string{string(topic)}}
+		is.NoErr(s.Add(b)) // add stream
+
+		js, err := b.Conn().Conn.JetStream()
+		is.NoErr(err) // jetstream
+
+		// the stream loses its dead letter subject
+		_, err = js.UpdateStream(&nats.StreamConfig{Name: s.Name, Subjects: []string{string(topic)}, Retention: nats.WorkQueuePolicy})
+		is.NoErr(err) // update stream
+
+		var attempts atomic.Int32
+		err = topic.Durable(b, s, "dead", backoff, func(ctx context.Context, v *int) error {
+			attempts.Add(1)
+			return errors.New("always fails")
+		})
+		is.NoErr(err) // consume
+
+		is.NoErr(topic.Publish(b, 1))
+
+		// every attempt is used, and the dead letter fails
+		for deadline := time.Now().Add(2 * time.Second); attempts.Load() <= int32(len(backoff)+1); {
+			if time.Now().After(deadline) {
+				t.Fatal("message was not retried")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		dead := make(chan *nats.Msg, 1)
+		sub, err := b.Conn().Conn.ChanSubscribe(events.DeadLetterSubject(string(topic)), dead)
+		is.NoErr(err) // watch dead letters
+		t.Cleanup(func() { sub.Unsubscribe() })
+
+		is.NoErr(s.Add(b)) // the dead letter subject is back
+
+		select {
+		case msg := <-dead:
+			is.Equal(msg.Header.Get(events.HeaderError), "always fails") // not lost
+		case <-time.After(2 * time.Second):
+			t.Fatal("no dead letter")
+		}
+	})
+
+	t.Run("drain keeps the consumer", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		is.NoErr(b.Drain(ctx)) // drained
+
+		js, err := b.Conn().Conn.JetStream()
+		is.NoErr(err) // jetstream
+		_, err = js.ConsumerInfo(events.StreamMail.Name, "login")
+		is.NoErr(err) // durable survives a restart
+	})
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultTimeout bounds a request whose context has no deadline, and
+// the handling of a request by an `Endpoint`
+const DefaultTimeout = 5 * time.Second
+
+// Topic is a subject that carries messages of one type
+type Topic[T any] string
+
+// Publish sends `v` to every subscriber of the topic
+func (t Topic[T]) Publish(b Broker, v T) error {
+	return b.Conn().Publish(string(t), v)
+}
+
+// Subscribe calls `h` with every message on the topic
+func (t Topic[T]) Subscribe(b Broker, h func(v *T)) error {
+	return b.subscribe(string(t), "", h)
+}
+
+// QueueSubscribe calls `h` with the messages on the topic that
+// are given to this member of the queue group
+func (t Topic[T]) QueueSubscribe(b Broker, queue string, h func(v *T)) error {
+	return b.subscribe(string(t), queue, h)
+}
+
+// Bind sends the messages on the topic to `ch` until the caller
+// unsubscribes. The subscription is not drained by the broker.
+func (t Topic[T]) Bind(b Broker, ch chan *T) (*nats.Subscription, error) {
+	return b.Conn().BindRecvChan(string(t), ch)
+}
+
+// Endpoint is a subject that answers requests of type Q with a value of type R
+type Endpoint[Q, R any] string
+
+// Request asks the endpoint, returning the error of the reply
+// with its code. A context without a deadline is given the
+// `DefaultTimeout`.
+func (e Endpoint[Q, R]) Request(ctx context.Context, b Broker, q Q) (R, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	var d Data[R]
+	if err := b.Conn().RequestWithContext(ctx, string(e), q, &d); err != nil {
+		return d.Value, err
+	}
+	return d.Value, d.Err
+}
+
+// Handle answers the requests of the endpoint with the result of `h`.
+// An error is sent to the requester with its code. Every instance of a
+// service handles the endpoint in the same queue group, so each request
+// is answered once.
+func (e Endpoint[Q, R]) Handle(b Broker, h func(ctx context.Context, q Q) (R, error)) error {
+	return b.subscribe(string(e), "workers", func(msg *nats.Msg) {
+		var d Data[R]
+
+		var q Q
+		if err := b.Conn().Enc.Decode(msg.Subject, msg.Data, &q); err != nil {
+			e.respond(b, msg, d.Fail(errs.Wrap(errs.InvalidArgument, fmt.Errorf("decode %s: %w", e, err))))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+
+		v, err := h(ctx, q)
+		if err != nil {
+			e.respond(b, msg, d.Fail(err))
+			return
+		}
+
+		d.Value = v
+		e.respond(b, msg, d)
+	})
+}
+
+func (e Endpoint[Q, R]) respond(b Broker, msg *nats.Msg, d Data[R]) {
+	if err := Respond(b.Conn(), msg, d); err != nil {
+		// the requester will time out
+		log.Printf("respond to %s: %v", e, err)
+	}
+}
+
+// Topics and endpoints of the `Event` subjects
+
+const (
+	TopicSendLoginConfirm  Topic[DataLoginConfirm]  = EventSendLoginConfirm
+	TopicSendSignupConfirm Topic[DataEmail]         = EventSendSignupConfirm
+	TopicProfileClosed     Topic[DataProfileClosed] = EventProfileClosed
+	TopicGameLobby         Topic[DataLobby]         = EventGameLobby
+	TopicGameFinished      Topic[DataGameResult]    = EventGameFinished
+	TopicMatchTicket       Topic[DataTicket]        = EventMatchTicket
+	TopicMatchCancel       Topic[DataTicket]        = EventMatchCancel
+	TopicMatchFound        Topic[DataMatch]         = EventMatchFound
+
+	EndpointGenerateSignupToken     Endpoint[DataEmail, []byte]       = EventGenerateSignupToken
+	EndpointVerifySignupToken       Endpoint[DataToken, string]       = EventVerifySignupToken
+	EndpointCreateProfileValidation Endpoint[DataAuthToken, struct{}] = EventCreateProfileValidation
+	EndpointGetProfileByEmail       Endpoint[DataEmail, DataProfile]  = EventGetProfileByEmail
+	EndpointGetRating               Endpoint[DataRatingQuery, int]    = EventGetRating
+)
+
+// GameTopic carries the updates of a single game
+func GameTopic(id uuid.UUID) Topic[DataGameState] {
+	return Topic[DataGameState](GameSubject(id))
+}
+
+// TicketTopic is where a waiting player hears about their match
+func TicketTopic(id uuid.UUID) Topic[DataMatch] {
+	return Topic[DataMatch](TicketSubject(id))
+}
@@ -0,0 +1,143 @@
+package events_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/prelude/testing/is"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func newBroker(t *testing.T) events.Broker {
+	ns := natsserver.RunRandClientPortServer()
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.NewClient(ec)
+}
+
+func TestEndpoint(t *testing.T) {
+	is := is.New(t)
+
+	b := newBroker(t)
+
+	const double events.Endpoint[int, int] = "test.double"
+	err := double.Handle(b, func(ctx context.Context, q int) (int, error) {
+		if q < 0 {
+			return 0, errs.New(errs.InvalidArgument, "negative")
+		}
+		return q * 2, nil
+	})
+	is.NoErr(err) // handle requests
+
+	t.Run("reply", func(t *testing.T) {
+		v, err := double.Request(context.Background(), b, 21)
+		is.NoErr(err)   // request
+		is.Equal(v, 42) // value of the reply
+	})
+
+	t.Run("reply with an error", func(t *testing.T) {
+		_, err := double.Request(context.Background(), b, -1)
+		is.Equal(errs.CodeOf(err), errs.InvalidArgument) // code of the handler
+	})
+
+	t.Run("each request is answered once", func(t *testing.T) {
+		const once events.Endpoint[int, int] = "test.once"
+
+		var handled atomic.Int32
+		for i := 0; i < 3; i++ {
+			// a replica of the service
+			err := once.Handle(b, func(ctx context.Context, q int) (int, error) {
+				handled.Add(1)
+				return q, nil
+			})
+			is.NoErr(err) // handle requests
+		}
+
+		for i := 0; i < 10; i++ {
+			_, err := once.Request(context.Background(), b, i)
+			is.NoErr(err) // request
+		}
+		is.NoErr(b.Conn().Flush())
+		time.Sleep(50 * time.Millisecond)
+		is.Equal(handled.Load(), int32(10)) // one replica per request
+	})
+
+	t.Run("nobody answers", func(t *testing.T) {
+		const nobody events.Endpoint[int, int] = "test.nobody"
+
+		_, err := nobody.Request(context.Background(), b, 1)
+		is.Equal(errs.CodeOf(err), errs.Unavailable) // no responders
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		const slow events.Endpoint[int, int] = "test.slow"
+		err := slow.Handle(b, func(ctx context.Context, q int) (int, error) {
+			time.Sleep(200 * time.Millisecond)
+			return q, nil
+		})
+		is.NoErr(err) // handle requests
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err = slow.Request(ctx, b, 1)
+		is.True(errors.Is(err, context.DeadlineExceeded)) // gave up
+		is.Equal(errs.CodeOf(err), errs.Unavailable)      // code
+	})
+}
+
+func TestTopic(t *testing.T) {
+	is := is.New(t)
+
+	b := newBroker(t)
+
+	t.Run("subscribe errors are returned", func(t *testing.T) {
+		const bad events.Topic[string] = "bad subject"
+
+		err := bad.Subscribe(b, func(v *string) {})
+		is.True(errors.Is(err, nats.ErrBadSubject)) // invalid subject
+	})
+
+	t.Run("drain handles messages already received", func(t *testing.T) {
+		const topic events.Topic[int] = "test.drain"
+
+		handled := make(chan int, 3)
+		err := topic.QueueSubscribe(b, "workers", func(v *int) {
+			time.Sleep(20 * time.Millisecond)
+			handled <- *v
+		})
+		is.NoErr(err) // subscribe
+
+		for i := 0; i < 3; i++ {
+			is.NoErr(topic.Publish(b, i)) // publish
+		}
+		is.NoErr(b.Conn().Flush())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		is.NoErr(b.Drain(ctx))    // drained
+		is.Equal(len(handled), 3) // every message was handled
+
+		is.NoErr(topic.Publish(b, 3))
+		is.NoErr(b.Conn().Flush())
+		time.Sleep(50 * time.Millisecond)
+		is.Equal(len(handled), 3) // no longer subscribed
+	})
+}
@@ -0,0 +1,237 @@
+// Package ai provides computer opponents for the game engine.
+package ai
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+)
+
+// Level is how well a computer opponent plays.
+type Level uint8
+
+const (
+	// Easy plays a random legal move
+	Easy Level = iota + 1
+	// Medium wins when it can, blocks when it must and otherwise plays at random
+	Medium
+	// Perfect never loses on a classic board and searches
+	// a few moves ahead on larger ones
+	Perfect
+)
+
+func (l Level) String() string {
+	switch l {
+	case Easy:
+		return "easy"
+	case Medium:
+		return "medium"
+	case Perfect:
+		return "perfect"
+	default:
+		return ""
+	}
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "easy":
+		*l = Easy
+	case "medium":
+		*l = Medium
+	case "perfect":
+		*l = Perfect
+	default:
+		return fmt.Errorf("ai: unknown level %q", text)
+	}
+	return nil
+}
+
+// Each level takes its seat in a game under a well-known id, so that
+// a stored game can be resumed without recording anything else.
+var ids = map[Level]uuid.UUID{
+	Easy:    uuid.MustParse("00000000-0000-4000-8000-0000000000b1"),
+	Medium:  uuid.MustParse("00000000-0000-4000-8000-0000000000b2"),
+	Perfect: uuid.MustParse("00000000-0000-4000-8000-0000000000b3"),
+}
+
+// ID returns the participant id of the computer opponent at this level.
+func (l Level) ID() uuid.UUID { return ids[l] }
+
+// LevelOf reports which computer opponent, if any, has the given id.
+func LevelOf(id uuid.UUID) (Level, bool) {
+	for l, v := range ids {
+		if v == id {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+var ErrNoMoves = errors.New("ai: no legal moves")
+
+// New returns the strategy for a level.
+func New(l Level) game.Strategy {
+	switch l {
+	case Easy:
+		return random{}
+	case Medium:
+		return heuristic{}
+	default:
+		return minimax{}
+	}
+}
+
+type random struct{}
+
+func (random) Choose(g *game.Game) (game.Move, error) {
+	ms := g.LegalMoves()
+	if len(ms) == 0 {
+		return game.Move{}, ErrNoMoves
+	}
+	return ms[rand.Intn(len(ms))], nil
+}
+
+type heuristic struct{}
+
+func (heuristic) Choose(g *game.Game) (game.Move, error) {
+	if m, ok := winOrBlock(g); ok {
+		return m, nil
+	}
+	return random{}.Choose(g)
+}
+
+// winOrBlock takes a winning move, or else stops the opponent
+// from winning on their next move
+func winOrBlock(g *game.Game) (game.Move, bool) {
+	ms := g.LegalMoves()
+	for _, m := range ms {
+		if g.Wins(m) {
+			return m, true
+		}
+	}
+
+	for _, m := range ms {
+		if g.Wins(game.Move{Player: m.Player.Opponent(), Row: m.Row, Col: m.Col}) {
+			return m, true
+		}
+	}
+	return game.Move{}, false
+}
+
+// minimax searches the whole game tree of a classic board and so never
+// loses. Larger boards have too many positions, so the search stops after
+// a few moves and rates the position with `game.Game.Score` instead.
+type minimax struct{}
+
+func (minimax) Choose(g *game.Game) (game.Move, error) {
+	ms := candidates(g)
+	if len(ms) == 0 {
+		return game.Move{}, ErrNoMoves
+	}
+
+	if m, ok := winOrBlock(g); ok {
+		return m, nil
+	}
+
+	// shuffle so that equally good moves are not always played in the same order
+	rand.Shuffle(len(ms), func(i, j int) { ms[i], ms[j] = ms[j], ms[i] })
+
+	depth := searchDepth(g.Config())
+
+	best, alpha, beta := ms[0], -inf, inf
+	for _, m := range ms {
+		next := g.Clone()
+		next.Play(m)
+
+		if score := -negamax(next, depth-1, 1, -beta, -alpha); score > alpha {
+			best, alpha = m, score
+		}
+	}
+	return best, nil
+}
+
+// inf is larger than any score from `game.Game.Score`
+const inf = 1 << 30
+
+// searchDepth is how many moves ahead to look on each kind of board
+func searchDepth(c game.Config) int {
+	switch {
+	case c.Variant == game.Classic:
+		return c.Rows * c.Cols
+	case c.Variant == game.Ultimate:
+		return 3
+	case c.Rows*c.Cols <= 16:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// candidates prunes the moves worth searching. On an m,n,k board only
+// the cells next to a mark are considered, and the centre on an empty one.
+func candidates(g *game.Game) []game.Move {
+	ms := g.LegalMoves()
+	if c := g.Config(); c.Variant != game.MNK || len(ms) == 0 {
+		return ms
+	}
+
+	b := g.Board()
+	if g.MoveCount() == 0 {
+		return []game.Move{{Player: g.Turn(), Row: b.Rows / 2, Col: b.Cols / 2}}
+	}
+
+	var near []game.Move
+	for _, m := range ms {
+		if touches(b, m.Row, m.Col) {
+			near = append(near, m)
+		}
+	}
+	return near
+}
+
+func touches(b game.Board, row, col int) bool {
+	for dr := -1; dr <= 1; dr++ {
+		for dc := -1; dc <= 1; dc++ {
+			if b.In(row+dr, col+dc) && b.At(row+dr, col+dc) != game.NoPlayer {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negamax scores the game for the player whose turn it is, preferring
+// quick wins and slow losses. Alpha-beta pruning skips any branch that
+// cannot change the result.
+func negamax(g *game.Game, depth, ply, alpha, beta int) int {
+	switch {
+	case g.Status() == game.Won:
+		// the previous player has just won
+		return ply - inf
+	case g.Status() == game.Draw:
+		return 0
+	case depth == 0:
+		return g.Score(g.Turn())
+	}
+
+	for _, m := range candidates(g) {
+		next := g.Clone()
+		next.Play(m)
+
+		if score := -negamax(next, depth-1, ply+1, -beta, -alpha); score > alpha {
+			alpha = score
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+	return alpha
+}
@@ -0,0 +1,126 @@
+package ai_test
+
+import (
+	"testing"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game/ai"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+// play lets two strategies finish a game
+func play(t *testing.T, g *game.Game, x, o game.Strategy) *game.Game {
+	for !g.Over() {
+		s := x
+		if g.Turn() == game.O {
+			s = o
+		}
+
+		m, err := s.Choose(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Play(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g
+}
+
+func TestLevels(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("every level plays a legal move", func(t *testing.T) {
+		for _, l := range []ai.Level{ai.Easy, ai.Medium, ai.Perfect} {
+			g := play(t, game.New(), ai.New(l), ai.New(l))
+			is.True(g.Over()) // game finished
+		}
+	})
+
+	t.Run("medium takes a win", func(t *testing.T) {
+		// X X .
+		// O O .
+		g, err := game.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 1, Col: 0},
+			{Player: game.X, Row: 0, Col: 1},
+			{Player: game.O, Row: 1, Col: 1},
+		})
+		is.NoErr(err) // replay
+
+		m, err := ai.New(ai.Medium).Choose(g)
+		is.NoErr(err)                                          // choose move
+		is.Equal(m, game.Move{Player: game.X, Row: 0, Col: 2}) // complete the top row
+	})
+
+	t.Run("medium blocks a win", func(t *testing.T) {
+		// X X .
+		// O . .
+		g, err := game.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 1, Col: 0},
+			{Player: game.X, Row: 0, Col: 1},
+		})
+		is.NoErr(err) // replay
+
+		m, err := ai.New(ai.Medium).Choose(g)
+		is.NoErr(err)                                          // choose move
+		is.Equal(m, game.Move{Player: game.O, Row: 0, Col: 2}) // block the top row
+	})
+
+	t.Run("perfect never loses", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			g := play(t, game.New(), ai.New(ai.Easy), ai.New(ai.Perfect))
+			is.True(g.Winner() != game.X) // perfect O did not lose
+
+			g = play(t, game.New(), ai.New(ai.Perfect), ai.New(ai.Medium))
+			is.True(g.Winner() != game.O) // perfect X did not lose
+		}
+
+		g := play(t, game.New(), ai.New(ai.Perfect), ai.New(ai.Perfect))
+		is.Equal(g.Status(), game.Draw) // perfect play draws
+	})
+
+	t.Run("perfect finishes larger boards", func(t *testing.T) {
+		for _, c := range []game.Config{
+			{Variant: game.MNK, Rows: 4, Cols: 4, K: 3},
+			{Variant: game.MNK, Rows: 9, Cols: 9, K: 5},
+			{Variant: game.Ultimate},
+		} {
+			g, err := c.New()
+			is.NoErr(err) // new game
+
+			// the easy opponent plays at random, so the result is
+			// not fixed; every move of both was legal
+			g = play(t, g, ai.New(ai.Perfect), ai.New(ai.Easy))
+			is.True(g.Over())                                               // game finished
+			is.True(g.Status() == game.Draw || g.Winner() != game.NoPlayer) // with a result
+		}
+	})
+
+	t.Run("perfect blocks on a large board", func(t *testing.T) {
+		// X has an open four on a 15x15 gomoku board
+		c := game.Config{Variant: game.MNK, Rows: 15, Cols: 15, K: 5}
+		g, err := c.Replay([]game.Move{
+			{Player: game.X, Row: 7, Col: 4},
+			{Player: game.O, Row: 0, Col: 0},
+			{Player: game.X, Row: 7, Col: 5},
+			{Player: game.O, Row: 0, Col: 14},
+			{Player: game.X, Row: 7, Col: 6},
+			{Player: game.O, Row: 14, Col: 0},
+			{Player: game.X, Row: 7, Col: 7},
+		})
+		is.NoErr(err) // replay
+
+		m, err := ai.New(ai.Perfect).Choose(g)
+		is.NoErr(err)                                     // choose move
+		is.True(m.Row == 7 && (m.Col == 3 || m.Col == 8)) // block one end
+	})
+
+	t.Run("no moves once the game is over", func(t *testing.T) {
+		g := play(t, game.New(), ai.New(ai.Perfect), ai.New(ai.Perfect))
+
+		_, err := ai.New(ai.Perfect).Choose(g)
+		is.Equal(err, ai.ErrNoMoves) // nothing to play
+	})
+}
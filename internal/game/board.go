@@ -0,0 +1,124 @@
+package game
+
+// Board is a grid of cells held in row-major order.
+type Board struct {
+	Rows  int      `json:"rows"`
+	Cols  int      `json:"cols"`
+	Cells []Player `json:"cells"`
+}
+
+// NewBoard returns an empty board of the given size.
+func NewBoard(rows, cols int) Board {
+	return Board{Rows: rows, Cols: cols, Cells: make([]Player, rows*cols)}
+}
+
+// At returns the mark at the given row and column.
+func (b Board) At(row, col int) Player {
+	return b.Cells[row*b.Cols+col]
+}
+
+// In reports whether the row and column are on the board.
+func (b Board) In(row, col int) bool {
+	return row >= 0 && row < b.Rows && col >= 0 && col < b.Cols
+}
+
+// Full reports whether every cell has been played.
+func (b Board) Full() bool {
+	for _, p := range b.Cells {
+		if p == NoPlayer {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of the board that does not share its cells.
+func (b Board) Clone() Board {
+	b.Cells = append([]Player(nil), b.Cells...)
+	return b
+}
+
+// directions are the four axes a line can run along
+var directions = [...][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+
+// window is a rectangle of the board that lines cannot leave.
+// Ultimate uses one window for each of its sub-boards.
+type window struct{ row, col, rows, cols int }
+
+func (w window) in(row, col int) bool {
+	return row >= w.row && row < w.row+w.rows && col >= w.col && col < w.col+w.cols
+}
+
+// Completes reports whether the mark at the given cell is part of an
+// unbroken line of at least k. Only the lines through that cell are
+// checked, so the cost does not grow with the size of the board.
+func (b Board) Completes(row, col, k int) bool {
+	return b.completes(window{0, 0, b.Rows, b.Cols}, row, col, k)
+}
+
+func (b Board) completes(w window, row, col, k int) bool {
+	p := b.At(row, col)
+	if p == NoPlayer {
+		return false
+	}
+
+	for _, d := range directions {
+		n := 1
+		for i := 1; n < k; i++ {
+			r, c := row+d[0]*i, col+d[1]*i
+			if !w.in(r, c) || b.At(r, c) != p {
+				break
+			}
+			n++
+		}
+		for i := 1; n < k; i++ {
+			r, c := row-d[0]*i, col-d[1]*i
+			if !w.in(r, c) || b.At(r, c) != p {
+				break
+			}
+			n++
+		}
+		if n >= k {
+			return true
+		}
+	}
+	return false
+}
+
+// Score rates the board for p by counting every run of k cells that only
+// one player has marked, weighting runs that are closer to complete.
+func (b Board) Score(p Player, k int) int {
+	return b.score(window{0, 0, b.Rows, b.Cols}, p, k)
+}
+
+func (b Board) score(w window, p Player, k int) int {
+	score := 0
+	for row := w.row; row < w.row+w.rows; row++ {
+		for col := w.col; col < w.col+w.cols; col++ {
+			for _, d := range directions {
+				// the run must fit in the window
+				if !w.in(row+d[0]*(k-1), col+d[1]*(k-1)) {
+					continue
+				}
+
+				var mine, theirs int
+				for i := 0; i < k; i++ {
+					switch b.At(row+d[0]*i, col+d[1]*i) {
+					case p:
+						mine++
+					case p.Opponent():
+						theirs++
+					}
+				}
+
+				switch {
+				case theirs == 0:
+					score += mine * mine * mine
+				case mine == 0:
+					score -= theirs * theirs * theirs
+				}
+			}
+		}
+	}
+	return score
+}
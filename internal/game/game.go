@@ -0,0 +1,330 @@
+// Package game implements the rules of noughts and crosses. It has no
+// knowledge of transport or storage so that it can be shared by the HTTP
+// service, the repository and any computer opponent.
+package game
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Player is the mark placed on the board by either side of a game.
+type Player uint8
+
+const (
+	NoPlayer Player = iota
+	X
+	O
+)
+
+func (p Player) String() string {
+	switch p {
+	case X:
+		return "X"
+	case O:
+		return "O"
+	default:
+		return ""
+	}
+}
+
+// Opponent returns the player that moves after p.
+func (p Player) Opponent() Player {
+	switch p {
+	case X:
+		return O
+	case O:
+		return X
+	default:
+		return NoPlayer
+	}
+}
+
+func (p Player) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Player) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "X", "x":
+		*p = X
+	case "O", "o":
+		*p = O
+	case "":
+		*p = NoPlayer
+	default:
+		return fmt.Errorf("game: unknown player %q", text)
+	}
+	return nil
+}
+
+// Status describes whether a game is still being played.
+type Status uint8
+
+const (
+	InProgress Status = iota
+	Won
+	Draw
+)
+
+func (s Status) String() string {
+	switch s {
+	case Won:
+		return "won"
+	case Draw:
+		return "draw"
+	default:
+		return "in-progress"
+	}
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "in-progress":
+		*s = InProgress
+	case "won":
+		*s = Won
+	case "draw":
+		*s = Draw
+	default:
+		return fmt.Errorf("game: unknown status %q", text)
+	}
+	return nil
+}
+
+// Move places a player's mark on a cell.
+type Move struct {
+	Player Player `json:"player"`
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+}
+
+var (
+	ErrOutOfBounds   = errors.New("cell is out of bounds")
+	ErrOccupied      = errors.New("cell is already occupied")
+	ErrWrongTurn     = errors.New("not the player's turn")
+	ErrGameOver      = errors.New("game is over")
+	ErrInvalidPlayer = errors.New("invalid player")
+	ErrWrongBoard    = errors.New("move must be played on the board chosen by the last move")
+	ErrBoardDecided  = errors.New("board has already been decided")
+	ErrInvalidConfig = errors.New("invalid game config")
+)
+
+// MoveError is returned when a move breaks the rules of the game.
+// The underlying reason can be checked with `errors.Is`.
+type MoveError struct {
+	Move Move
+	Err  error
+}
+
+func (e *MoveError) Error() string {
+	return fmt.Sprintf("game: %s at (%d, %d): %v", e.Move.Player, e.Move.Row, e.Move.Col, e.Err)
+}
+
+func (e *MoveError) Unwrap() error { return e.Err }
+
+// Strategy chooses a move for the player whose turn it is,
+// allowing computer opponents to take part in a game.
+type Strategy interface {
+	Choose(g *Game) (Move, error)
+}
+
+// Game tracks the board, whose turn it is and the outcome.
+// X always moves first.
+type Game struct {
+	config Config
+	board  Board
+	turn   Player
+	status Status
+	winner Player
+	moves  []Move
+
+	// subs and next are only used by Ultimate
+	subs []subBoard
+	next int
+}
+
+// subBoard is one of the nine small boards in Ultimate
+type subBoard struct {
+	winner Player
+	filled int
+}
+
+func (s subBoard) decided() bool { return s.winner != NoPlayer || s.filled == 9 }
+
+// subIndex returns which of the nine small boards holds a cell
+func subIndex(row, col int) int { return (row/3)*3 + col/3 }
+
+func subWindow(i int) window { return window{(i / 3) * 3, (i % 3) * 3, 3, 3} }
+
+// New returns a classic game with an empty board.
+func New() *Game {
+	g, _ := DefaultConfig.New()
+	return g
+}
+
+// Replay rebuilds a classic game by applying each move in order.
+func Replay(moves []Move) (*Game, error) {
+	return DefaultConfig.Replay(moves)
+}
+
+// Clone returns a copy of the game that can be played independently.
+func (g *Game) Clone() *Game {
+	c := *g
+	c.board = g.board.Clone()
+	c.moves = g.Moves()
+	c.subs = append([]subBoard(nil), g.subs...)
+	return &c
+}
+
+func (g *Game) Config() Config { return g.config }
+func (g *Game) Board() Board   { return g.board.Clone() }
+func (g *Game) Turn() Player   { return g.turn }
+func (g *Game) Status() Status { return g.status }
+func (g *Game) Winner() Player { return g.winner }
+func (g *Game) Over() bool     { return g.status != InProgress }
+func (g *Game) MoveCount() int { return len(g.moves) }
+func (g *Game) Moves() []Move  { return append([]Move(nil), g.moves...) }
+
+// Next returns the small board that the next move must be played on in
+// Ultimate, or -1 when any board that is still open may be chosen.
+func (g *Game) Next() int { return g.next }
+
+// SubBoards returns the winner of each small board in Ultimate,
+// as a 3x3 board of its own.
+func (g *Game) SubBoards() Board {
+	b := NewBoard(3, 3)
+	for i, s := range g.subs {
+		b.Cells[i] = s.winner
+	}
+	return b
+}
+
+// Legal reports why a move cannot be played, or nil if it can.
+func (g *Game) Legal(m Move) error {
+	switch {
+	case g.Over():
+		return &MoveError{m, ErrGameOver}
+	case m.Player != X && m.Player != O:
+		return &MoveError{m, ErrInvalidPlayer}
+	case m.Player != g.turn:
+		return &MoveError{m, ErrWrongTurn}
+	case !g.board.In(m.Row, m.Col):
+		return &MoveError{m, ErrOutOfBounds}
+	case g.board.At(m.Row, m.Col) != NoPlayer:
+		return &MoveError{m, ErrOccupied}
+	}
+
+	if g.config.Variant == Ultimate {
+		switch i := subIndex(m.Row, m.Col); {
+		case g.subs[i].decided():
+			return &MoveError{m, ErrBoardDecided}
+		case g.next >= 0 && i != g.next:
+			return &MoveError{m, ErrWrongBoard}
+		}
+	}
+	return nil
+}
+
+// Play applies a move and updates the outcome of the game. Only the lines
+// through the new mark are checked for a win.
+func (g *Game) Play(m Move) error {
+	if err := g.Legal(m); err != nil {
+		return err
+	}
+
+	g.board.Cells[m.Row*g.board.Cols+m.Col] = m.Player
+	g.moves = append(g.moves, m)
+
+	var won, full bool
+	if g.config.Variant == Ultimate {
+		won, full = g.playSubBoard(m)
+	} else {
+		won = g.board.Completes(m.Row, m.Col, g.config.K)
+		full = len(g.moves) == len(g.board.Cells)
+	}
+
+	switch {
+	case won:
+		g.status, g.winner, g.turn, g.next = Won, m.Player, NoPlayer, -1
+	case full:
+		g.status, g.turn, g.next = Draw, NoPlayer, -1
+	default:
+		g.turn = m.Player.Opponent()
+	}
+	return nil
+}
+
+// playSubBoard settles the small board that was played on, reports whether
+// that won the large board or left no board open, and picks the next board.
+func (g *Game) playSubBoard(m Move) (won, full bool) {
+	i := subIndex(m.Row, m.Col)
+
+	s := &g.subs[i]
+	s.filled++
+	if s.winner == NoPlayer && g.board.completes(subWindow(i), m.Row, m.Col, 3) {
+		s.winner = m.Player
+		won = g.SubBoards().Completes(i/3, i%3, 3)
+	}
+
+	full = true
+	for _, s := range g.subs {
+		if !s.decided() {
+			full = false
+			break
+		}
+	}
+
+	// the cell played sends the opponent to the matching board,
+	// unless that board is already decided
+	g.next = (m.Row%3)*3 + m.Col%3
+	if g.subs[g.next].decided() {
+		g.next = -1
+	}
+	return won, full
+}
+
+// LegalMoves lists every move available to the player whose turn it is.
+func (g *Game) LegalMoves() []Move {
+	if g.Over() {
+		return nil
+	}
+
+	var ms []Move
+	for i, p := range g.board.Cells {
+		m := Move{Player: g.turn, Row: i / g.board.Cols, Col: i % g.board.Cols}
+		if p == NoPlayer && (g.config.Variant != Ultimate || g.Legal(m) == nil) {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// Wins reports whether the move would win the game for its player,
+// whether or not it is their turn.
+func (g *Game) Wins(m Move) bool {
+	c := g.Clone()
+	c.turn = m.Player
+	return c.Play(m) == nil && c.status == Won
+}
+
+// Score estimates how well p is placed. It is used by computer opponents
+// that cannot search to the end of a game.
+func (g *Game) Score(p Player) int {
+	if g.config.Variant != Ultimate {
+		return g.board.Score(p, g.config.K)
+	}
+
+	// the large board matters far more than any single small one
+	score := 16 * g.SubBoards().Score(p, 3)
+	for i, s := range g.subs {
+		if !s.decided() {
+			score += g.board.score(subWindow(i), p, 3)
+		}
+	}
+	return score
+}
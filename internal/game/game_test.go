@@ -0,0 +1,162 @@
+package game_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestGame(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("X moves first", func(t *testing.T) {
+		g := game.New()
+		is.Equal(g.Turn(), game.X) // X has the first turn
+
+		err := g.Play(game.Move{Player: game.O, Row: 0, Col: 0})
+		is.True(errors.Is(err, game.ErrWrongTurn)) // O cannot open
+	})
+
+	t.Run("occupied cell", func(t *testing.T) {
+		g := game.New()
+		is.NoErr(g.Play(game.Move{Player: game.X, Row: 1, Col: 1})) // centre
+
+		err := g.Play(game.Move{Player: game.O, Row: 1, Col: 1})
+		is.True(errors.Is(err, game.ErrOccupied)) // cell taken
+
+		var me *game.MoveError
+		is.True(errors.As(err, &me))     // typed error
+		is.Equal(me.Move.Player, game.O) // offending move is reported
+	})
+
+	t.Run("out of bounds", func(t *testing.T) {
+		g := game.New()
+		err := g.Play(game.Move{Player: game.X, Row: 3, Col: 0})
+		is.True(errors.Is(err, game.ErrOutOfBounds)) // row outside board
+	})
+
+	t.Run("win on a diagonal", func(t *testing.T) {
+		g, err := game.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 0, Col: 1},
+			{Player: game.X, Row: 1, Col: 1},
+			{Player: game.O, Row: 0, Col: 2},
+			{Player: game.X, Row: 2, Col: 2},
+		})
+		is.NoErr(err)                     // replay moves
+		is.Equal(g.Status(), game.Won)    // game is won
+		is.Equal(g.Winner(), game.X)      // by X
+		is.Equal(g.Turn(), game.NoPlayer) // nobody moves next
+		is.Equal(len(g.LegalMoves()), 0)  // no moves remain
+
+		err = g.Play(game.Move{Player: game.O, Row: 2, Col: 0})
+		is.True(errors.Is(err, game.ErrGameOver)) // cannot play after a win
+	})
+
+	t.Run("draw on a full board", func(t *testing.T) {
+		// X O X
+		// X O O
+		// O X X
+		g, err := game.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 0, Col: 1},
+			{Player: game.X, Row: 0, Col: 2},
+			{Player: game.O, Row: 1, Col: 1},
+			{Player: game.X, Row: 1, Col: 0},
+			{Player: game.O, Row: 1, Col: 2},
+			{Player: game.X, Row: 2, Col: 1},
+			{Player: game.O, Row: 2, Col: 0},
+			{Player: game.X, Row: 2, Col: 2},
+		})
+		is.NoErr(err)                       // replay moves
+		is.Equal(g.Status(), game.Draw)     // game is drawn
+		is.Equal(g.Winner(), game.NoPlayer) // without a winner
+	})
+}
+
+func TestVariants(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("reject unplayable boards", func(t *testing.T) {
+		_, err := game.Config{Variant: game.MNK, Rows: 2, Cols: 30, K: 3}.New()
+		is.True(err != nil) // board too small and too large
+
+		_, err = game.Config{Variant: game.MNK, Rows: 4, Cols: 4, K: 5}.New()
+		is.True(err != nil) // line does not fit
+
+		_, err = game.Config{Variant: "chess"}.New()
+		is.True(err != nil) // unknown variant
+	})
+
+	t.Run("four in a row on 4x4", func(t *testing.T) {
+		c := game.Config{Variant: game.MNK, Rows: 4, Cols: 4, K: 4}
+
+		g, err := c.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 1, Col: 0},
+			{Player: game.X, Row: 0, Col: 1},
+			{Player: game.O, Row: 1, Col: 1},
+			{Player: game.X, Row: 0, Col: 2},
+			{Player: game.O, Row: 1, Col: 2},
+		})
+		is.NoErr(err)                         // replay moves
+		is.Equal(g.Status(), game.InProgress) // three is not enough
+
+		is.NoErr(g.Play(game.Move{Player: game.X, Row: 0, Col: 3})) // complete the row
+		is.Equal(g.Winner(), game.X)                                // X wins
+	})
+
+	t.Run("five in a row on 15x15", func(t *testing.T) {
+		c := game.Config{Variant: game.MNK, Rows: 15, Cols: 15, K: 5}
+
+		var ms []game.Move
+		for i := 0; i < 5; i++ {
+			ms = append(ms, game.Move{Player: game.X, Row: 10 - i, Col: 3 + i})
+			if i < 4 {
+				ms = append(ms, game.Move{Player: game.O, Row: 0, Col: i})
+			}
+		}
+
+		g, err := c.Replay(ms)
+		is.NoErr(err)                  // replay moves
+		is.Equal(g.Status(), game.Won) // anti-diagonal wins
+		is.Equal(g.Winner(), game.X)   // for X
+	})
+
+	t.Run("ultimate sends the opponent to a board", func(t *testing.T) {
+		g, err := game.Config{Variant: game.Ultimate}.New()
+		is.NoErr(err)          // new game
+		is.Equal(g.Next(), -1) // first move is free
+
+		// top-right cell of the centre board sends O to the top-right board
+		is.NoErr(g.Play(game.Move{Player: game.X, Row: 3, Col: 5}))
+		is.Equal(g.Next(), 2) // top-right board
+
+		err = g.Play(game.Move{Player: game.O, Row: 4, Col: 4})
+		is.True(errors.Is(err, game.ErrWrongBoard)) // must play top-right
+
+		is.NoErr(g.Play(game.Move{Player: game.O, Row: 0, Col: 6})) // top-left of top-right board
+	})
+
+	t.Run("ultimate small boards are won", func(t *testing.T) {
+		// X takes the top row of the top-left board while O is sent
+		// back and forth between the top-centre and top-right boards
+		c := game.Config{Variant: game.Ultimate}
+		g, err := c.Replay([]game.Move{
+			{Player: game.X, Row: 0, Col: 0}, {Player: game.O, Row: 1, Col: 1},
+			{Player: game.X, Row: 3, Col: 4}, {Player: game.O, Row: 0, Col: 3},
+			{Player: game.X, Row: 0, Col: 1}, {Player: game.O, Row: 1, Col: 4},
+			{Player: game.X, Row: 3, Col: 5}, {Player: game.O, Row: 0, Col: 6},
+			{Player: game.X, Row: 0, Col: 2},
+		})
+		is.NoErr(err) // replay moves
+
+		is.Equal(g.SubBoards().At(0, 0), game.X) // X took the top-left board
+		is.Equal(g.Next(), 2)                    // O goes to the top-right board
+
+		err = g.Play(game.Move{Player: game.O, Row: 3, Col: 0})
+		is.True(errors.Is(err, game.ErrWrongBoard)) // must follow the last move
+	})
+}
@@ -0,0 +1,36 @@
+package game
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Record is a game together with the people playing it. The creator
+// always plays X and whoever joins with the invite code plays O.
+type Record struct {
+	ID         uuid.UUID
+	InviteCode string
+	X          uuid.UUID
+	O          uuid.UUID // uuid.Nil until an opponent joins
+	Game       *Game
+	CreatedAt  time.Time
+}
+
+// Open reports whether the game is still waiting for an opponent.
+func (r *Record) Open() bool { return r.O == uuid.Nil }
+
+// PlayerOf returns the mark played by the given user, or NoPlayer
+// if they are not taking part in the game.
+func (r *Record) PlayerOf(uid uuid.UUID) Player {
+	switch uid {
+	case uuid.Nil:
+		return NoPlayer
+	case r.X:
+		return X
+	case r.O:
+		return O
+	default:
+		return NoPlayer
+	}
+}
@@ -0,0 +1,257 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Repo interface {
+	SetGame(ctx context.Context, args pgx.QueryRewriter) error
+	GetGame(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error)
+	GetGameByInviteCode(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error)
+	SetParticipant(ctx context.Context, args pgx.QueryRewriter) error
+	SetMove(ctx context.Context, args pgx.QueryRewriter) error
+	// SetFinalMove stores the move that ends a game, and the `outbox.Message`
+	// in `result`, in a single transaction
+	SetFinalMove(ctx context.Context, args, result pgx.QueryRewriter) error
+	GetMoves(ctx context.Context, args pgx.QueryRewriter) ([]*game.Move, error)
+}
+
+type repo struct {
+	g pg.Conn[game.Record]
+	m pg.Conn[game.Move]
+}
+
+type UUIDArgs struct {
+	ID uuid.UUID
+}
+
+func (a UUIDArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id": a.ID,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+type InviteCodeArgs struct {
+	InviteCode string
+}
+
+func (a InviteCodeArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"invite_code": a.InviteCode,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+type SetGameArgs struct {
+	ID         uuid.UUID
+	InviteCode string
+	// Owner is the profile that created the game and plays X
+	Owner uuid.UUID
+	// Opponent plays O, or is uuid.Nil for a game waiting for one to join
+	Opponent uuid.UUID
+	Config   game.Config
+}
+
+func (a SetGameArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	var opponent *uuid.UUID
+	if a.Opponent != uuid.Nil {
+		opponent = &a.Opponent
+	}
+
+	na := pgx.NamedArgs{
+		"id":          a.ID,
+		"invite_code": a.InviteCode,
+		"profile_id":  a.Owner,
+		"opponent_id": opponent,
+		"variant":     string(a.Config.Variant),
+		"rows":        a.Config.Rows,
+		"cols":        a.Config.Cols,
+		"k":           a.Config.K,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// SetGame creates the game and seats its owner, and any opponent,
+// in a single statement
+func (r *repo) SetGame(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	WITH g AS (
+		INSERT INTO games.games (id, invite_code, variant, rows, cols, k)
+		VALUES (@id, @invite_code, @variant, @rows, @cols, @k)
+		RETURNING id
+	)
+	INSERT INTO games.participants (game_id, profile_id, mark)
+	SELECT id, @profile_id::UUID, 'X' FROM g
+	UNION ALL
+	SELECT id, @opponent_id::UUID, 'O' FROM g WHERE @opponent_id::UUID IS NOT NULL`
+
+	_, err := r.g.ExecContext(ctx, q, args)
+	return err
+}
+
+const selectGame = `
+	SELECT g.id, g.invite_code, g.created_at, g.variant, g.rows, g.cols, g.k, x.profile_id, o.profile_id
+	FROM games.games g
+	JOIN games.participants x ON x.game_id = g.id AND x.mark = 'X'
+	LEFT JOIN games.participants o ON o.game_id = g.id AND o.mark = 'O'`
+
+func scanGame(row pgx.Row, rec *game.Record) error {
+	var c game.Config
+	// O is null until an opponent joins
+	var o *uuid.UUID
+	if err := row.Scan(&rec.ID, &rec.InviteCode, &rec.CreatedAt, &c.Variant, &c.Rows, &c.Cols, &c.K, &rec.X, &o); err != nil {
+		return err
+	}
+
+	if o != nil {
+		rec.O = *o
+	}
+
+	// the board is empty until replay
+	var err error
+	rec.Game, err = c.New()
+	return err
+}
+
+// GetGame implements Repo. The board is rebuilt from the move log.
+func (r *repo) GetGame(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error) {
+	const q = selectGame + `
+	WHERE g.id = @id`
+
+	rec, err := r.g.QueryRowContext(ctx, scanGame, q, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, r.replay(ctx, rec)
+}
+
+func (r *repo) GetGameByInviteCode(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error) {
+	const q = selectGame + `
+	WHERE g.invite_code = @invite_code`
+
+	rec, err := r.g.QueryRowContext(ctx, scanGame, q, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, r.replay(ctx, rec)
+}
+
+func (r *repo) replay(ctx context.Context, rec *game.Record) error {
+	ms, err := r.GetMoves(ctx, UUIDArgs{ID: rec.ID})
+	if err != nil {
+		return err
+	}
+
+	moves := make([]game.Move, len(ms))
+	for i, m := range ms {
+		moves[i] = *m
+	}
+
+	rec.Game, err = rec.Game.Config().Replay(moves)
+	return err
+}
+
+type SetParticipantArgs struct {
+	GameID    uuid.UUID
+	ProfileID uuid.UUID
+	Player    game.Player
+}
+
+func (a SetParticipantArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"game_id":    a.GameID,
+		"profile_id": a.ProfileID,
+		"mark":       a.Player.String(),
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// SetParticipant seats a player. A seat that is already taken
+// violates the primary key of `games.participants`.
+func (r *repo) SetParticipant(ctx context.Context, args pgx.QueryRewriter) error {
+	const q = `
+	INSERT INTO games.participants (game_id, profile_id, mark)
+	VALUES (@game_id, @profile_id, @mark)`
+
+	_, err := r.g.ExecContext(ctx, q, args)
+	return err
+}
+
+type SetMoveArgs struct {
+	GameID uuid.UUID
+	// Seq is the position of the move in the log, starting at 1
+	Seq  int
+	Move game.Move
+}
+
+func (a SetMoveArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"game_id": a.GameID,
+		"seq":     a.Seq,
+		"mark":    a.Move.Player.String(),
+		"row":     a.Move.Row,
+		"col":     a.Move.Col,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+const insertMove = `
+	INSERT INTO games.moves (game_id, seq, mark, cell_row, cell_col)
+	VALUES (@game_id, @seq, @mark, @row, @col)`
+
+// SetMove appends to the move log. Two moves racing for the same
+// position violate the primary key of `games.moves`.
+func (r *repo) SetMove(ctx context.Context, args pgx.QueryRewriter) error {
+	_, err := r.m.ExecContext(ctx, insertMove, args)
+	return err
+}
+
+// SetFinalMove appends the last move of a game to the move log and enqueues
+// its result, so the result is published if, and only if, the move is stored
+func (r *repo) SetFinalMove(ctx context.Context, args, result pgx.QueryRewriter) error {
+	return r.m.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := r.m.ExecTx(ctx, tx, insertMove, args); err != nil {
+			return err
+		}
+		return outbox.Enqueue(ctx, tx, result)
+	})
+}
+
+func (r *repo) GetMoves(ctx context.Context, args pgx.QueryRewriter) ([]*game.Move, error) {
+	const q = `
+	SELECT mark, cell_row, cell_col
+	FROM games.moves
+	WHERE game_id = @id
+	ORDER BY seq`
+
+	return r.m.QueryContext(ctx, func(r pgx.Rows, m *game.Move) error {
+		var mark string
+		if err := r.Scan(&mark, &m.Row, &m.Col); err != nil {
+			return err
+		}
+		return m.Player.UnmarshalText([]byte(mark))
+	}, q, args)
+}
+
+func New(rwc *pgxpool.Pool) Repo {
+	r := &repo{
+		g: pg.NewConn[game.Record](rwc),
+		m: pg.NewConn[game.Move](rwc),
+	}
+	return r
+}
@@ -0,0 +1,222 @@
+package repo_test
+
+import (
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/docker"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/game/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	gameRepo  repo.Repo
+	gameConn  *pgxpool.Pool
+	container *docker.PostgresContainer
+)
+
+func init() {
+	ctx := context.TODO()
+
+	m := `
+	CREATE SCHEMA IF NOT EXISTS games;
+
+	CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+	CREATE TABLE IF NOT EXISTS games.games (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		invite_code VARCHAR(6) UNIQUE NOT NULL,
+		variant VARCHAR(16) NOT NULL DEFAULT 'classic' CHECK (variant IN ('classic', 'mnk', 'ultimate')),
+		rows INT NOT NULL DEFAULT 3 CHECK (rows BETWEEN 3 AND 19),
+		cols INT NOT NULL DEFAULT 3 CHECK (cols BETWEEN 3 AND 19),
+		k INT NOT NULL DEFAULT 3 CHECK (k >= 3),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE TABLE IF NOT EXISTS games.participants (
+		game_id UUID NOT NULL REFERENCES games.games (id) ON DELETE CASCADE,
+		profile_id UUID NOT NULL,
+		mark CHAR(1) NOT NULL CHECK (mark IN ('X', 'O')),
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (game_id, mark),
+		UNIQUE (game_id, profile_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS games.moves (
+		game_id UUID NOT NULL REFERENCES games.games (id) ON DELETE CASCADE,
+		seq INT NOT NULL CHECK (seq > 0),
+		mark CHAR(1) NOT NULL CHECK (mark IN ('X', 'O')),
+		cell_row INT NOT NULL CHECK (cell_row >= 0),
+		cell_col INT NOT NULL CHECK (cell_col >= 0),
+		played_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (game_id, seq)
+	);
+
+	-- the move log is append-only
+	CREATE OR REPLACE FUNCTION games.reject_move_update() RETURNS TRIGGER AS $$
+	BEGIN
+		RAISE EXCEPTION 'games.moves is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER moves_append_only
+	BEFORE UPDATE ON games.moves
+	FOR EACH ROW EXECUTE FUNCTION games.reject_move_update();
+	` + outbox.Schema
+
+	var err error
+	container, gameConn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize test repo
+	gameRepo = repo.New(gameConn)
+}
+
+func TestGameRepository(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	var (
+		gameID   = uuid.New()
+		johnDoe  = uuid.New()
+		janeDoe  = uuid.New()
+		inviteCD = "ABC123"
+	)
+
+	t.Run("create a new game", func(t *testing.T) {
+		args := repo.SetGameArgs{
+			ID:         gameID,
+			InviteCode: inviteCD,
+			Owner:      johnDoe,
+			Config:     game.DefaultConfig,
+		}
+
+		err := gameRepo.SetGame(ctx, args)
+		is.NoErr(err) // create a new game
+	})
+
+	t.Run("find game by invite code", func(t *testing.T) {
+		rec, err := gameRepo.GetGameByInviteCode(ctx, repo.InviteCodeArgs{InviteCode: inviteCD})
+		is.NoErr(err)            // get game
+		is.Equal(rec.ID, gameID) // id is correct
+		is.Equal(rec.X, johnDoe) // owner plays X
+		is.True(rec.Open())      // waiting for an opponent
+	})
+
+	t.Run("join the game", func(t *testing.T) {
+		args := repo.SetParticipantArgs{
+			GameID:    gameID,
+			ProfileID: janeDoe,
+			Player:    game.O,
+		}
+
+		err := gameRepo.SetParticipant(ctx, args)
+		is.NoErr(err) // seat O
+	})
+
+	t.Run("seat already taken", func(t *testing.T) {
+		args := repo.SetParticipantArgs{
+			GameID:    gameID,
+			ProfileID: uuid.New(),
+			Player:    game.O,
+		}
+
+		err := gameRepo.SetParticipant(ctx, args)
+		is.True(pg.IsUniqueViolation(err)) // O is taken
+	})
+
+	t.Run("append moves", func(t *testing.T) {
+		moves := []game.Move{
+			{Player: game.X, Row: 0, Col: 0},
+			{Player: game.O, Row: 1, Col: 1},
+			{Player: game.X, Row: 0, Col: 1},
+		}
+
+		for i, m := range moves {
+			err := gameRepo.SetMove(ctx, repo.SetMoveArgs{GameID: gameID, Seq: i + 1, Move: m})
+			is.NoErr(err) // append move
+		}
+	})
+
+	t.Run("racing moves conflict", func(t *testing.T) {
+		m := game.Move{Player: game.O, Row: 2, Col: 2}
+
+		err := gameRepo.SetMove(ctx, repo.SetMoveArgs{GameID: gameID, Seq: 3, Move: m})
+		is.True(pg.IsUniqueViolation(err)) // position 3 already played
+	})
+
+	t.Run("rebuild the board from the move log", func(t *testing.T) {
+		rec, err := gameRepo.GetGame(ctx, repo.UUIDArgs{ID: gameID})
+		is.NoErr(err)                               // get game
+		is.Equal(rec.O, janeDoe)                    // opponent plays O
+		is.Equal(rec.Game.MoveCount(), 3)           // every move replayed
+		is.Equal(rec.Game.Board().At(1, 1), game.O) // O holds the centre
+		is.Equal(rec.Game.Turn(), game.O)           // O moves next
+	})
+
+	t.Run("the result is enqueued with the final move", func(t *testing.T) {
+		result, err := outbox.NewMessage(events.TopicGameFinished, events.DataGameResult{ID: gameID, Winner: game.X})
+		is.NoErr(err) // new message
+
+		finished := func() (n int) {
+			err := gameConn.QueryRow(ctx, `SELECT count(*) FROM outbox.messages WHERE subject = $1`, events.EventGameFinished).Scan(&n)
+			is.NoErr(err) // count outbox
+			return n
+		}
+
+		m := game.Move{Player: game.O, Row: 2, Col: 2}
+		err = gameRepo.SetFinalMove(ctx, repo.SetMoveArgs{GameID: gameID, Seq: 3, Move: m}, result)
+		is.True(pg.IsUniqueViolation(err)) // move is rejected
+		is.Equal(finished(), 0)            // and so is the result
+
+		err = gameRepo.SetFinalMove(ctx, repo.SetMoveArgs{GameID: gameID, Seq: 4, Move: m}, result)
+		is.NoErr(err)           // move is stored
+		is.Equal(finished(), 1) // with the result
+	})
+
+	t.Run("create a game for two players", func(t *testing.T) {
+		id := uuid.New()
+
+		err := gameRepo.SetGame(ctx, repo.SetGameArgs{ID: id, InviteCode: "PAIR01", Owner: johnDoe, Opponent: janeDoe, Config: game.DefaultConfig})
+		is.NoErr(err) // create a matched game
+
+		rec, err := gameRepo.GetGame(ctx, repo.UUIDArgs{ID: id})
+		is.NoErr(err)            // get game
+		is.Equal(rec.X, johnDoe) // owner plays X
+		is.Equal(rec.O, janeDoe) // opponent plays O
+		is.True(!rec.Open())     // nobody else can join
+
+		err = gameRepo.SetGame(ctx, repo.SetGameArgs{ID: uuid.New(), InviteCode: "PAIR02", Owner: johnDoe, Opponent: johnDoe, Config: game.DefaultConfig})
+		is.True(err != nil) // a player cannot play themselves
+
+		_, err = gameRepo.GetGameByInviteCode(ctx, repo.InviteCodeArgs{InviteCode: "PAIR02"})
+		is.Equal(err, pgx.ErrNoRows) // the game is not left with one player
+	})
+
+	t.Run("keep the variant of the game", func(t *testing.T) {
+		id := uuid.New()
+		c := game.Config{Variant: game.MNK, Rows: 15, Cols: 15, K: 5}
+
+		err := gameRepo.SetGame(ctx, repo.SetGameArgs{ID: id, InviteCode: "MNK015", Owner: johnDoe, Config: c})
+		is.NoErr(err) // create a gomoku game
+
+		err = gameRepo.SetMove(ctx, repo.SetMoveArgs{GameID: id, Seq: 1, Move: game.Move{Player: game.X, Row: 14, Col: 14}})
+		is.NoErr(err) // play in the far corner
+
+		rec, err := gameRepo.GetGame(ctx, repo.UUIDArgs{ID: id})
+		is.NoErr(err)                     // get game
+		is.Equal(rec.Game.Config(), c)    // same board
+		is.Equal(rec.Game.MoveCount(), 1) // move replayed
+	})
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/hyphengolang/noughts-and-crosses/internal/conf"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/game/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+)
+
+const (
+	// time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+	// must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// update is the JSON message streamed to clients watching a game
+type update struct {
+	// Type is "state" for the snapshot sent on connect,
+	// "join" when the opponent arrives and "move" after each move
+	Type string     `json:"type"`
+	Seq  int        `json:"seq"`
+	Move *game.Move `json:"move,omitempty"`
+	Game gameView   `json:"game"`
+}
+
+func newSnapshot(rec *game.Record, viewer uuid.UUID) update {
+	return update{Type: "state", Seq: rec.Game.MoveCount(), Game: newGameView(rec, viewer)}
+}
+
+func newUpdate(d *events.DataGameState) update {
+	u := update{
+		Type: "move",
+		Seq:  d.Seq,
+		Move: d.Move,
+		Game: gameView{
+			ID:     d.ID,
+			X:      d.X,
+			Config: d.Config,
+			Board:  d.Board,
+			Next:   d.Next,
+			Turn:   d.Turn,
+			Status: d.Status,
+			Winner: d.Winner,
+			Moves:  d.Seq,
+		},
+	}
+
+	if d.Move == nil {
+		u.Type = "join"
+	}
+	if d.O != uuid.Nil {
+		u.Game.O = &d.O
+	}
+	return u
+}
+
+// subscribe listens for updates to a game and returns the current state.
+// The subscription is made first so that nothing published while the state
+// is being read can be missed; callers should skip updates with a `Seq` at
+// or below the snapshot's.
+func (s *Service) subscribe(r *http.Request, id uuid.UUID) (<-chan *events.DataGameState, func(), *game.Record, error) {
+	ch := make(chan *events.DataGameState, 16)
+
+	sub, err := events.GameTopic(id).Bind(s.e, ch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rec, err := s.r.GetGame(r.Context(), repo.UUIDArgs{ID: id})
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, nil, nil, err
+	}
+
+	return ch, func() { sub.Unsubscribe() }, rec, nil
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin only lets the client app, or pages of the API itself, open a
+// WebSocket. CORS does not apply to the upgrade, and browsers send the
+// access token cookie whichever site opens it.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not sent by a browser
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if c, err := url.Parse(conf.ClientURI); err == nil && c.Host != "" && strings.EqualFold(u.Scheme, c.Scheme) && strings.EqualFold(u.Host, c.Host) {
+		return true
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func (s *Service) handleWebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		id, _ := uuidFromRequest(r)
+
+		updates, unsubscribe, rec, err := s.subscribe(r, id)
+		if err != nil {
+			s.m.Respond(w, r, err, statusOf(err))
+			return
+		}
+		defer unsubscribe()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already replied to the client
+			s.m.Logf("websocket upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// the client only sends control frames, but reading is
+		// required to process them and to notice a disconnect
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn.SetReadLimit(512)
+			conn.SetReadDeadline(time.Now().Add(pongWait))
+			conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(pongWait)) })
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		write := func(v any) error {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			return conn.WriteJSON(v)
+		}
+
+		// a client that reconnects catches up from the current state
+		seq := rec.Game.MoveCount()
+		if err := write(newSnapshot(rec, caller.ID)); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case d := <-updates:
+				if d.Seq < seq || (d.Seq == seq && d.Move != nil) {
+					// already part of the snapshot
+					continue
+				}
+				seq = d.Seq
+				if err := write(newUpdate(d)); err != nil {
+					return
+				}
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
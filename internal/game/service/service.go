@@ -0,0 +1,552 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game/ai"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/game/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/noughts-and-crosses/pkg/rand"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrNotFound       = errs.New(errs.NotFound, "game not found")
+	ErrNotParticipant = errs.New(errs.PermissionDenied, "not a participant in this game")
+	ErrAlreadyJoined  = errs.New(errs.Conflict, "game already has two players")
+	ErrWaiting        = errs.New(errs.Conflict, "waiting for an opponent to join")
+	ErrConflict       = errs.New(errs.Conflict, "game changed while the move was being played")
+)
+
+func uuidParser(r *http.Request, key string) (uuid.UUID, error) {
+	return uuid.Parse(chi.URLParam(r, key))
+}
+
+func uuidFromRequest(r *http.Request) (uuid.UUID, error) {
+	return service.PathParamFromRequest[uuid.UUID](r)
+}
+
+type Service struct {
+	m service.Router
+	e events.Broker
+	t token.Client
+	r repo.Repo
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.ServeHTTP(w, r)
+}
+
+func New(e events.Broker, t token.Client, r repo.Repo) (*Service, error) {
+	s := &Service{
+		m: service.NewRouter(),
+		e: e,
+		t: t,
+		r: r,
+	}
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+	s.routes()
+	return s, nil
+}
+
+func (s *Service) routes() {
+	// playing needs the scope granted to every role
+	play := s.m.With(service.Authenticate(s.t), s.m.RequireScope(reg.ScopePlay))
+	play.Post("/", s.handleCreateGame())
+	play.Post("/join", s.handleJoinGame())
+	play.Get("/events", s.handleLobbyEvents())
+
+	r := play.With(service.PathParam("uuid", uuidParser))
+	r.Get("/{uuid}", s.handleGetState())
+	r.Post("/{uuid}/moves", s.handleMove())
+	r.Get("/{uuid}/ws", s.handleWebSocket())
+	r.Get("/{uuid}/events", s.handleGameEvents())
+}
+
+func (s *Service) listen() error {
+	// one instance creates each game paired by matchmaking
+	return events.TopicMatchFound.QueueSubscribe(s.e, "workers", s.handleMatchFound())
+}
+
+type gameView struct {
+	ID         uuid.UUID   `json:"id"`
+	InviteCode string      `json:"inviteCode,omitempty"`
+	X          uuid.UUID   `json:"x"`
+	O          *uuid.UUID  `json:"o"` // null until an opponent joins
+	Config     game.Config `json:"config"`
+	Board      game.Board  `json:"board"`
+	// Next is the ultimate sub-board, numbered 0 to 8 in row-major
+	// order, that the next move must be played on, or -1 for any
+	Next   int         `json:"next"`
+	Turn   game.Player `json:"turn"`
+	Status game.Status `json:"status"`
+	Winner game.Player `json:"winner"`
+	Moves  int         `json:"moves"`
+}
+
+// newGameView is the game as `viewer` sees it. Anyone may watch a game,
+// but only its players see the invite code.
+func newGameView(rec *game.Record, viewer uuid.UUID) gameView {
+	v := gameView{
+		ID:     rec.ID,
+		X:      rec.X,
+		Config: rec.Game.Config(),
+		Board:  rec.Game.Board(),
+		Next:   rec.Game.Next(),
+		Turn:   rec.Game.Turn(),
+		Status: rec.Game.Status(),
+		Winner: rec.Game.Winner(),
+		Moves:  rec.Game.MoveCount(),
+	}
+
+	if rec.Open() {
+		// only worth sharing while someone can still join
+		if rec.PlayerOf(viewer) != game.NoPlayer {
+			v.InviteCode = rec.InviteCode
+		}
+	} else {
+		v.O = &rec.O
+	}
+	return v
+}
+
+func newGameState(rec *game.Record, m *game.Move) events.DataGameState {
+	return events.DataGameState{
+		ID:     rec.ID,
+		Seq:    rec.Game.MoveCount(),
+		X:      rec.X,
+		O:      rec.O,
+		Config: rec.Game.Config(),
+		Board:  rec.Game.Board(),
+		Next:   rec.Game.Next(),
+		Turn:   rec.Game.Turn(),
+		Status: rec.Game.Status(),
+		Winner: rec.Game.Winner(),
+		Move:   m,
+	}
+}
+
+// statusOf maps errors raised by the store and game engine to a response status
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, pgx.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotParticipant):
+		return http.StatusForbidden
+	case errors.Is(err, game.ErrOutOfBounds),
+		errors.Is(err, game.ErrInvalidPlayer),
+		errors.Is(err, game.ErrInvalidConfig):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAlreadyJoined),
+		errors.Is(err, ErrWaiting),
+		errors.Is(err, ErrConflict),
+		errors.Is(err, game.ErrOccupied),
+		errors.Is(err, game.ErrWrongTurn),
+		errors.Is(err, game.ErrWrongBoard),
+		errors.Is(err, game.ErrBoardDecided),
+		errors.Is(err, game.ErrGameOver):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *Service) handleCreateGame() http.HandlerFunc {
+	type Q struct {
+		// Opponent is "bot" to play against the computer,
+		// otherwise the game waits for someone to join
+		Opponent string   `json:"opponent"`
+		Level    ai.Level `json:"level"`
+		// the board is classic unless a variant is given;
+		// rows, cols and k only apply to "mnk"
+		Variant game.Variant `json:"variant"`
+		Rows    int          `json:"rows"`
+		Cols    int          `json:"cols"`
+		K       int          `json:"k"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		uid := caller.ID
+
+		// the body is optional
+		var q Q
+		if err := s.m.Decode(w, r, &q); err != nil && !errors.Is(err, io.EOF) {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		g, err := game.Config{Variant: q.Variant, Rows: q.Rows, Cols: q.Cols, K: q.K}.New()
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		rec, err := s.createGame(r.Context(), uuid.New(), uid, uuid.Nil, g)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		s.publishLobby(rec, "created")
+
+		if q.Opponent == "bot" {
+			if q.Level == 0 {
+				q.Level = ai.Medium
+			}
+
+			args := repo.SetParticipantArgs{
+				GameID:    rec.ID,
+				ProfileID: q.Level.ID(),
+				Player:    game.O,
+			}
+
+			if err := s.r.SetParticipant(r.Context(), args); err != nil {
+				s.m.Respond(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			rec.O = q.Level.ID()
+			s.publish(rec, nil)
+		}
+
+		s.m.SetLocation(w, r, strings.TrimSuffix(r.URL.Path, "/")+"/"+rec.ID.String())
+		s.m.Respond(w, r, newGameView(rec, uid), http.StatusCreated)
+	}
+}
+
+func (s *Service) handleJoinGame() http.HandlerFunc {
+	type Q struct {
+		InviteCode string `json:"inviteCode"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		uid := caller.ID
+
+		var q Q
+		if err := s.m.Decode(w, r, &q); err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		rec, joined, err := s.joinGame(r.Context(), q.InviteCode, uid)
+		if err != nil {
+			s.m.Respond(w, r, err, statusOf(err))
+			return
+		}
+
+		if joined {
+			s.publish(rec, nil)
+		}
+
+		s.m.Respond(w, r, newGameView(rec, uid), http.StatusOK)
+	}
+}
+
+func (s *Service) handleGetState() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		id, _ := uuidFromRequest(r)
+
+		rec, err := s.r.GetGame(r.Context(), repo.UUIDArgs{ID: id})
+		if err != nil {
+			s.m.Respond(w, r, err, statusOf(err))
+			return
+		}
+
+		s.m.Respond(w, r, newGameView(rec, caller.ID), http.StatusOK)
+	}
+}
+
+func (s *Service) handleMove() http.HandlerFunc {
+	type Q struct {
+		Row int `json:"row"`
+		Col int `json:"col"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		uid := caller.ID
+
+		id, _ := uuidFromRequest(r)
+
+		var q Q
+		if err := s.m.Decode(w, r, &q); err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		rec, m, err := s.playMove(r.Context(), id, uid, q.Row, q.Col)
+		if err != nil {
+			s.m.Respond(w, r, err, statusOf(err))
+			return
+		}
+
+		s.publish(rec, &m)
+
+		if err := s.playBot(r.Context(), rec); err != nil {
+			s.m.Logf("bot move in game %s: %v", rec.ID, err)
+		}
+
+		s.m.Respond(w, r, newGameView(rec, uid), http.StatusOK)
+	}
+}
+
+// createGame stores a new game owned by uid, and seats o unless it is
+// uuid.Nil, picking another invite code in the unlikely event that one
+// is already in use
+func (s *Service) createGame(ctx context.Context, id, uid, o uuid.UUID, g *game.Game) (*game.Record, error) {
+	code := rand.RandString{Length: 6}
+
+	rec := &game.Record{
+		ID:        id,
+		X:         uid,
+		O:         o,
+		Game:      g,
+		CreatedAt: time.Now(),
+	}
+
+	for attempt := 0; ; attempt++ {
+		rec.InviteCode = code.ToUpper()
+
+		args := repo.SetGameArgs{
+			ID:         rec.ID,
+			InviteCode: rec.InviteCode,
+			Owner:      uid,
+			Opponent:   o,
+			Config:     g.Config(),
+		}
+
+		err := s.r.SetGame(ctx, args)
+		if err == nil || !pg.IsUniqueViolation(err) || attempt == 3 {
+			return rec, err
+		}
+	}
+}
+
+// handleMatchFound creates a game for two players paired by matchmaking,
+// then tells both of them it is ready.
+func (s *Service) handleMatchFound() func(d *events.DataMatch) {
+	return func(d *events.DataMatch) {
+		ctx := context.Background()
+
+		g, err := d.Config.New()
+		if err != nil {
+			s.m.Logf("match %s: %v", d.ID, err)
+			return
+		}
+
+		// both players are seated at once, so the game is never left
+		// waiting for an opponent nobody can join as
+		rec, err := s.createGame(ctx, d.ID, d.X, d.O, g)
+		if err != nil {
+			s.m.Logf("create matched game %s: %v", d.ID, err)
+			return
+		}
+
+		s.publishLobby(rec, "created")
+		s.publish(rec, nil)
+
+		for _, t := range d.Tickets {
+			if err := events.TicketTopic(t).Publish(s.e, *d); err != nil {
+				s.m.Logf("publish match %s: %v", d.ID, err)
+			}
+		}
+	}
+}
+
+// joinGame seats uid as O and reports whether they were not already seated
+func (s *Service) joinGame(ctx context.Context, code string, uid uuid.UUID) (*game.Record, bool, error) {
+	rec, err := s.r.GetGameByInviteCode(ctx, repo.InviteCodeArgs{InviteCode: code})
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch {
+	case rec.PlayerOf(uid) != game.NoPlayer:
+		// joining twice is harmless
+		return rec, false, nil
+	case !rec.Open():
+		return nil, false, ErrAlreadyJoined
+	}
+
+	args := repo.SetParticipantArgs{
+		GameID:    rec.ID,
+		ProfileID: uid,
+		Player:    game.O,
+	}
+
+	if err := s.r.SetParticipant(ctx, args); err != nil {
+		if pg.IsUniqueViolation(err) {
+			// someone else took the seat first
+			return nil, false, ErrAlreadyJoined
+		}
+		return nil, false, err
+	}
+
+	rec.O = uid
+	return rec, true, nil
+}
+
+// playMove validates the move against the stored game and appends it to
+// the move log. The log's primary key rejects a move that races another.
+func (s *Service) playMove(ctx context.Context, id, uid uuid.UUID, row, col int) (*game.Record, game.Move, error) {
+	rec, err := s.r.GetGame(ctx, repo.UUIDArgs{ID: id})
+	if err != nil {
+		return nil, game.Move{}, err
+	}
+
+	m := game.Move{Player: rec.PlayerOf(uid), Row: row, Col: col}
+	switch {
+	case m.Player == game.NoPlayer:
+		return nil, m, ErrNotParticipant
+	case rec.Open():
+		return nil, m, ErrWaiting
+	}
+
+	if err := rec.Game.Play(m); err != nil {
+		return nil, m, err
+	}
+
+	if err := s.setMove(ctx, rec, m); err != nil {
+		if pg.IsUniqueViolation(err) {
+			return nil, m, ErrConflict
+		}
+		return nil, m, err
+	}
+
+	return rec, m, nil
+}
+
+// setMove appends a move that has been played on `rec` to the move log.
+// The result of a rated game is enqueued with its final move, so the
+// registry hears of it even if NATS is down when the game ends.
+func (s *Service) setMove(ctx context.Context, rec *game.Record, m game.Move) error {
+	args := repo.SetMoveArgs{
+		GameID: rec.ID,
+		Seq:    rec.Game.MoveCount(),
+		Move:   m,
+	}
+
+	if !rec.Game.Over() || !rated(rec) {
+		return s.r.SetMove(ctx, args)
+	}
+
+	result, err := outbox.NewMessage(events.TopicGameFinished, events.DataGameResult{
+		ID:      rec.ID,
+		Variant: rec.Game.Config().Variant,
+		X:       rec.X,
+		O:       rec.O,
+		Winner:  rec.Game.Winner(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.r.SetFinalMove(ctx, args, result)
+}
+
+// rated reports whether the registry rates the game. Games
+// against the computer are not rated.
+func rated(rec *game.Record) bool {
+	for _, uid := range []uuid.UUID{rec.X, rec.O} {
+		if _, ok := ai.LevelOf(uid); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// publish tells anyone watching the game that it has changed. The change has
+// already been stored so a failed publish is logged rather than returned;
+// clients catch up from the stored state when they reconnect.
+func (s *Service) publish(rec *game.Record, m *game.Move) {
+	if err := events.GameTopic(rec.ID).Publish(s.e, newGameState(rec, m)); err != nil {
+		s.m.Logf("publish game state: %v", err)
+	}
+
+	switch {
+	case m == nil:
+		s.publishLobby(rec, "started")
+	case rec.Game.Over():
+		s.publishLobby(rec, "finished")
+	}
+}
+
+func (s *Service) publishLobby(rec *game.Record, kind string) {
+	data := events.DataLobby{
+		ID:     rec.ID,
+		Kind:   kind,
+		Status: rec.Game.Status(),
+		Winner: rec.Game.Winner(),
+	}
+
+	if err := events.TopicGameLobby.Publish(s.e, data); err != nil {
+		s.m.Logf("publish lobby: %v", err)
+	}
+}
+
+// playBot moves for any computer opponent whose turn it is. Its moves go
+// through the same move log and subjects as a human's.
+func (s *Service) playBot(ctx context.Context, rec *game.Record) error {
+	for !rec.Game.Over() {
+		uid := rec.X
+		if rec.Game.Turn() == game.O {
+			uid = rec.O
+		}
+
+		level, ok := ai.LevelOf(uid)
+		if !ok {
+			return nil
+		}
+
+		m, err := ai.New(level).Choose(rec.Game)
+		if err != nil {
+			return err
+		}
+
+		if err := rec.Game.Play(m); err != nil {
+			return err
+		}
+
+		if err := s.setMove(ctx, rec, m); err != nil {
+			return err
+		}
+
+		s.publish(rec, &m)
+	}
+	return nil
+}
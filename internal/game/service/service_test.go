@@ -0,0 +1,680 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/hyphengolang/noughts-and-crosses/internal/conf"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/game/repository"
+	srv "github.com/hyphengolang/noughts-and-crosses/internal/game/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// memRepo is an in-memory stand-in for the Postgres repository
+type memRepo struct {
+	mu     sync.Mutex
+	games  map[uuid.UUID]*game.Record
+	moves  map[uuid.UUID][]game.Move
+	outbox []outbox.Message
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{games: map[uuid.UUID]*game.Record{}, moves: map[uuid.UUID][]game.Move{}}
+}
+
+func (m *memRepo) SetGame(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetGameArgs)
+
+	// keep an empty game to remember the config
+	g, err := a.Config.New()
+	if err != nil {
+		return err
+	}
+
+	m.games[a.ID] = &game.Record{ID: a.ID, InviteCode: a.InviteCode, X: a.Owner, O: a.Opponent, Game: g, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *memRepo) get(id uuid.UUID) (*game.Record, error) {
+	rec, ok := m.games[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	c := *rec
+	g, err := rec.Game.Config().Replay(m.moves[id])
+	c.Game = g
+	return &c, err
+}
+
+func (m *memRepo) GetGame(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(args.(repo.UUIDArgs).ID)
+}
+
+func (m *memRepo) GetGameByInviteCode(ctx context.Context, args pgx.QueryRewriter) (*game.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, rec := range m.games {
+		if rec.InviteCode == args.(repo.InviteCodeArgs).InviteCode {
+			return m.get(id)
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (m *memRepo) SetParticipant(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetParticipantArgs)
+	m.games[a.GameID].O = a.ProfileID
+	return nil
+}
+
+func (m *memRepo) SetMove(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetMoveArgs)
+	if a.Seq != len(m.moves[a.GameID])+1 {
+		return fmt.Errorf("move %d already played", a.Seq)
+	}
+	m.moves[a.GameID] = append(m.moves[a.GameID], a.Move)
+	return nil
+}
+
+func (m *memRepo) SetFinalMove(ctx context.Context, args, result pgx.QueryRewriter) error {
+	if err := m.SetMove(ctx, args); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outbox = append(m.outbox, result.(outbox.Message))
+	return nil
+}
+
+// enqueued returns the messages sent to the subject
+func (m *memRepo) enqueued(subject string) []outbox.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ms []outbox.Message
+	for _, msg := range m.outbox {
+		if msg.Subject == subject {
+			ms = append(ms, msg)
+		}
+	}
+	return ms
+}
+
+func (m *memRepo) GetMoves(ctx context.Context, args pgx.QueryRewriter) ([]*game.Move, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ms []*game.Move
+	for _, mv := range m.moves[args.(repo.UUIDArgs).ID] {
+		mv := mv
+		ms = append(ms, &mv)
+	}
+	return ms, nil
+}
+
+type gameView struct {
+	ID         uuid.UUID   `json:"id"`
+	InviteCode string      `json:"inviteCode"`
+	O          *uuid.UUID  `json:"o"`
+	Config     game.Config `json:"config"`
+	Next       int         `json:"next"`
+	Turn       game.Player `json:"turn"`
+	Moves      int         `json:"moves"`
+}
+
+type update struct {
+	Type string     `json:"type"`
+	Seq  int        `json:"seq"`
+	Move *game.Move `json:"move"`
+	Game gameView   `json:"game"`
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, token.Client, *nats.EncodedConn) {
+	return newTestServerWith(t, newMemRepo())
+}
+
+func newTestServerWith(t *testing.T, mem *memRepo) (*httptest.Server, token.Client, *nats.EncodedConn) {
+	ns := natsserver.RunRandClientPortServer()
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server has subscriptions of its own
+	n := ns.NumSubscriptions()
+
+	tk := token.NewTokenClient()
+	s, err := srv.New(events.NewClient(ec), tk, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	// wait for the server to register the subscription to matches
+	for deadline := time.Now().Add(5 * time.Second); ns.NumSubscriptions() == n; {
+		if time.Now().After(deadline) {
+			t.Fatal("game service did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return ts, tk, ec
+}
+
+func accessToken(t *testing.T, tk token.Client, uid uuid.UUID) string {
+	p, err := tk.SignToken(context.Background(), token.WithEnd(time.Minute), token.WithSubject(uid.String()), token.WithClaims(token.PrivateClaims{"scope": reg.ScopePlay}), token.WithPurpose(token.PurposeAccess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func do(t *testing.T, method, url, tk string, body any) *http.Response {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req, _ := http.NewRequest(method, url, &buf)
+	req.Header.Set("Authorization", "Bearer "+tk)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// cookie is how a browser sends the access token on a WebSocket
+func cookie(tk string) http.Header {
+	c := &http.Cookie{Name: service.AccessTokenCookie, Value: tk}
+	return http.Header{"Cookie": {c.String()}}
+}
+
+func TestWebSocket(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+
+	var (
+		john = accessToken(t, tk, uuid.New())
+		jane = accessToken(t, tk, uuid.New())
+	)
+
+	var g gameView
+	{
+		res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+		res = do(t, http.MethodPost, ts.URL+"/join", jane, map[string]string{"inviteCode": g.InviteCode})
+		is.Equal(res.StatusCode, http.StatusOK) // join game
+	}
+
+	dial := func(tk string) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/" + g.ID.String() + "/ws"
+		return websocket.DefaultDialer.Dial(url, cookie(tk))
+	}
+
+	read := func(conn *websocket.Conn) update {
+		var u update
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		is.NoErr(conn.ReadJSON(&u)) // read update
+		return u
+	}
+
+	t.Run("reject connection without a valid token", func(t *testing.T) {
+		_, res, err := dial("not-a-token")
+		is.True(err != nil)                               // handshake fails
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // unauthorized
+	})
+
+	t.Run("reject other sites", func(t *testing.T) {
+		h := cookie(jane)
+		h.Set("Origin", "https://evil.example")
+
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/"+g.ID.String()+"/ws", h)
+		is.True(err != nil)                            // handshake fails
+		is.Equal(res.StatusCode, http.StatusForbidden) // cross-site hijacking
+	})
+
+	t.Run("accept the client app", func(t *testing.T) {
+		uri := conf.ClientURI
+		conf.ClientURI = "https://app.example"
+		t.Cleanup(func() { conf.ClientURI = uri })
+
+		h := cookie(jane)
+		h.Set("Origin", "https://app.example")
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/"+g.ID.String()+"/ws", h)
+		is.NoErr(err) // same origin as CLIENT_URI
+		conn.Close()
+	})
+
+	t.Run("ignore a token in the query", func(t *testing.T) {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/" + g.ID.String() + "/ws?token=" + jane
+		_, res, err := websocket.DefaultDialer.Dial(url, nil)
+		is.True(err != nil)                               // handshake fails
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // query is logged, so never trusted
+	})
+
+	t.Run("stream moves to the opponent", func(t *testing.T) {
+		conn, _, err := dial(jane)
+		is.NoErr(err) // connect as O
+		defer conn.Close()
+
+		u := read(conn)
+		is.Equal(u.Type, "state")     // snapshot on connect
+		is.True(u.Game.O != nil)      // opponent has joined
+		is.Equal(u.Game.Turn, game.X) // X to play
+
+		res := do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", john, map[string]int{"row": 1, "col": 1})
+		is.Equal(res.StatusCode, http.StatusOK) // X plays the centre
+
+		u = read(conn)
+		is.Equal(u.Type, "move")        // move is pushed
+		is.Equal(u.Seq, 1)              // first move
+		is.Equal(u.Move.Player, game.X) // played by X
+		is.Equal(u.Game.Turn, game.O)   // O to play
+	})
+
+	t.Run("send the current state on reconnect", func(t *testing.T) {
+		conn, _, err := dial(jane)
+		is.NoErr(err) // reconnect as O
+		defer conn.Close()
+
+		u := read(conn)
+		is.Equal(u.Type, "state") // snapshot on connect
+		is.Equal(u.Seq, 1)        // includes the move played while away
+	})
+}
+
+type event struct {
+	ID, Event string
+	Data      update
+}
+
+func readEvent(t *testing.T, sc *bufio.Scanner) event {
+	var e event
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "" && e.Event != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Fatal("event stream closed")
+	return e
+}
+
+func TestEventStream(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+
+	var (
+		john = accessToken(t, tk, uuid.New())
+		jane = accessToken(t, tk, uuid.New())
+	)
+
+	var g gameView
+	{
+		res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+		res = do(t, http.MethodPost, ts.URL+"/join", jane, map[string]string{"inviteCode": g.InviteCode})
+		is.Equal(res.StatusCode, http.StatusOK) // join game
+	}
+
+	move := func(tk string, row, col int) {
+		res := do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", tk, map[string]int{"row": row, "col": col})
+		is.Equal(res.StatusCode, http.StatusOK) // play move
+	}
+
+	stream := func(lastEventID string) (*bufio.Scanner, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/"+g.ID.String()+"/events", nil)
+		req.Header.Set("Authorization", "Bearer "+jane)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err)                                                 // open stream
+		is.Equal(res.Header.Get("Content-Type"), "text/event-stream") // event stream
+		return bufio.NewScanner(res.Body), func() { cancel(); res.Body.Close() }
+	}
+
+	move(john, 0, 0)
+	move(jane, 1, 1)
+
+	t.Run("send the current state on connect", func(t *testing.T) {
+		sc, close := stream("")
+		defer close()
+
+		e := readEvent(t, sc)
+		is.Equal(e.Event, "state") // snapshot
+		is.Equal(e.ID, "2")        // two moves played
+	})
+
+	t.Run("resume from the last event id", func(t *testing.T) {
+		sc, close := stream("1")
+		defer close()
+
+		e := readEvent(t, sc)
+		is.Equal(e.Event, "move")            // missed move
+		is.Equal(e.ID, "2")                  // second move
+		is.Equal(e.Data.Move.Player, game.O) // played by O
+
+		move(john, 0, 1)
+
+		e = readEvent(t, sc)
+		is.Equal(e.Event, "move")          // live move
+		is.Equal(e.ID, "3")                // third move
+		is.Equal(e.Data.Game.Turn, game.O) // O to play
+	})
+}
+
+func TestBotOpponent(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+	john := accessToken(t, tk, uuid.New())
+
+	var g gameView
+	{
+		res := do(t, http.MethodPost, ts.URL+"/", john, map[string]string{"opponent": "bot", "level": "perfect"})
+		is.Equal(res.StatusCode, http.StatusCreated) // create game against the computer
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+		is.True(g.O != nil)        // bot is seated
+		is.Equal(g.InviteCode, "") // nobody else can join
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/"+g.ID.String()+"/ws", cookie(john))
+	is.NoErr(err) // watch the game
+	defer conn.Close()
+
+	read := func() update {
+		var u update
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		is.NoErr(conn.ReadJSON(&u)) // read update
+		return u
+	}
+	read() // snapshot
+
+	res := do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", john, map[string]int{"row": 0, "col": 0})
+	is.Equal(res.StatusCode, http.StatusOK) // X plays a corner
+
+	is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+	is.Equal(g.Moves, 2)     // the bot replied at once
+	is.Equal(g.Turn, game.X) // X to play again
+
+	is.Equal(read().Move.Player, game.X) // human move is published
+	is.Equal(read().Move.Player, game.O) // bot move is published on the same subject
+}
+
+func TestVariants(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+	john := accessToken(t, tk, uuid.New())
+
+	t.Run("classic by default", func(t *testing.T) {
+		res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+
+		var g gameView
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+		is.Equal(g.Config, game.DefaultConfig) // classic board
+	})
+
+	t.Run("reject an unplayable board", func(t *testing.T) {
+		res := do(t, http.MethodPost, ts.URL+"/", john, map[string]any{"variant": "mnk", "rows": 50, "cols": 50, "k": 5})
+		is.Equal(res.StatusCode, http.StatusBadRequest) // board too large
+	})
+
+	t.Run("ultimate sends the opponent to a board", func(t *testing.T) {
+		var g gameView
+		{
+			res := do(t, http.MethodPost, ts.URL+"/", john, map[string]any{"variant": "ultimate", "opponent": "bot", "level": "easy"})
+			is.Equal(res.StatusCode, http.StatusCreated) // create game
+			is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+			is.Equal(g.Config.Rows, 9) // nine boards of nine cells
+			is.Equal(g.Next, -1)       // first move is free
+		}
+
+		res := do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", john, map[string]int{"row": 4, "col": 4})
+		is.Equal(res.StatusCode, http.StatusOK) // X plays the very centre
+
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+		is.Equal(g.Moves, 2) // the bot replied in the centre board
+
+		// the top-left cell of the board after the one X was sent to
+		other := (g.Next + 1) % 9
+		res = do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", john, map[string]int{"row": other / 3 * 3, "col": other % 3 * 3})
+		is.Equal(res.StatusCode, http.StatusConflict) // wrong board
+	})
+}
+
+func TestMatchFound(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, ec := newTestServer(t)
+
+	john, jane := uuid.New(), uuid.New()
+	d := events.DataMatch{
+		ID:      uuid.New(),
+		Config:  game.DefaultConfig,
+		X:       john,
+		O:       jane,
+		Tickets: [2]uuid.UUID{uuid.New(), uuid.New()},
+	}
+
+	ready := make(chan *events.DataMatch, 1)
+	_, err := ec.BindRecvChan(events.TicketSubject(d.Tickets[1]), ready)
+	is.NoErr(err) // wait as the second player
+
+	is.NoErr(ec.Publish(events.EventMatchFound, d)) // pair the players
+
+	select {
+	case r := <-ready:
+		is.Equal(r.ID, d.ID) // told which game to play
+	case <-time.After(5 * time.Second):
+		t.Fatal("game was not created")
+	}
+
+	res := do(t, http.MethodGet, ts.URL+"/"+d.ID.String(), accessToken(t, tk, jane), nil)
+	is.Equal(res.StatusCode, http.StatusOK) // game exists
+
+	var g gameView
+	is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+	is.Equal(*g.O, jane)       // both players seated
+	is.Equal(g.InviteCode, "") // nobody else can join
+	is.Equal(g.Turn, game.X)   // X to play
+}
+
+func TestGameResult(t *testing.T) {
+	is := is.New(t)
+
+	mem := newMemRepo()
+	ts, tk, _ := newTestServerWith(t, mem)
+
+	johnID, janeID := uuid.New(), uuid.New()
+	john, jane := accessToken(t, tk, johnID), accessToken(t, tk, janeID)
+
+	var g gameView
+	{
+		res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+		res = do(t, http.MethodPost, ts.URL+"/join", jane, map[string]string{"inviteCode": g.InviteCode})
+		is.Equal(res.StatusCode, http.StatusOK) // join game
+	}
+
+	for i, m := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}, {0, 2}} {
+		tk := john
+		if i%2 == 1 {
+			tk = jane
+		}
+
+		res := do(t, http.MethodPost, ts.URL+"/"+g.ID.String()+"/moves", tk, map[string]int{"row": m[0], "col": m[1]})
+		is.Equal(res.StatusCode, http.StatusOK) // play move
+	}
+
+	ms := mem.enqueued(events.EventGameFinished)
+	is.Equal(len(ms), 1) // enqueued with the final move only
+
+	var d events.DataGameResult
+	is.NoErr(json.Unmarshal(ms[0].Payload, &d)) // payload
+	is.Equal(d.ID, g.ID)                        // result of this game
+	is.Equal(d.Variant, game.Classic)           // rated as classic
+	is.Equal(d.X, johnID)                       // john played X
+	is.Equal(d.Winner, game.X)                  // and won
+}
+
+func TestCookieSession(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+	john := accessToken(t, tk, uuid.New())
+
+	request := func(method, url, csrf string) *http.Response {
+		req, _ := http.NewRequest(method, url, nil)
+		req.AddCookie(&http.Cookie{Name: service.AccessTokenCookie, Value: john})
+		req.AddCookie(&http.Cookie{Name: service.CSRFCookie, Value: "secret"})
+		if csrf != "" {
+			req.Header.Set(service.CSRFHeader, csrf)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err) // send request
+		return res
+	}
+
+	t.Run("changes need the CSRF header", func(t *testing.T) {
+		res := request(http.MethodPost, ts.URL+"/", "")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no CSRF header
+
+		res = request(http.MethodPost, ts.URL+"/", "forged")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // wrong CSRF header
+
+		res = request(http.MethodPost, ts.URL+"/", "secret")
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+	})
+
+	t.Run("reads do not", func(t *testing.T) {
+		res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+		is.Equal(res.StatusCode, http.StatusCreated) // create game
+
+		var g gameView
+		is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+		res = request(http.MethodGet, ts.URL+"/"+g.ID.String(), "")
+		is.Equal(res.StatusCode, http.StatusOK) // get state
+	})
+}
+
+func TestPlayScope(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+
+	p, err := tk.SignToken(context.Background(), token.WithEnd(time.Minute), token.WithSubject(uuid.NewString()), token.WithPurpose(token.PurposeAccess))
+	is.NoErr(err) // sign a token without scopes
+
+	res := do(t, http.MethodPost, ts.URL+"/", string(p), nil)
+	is.Equal(res.StatusCode, http.StatusForbidden) // cannot play
+
+	res = do(t, http.MethodPost, ts.URL+"/", accessToken(t, tk, uuid.New()), nil)
+	is.Equal(res.StatusCode, http.StatusCreated) // create game
+
+	var g gameView
+	is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+	for _, path := range []string{"/" + g.ID.String(), "/" + g.ID.String() + "/events", "/" + g.ID.String() + "/ws", "/events"} {
+		res = do(t, http.MethodGet, ts.URL+path, string(p), nil)
+		is.Equal(res.StatusCode, http.StatusForbidden) // cannot watch
+	}
+}
+
+func TestWatchGame(t *testing.T) {
+	is := is.New(t)
+
+	ts, tk, _ := newTestServer(t)
+	john, bob := accessToken(t, tk, uuid.New()), accessToken(t, tk, uuid.New())
+
+	res := do(t, http.MethodPost, ts.URL+"/", john, nil)
+	is.Equal(res.StatusCode, http.StatusCreated) // create game
+
+	var g gameView
+	is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+
+	res = do(t, http.MethodGet, ts.URL+"/"+g.ID.String(), john, nil)
+	is.Equal(res.StatusCode, http.StatusOK) // get state
+	is.NoErr(json.NewDecoder(res.Body).Decode(&g))
+	is.True(g.InviteCode != "") // shown to the owner
+
+	res = do(t, http.MethodGet, ts.URL+"/"+g.ID.String(), bob, nil)
+	is.Equal(res.StatusCode, http.StatusOK) // anyone may watch
+
+	var v gameView
+	is.NoErr(json.NewDecoder(res.Body).Decode(&v))
+	is.Equal(v.ID, g.ID)       // same game
+	is.Equal(v.InviteCode, "") // hidden from others
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+)
+
+// keepAlivePeriod stops proxies from closing an idle event stream
+const keepAlivePeriod = 15 * time.Second
+
+// writeEvent writes a single Server-Sent Event. An empty id leaves
+// the client's last event id unchanged.
+func writeEvent(w io.Writer, id, event string, v any) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, p)
+	return err
+}
+
+// lastEventID reads the id a reconnecting EventSource sends with its request.
+// The query parameter is for clients that cannot set request headers.
+func lastEventID(r *http.Request) (int, bool) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGameEvents streams the same updates as the WebSocket for clients that
+// cannot hold one open. Each event id is the number of moves played, so a
+// client that reconnects with `Last-Event-ID` is sent every move it missed.
+func (s *Service) handleGameEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.m.Respond(w, r, errs.New(errs.Internal, "streaming unsupported"), http.StatusInternalServerError)
+			return
+		}
+
+		id, _ := uuidFromRequest(r)
+
+		updates, unsubscribe, rec, err := s.subscribe(r, id)
+		if err != nil {
+			s.m.Respond(w, r, err, statusOf(err))
+			return
+		}
+		defer unsubscribe()
+
+		startEventStream(w)
+
+		seq := rec.Game.MoveCount()
+		if last, ok := lastEventID(r); ok && last <= seq {
+			// rebuild the board after each missed move from the move log
+			past := *rec
+			g, err := rec.Game.Config().New()
+			if err != nil {
+				s.m.Logf("replay game %s: %v", rec.ID, err)
+				return
+			}
+
+			for i, m := range rec.Game.Moves() {
+				m := m
+				if err := g.Play(m); err != nil {
+					s.m.Logf("replay game %s: %v", rec.ID, err)
+					return
+				}
+				if i+1 <= last {
+					continue
+				}
+
+				past.Game = g
+				u := newSnapshot(&past, caller.ID)
+				u.Type, u.Move = "move", &m
+				if err := writeEvent(w, strconv.Itoa(u.Seq), u.Type, u); err != nil {
+					return
+				}
+			}
+		} else {
+			u := newSnapshot(rec, caller.ID)
+			if err := writeEvent(w, strconv.Itoa(u.Seq), u.Type, u); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(keepAlivePeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case d := <-updates:
+				if d.Seq < seq || (d.Seq == seq && d.Move != nil) {
+					// already sent
+					continue
+				}
+				seq = d.Seq
+
+				u := newUpdate(d)
+				if err := writeEvent(w, strconv.Itoa(u.Seq), u.Type, u); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleLobbyEvents streams games as they are created, started and finished.
+// Lobby events are not stored so a reconnecting client only sees new ones.
+func (s *Service) handleLobbyEvents() http.HandlerFunc {
+	type P struct {
+		ID     string      `json:"id"`
+		Status game.Status `json:"status"`
+		Winner game.Player `json:"winner"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := service.PrincipalFromRequest(r); err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.m.Respond(w, r, errs.New(errs.Internal, "streaming unsupported"), http.StatusInternalServerError)
+			return
+		}
+
+		ch := make(chan *events.DataLobby, 64)
+		sub, err := events.TopicGameLobby.Bind(s.e, ch)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		defer sub.Unsubscribe()
+
+		startEventStream(w)
+		flusher.Flush()
+
+		ticker := time.NewTicker(keepAlivePeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case d := <-ch:
+				p := P{ID: d.ID.String(), Status: d.Status, Winner: d.Winner}
+				if err := writeEvent(w, "", d.Kind, p); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package game
+
+import "fmt"
+
+// Variant names a set of rules.
+type Variant string
+
+const (
+	// Classic is noughts and crosses on a 3x3 board
+	Classic Variant = "classic"
+	// MNK is k-in-a-row on a board of any size, such as 15x15 gomoku
+	MNK Variant = "mnk"
+	// Ultimate is nine classic boards arranged as a 3x3 board. Winning a
+	// small board claims its cell on the large one, and each move sends the
+	// next player to the small board matching the cell that was played.
+	Ultimate Variant = "ultimate"
+)
+
+const (
+	// MinSize and MaxSize bound each side of an m,n,k board
+	MinSize = 3
+	MaxSize = 19
+)
+
+// Config describes the board a game is played on.
+type Config struct {
+	Variant Variant `json:"variant"`
+	Rows    int     `json:"rows"`
+	Cols    int     `json:"cols"`
+	// K is the length of line needed to win
+	K int `json:"k"`
+}
+
+// DefaultConfig is a classic game.
+var DefaultConfig = Config{Variant: Classic, Rows: 3, Cols: 3, K: 3}
+
+// Normalize fills in the board size for fixed variants and checks
+// that the size of an m,n,k board is playable.
+func (c Config) Normalize() (Config, error) {
+	switch c.Variant {
+	case "", Classic:
+		return DefaultConfig, nil
+	case Ultimate:
+		return Config{Variant: Ultimate, Rows: 9, Cols: 9, K: 3}, nil
+	case MNK:
+		switch {
+		case c.Rows < MinSize || c.Rows > MaxSize || c.Cols < MinSize || c.Cols > MaxSize:
+			return c, fmt.Errorf("%w: board must be between %d and %d cells a side", ErrInvalidConfig, MinSize, MaxSize)
+		case c.K < MinSize || (c.K > c.Rows && c.K > c.Cols):
+			return c, fmt.Errorf("%w: k must be at least %d and fit on the board", ErrInvalidConfig, MinSize)
+		}
+		return c, nil
+	default:
+		return c, fmt.Errorf("%w: unknown variant %q", ErrInvalidConfig, c.Variant)
+	}
+}
+
+// New returns a game with an empty board.
+func (c Config) New() (*Game, error) {
+	c, err := c.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Game{
+		config: c,
+		board:  NewBoard(c.Rows, c.Cols),
+		turn:   X,
+		next:   -1,
+	}
+
+	if c.Variant == Ultimate {
+		g.subs = make([]subBoard, 9)
+	}
+	return g, nil
+}
+
+// Replay rebuilds a game by applying each move in order.
+func (c Config) Replay(moves []Move) (*Game, error) {
+	g, err := c.New()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range moves {
+		if err := g.Play(m); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
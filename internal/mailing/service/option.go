@@ -1,3 +1,11 @@
 package service
 
+import "time"
+
 type Option func(*Service)
+
+// WithBackoff sets how long to wait before each retry of an email
+// that could not be sent
+func WithBackoff(d ...time.Duration) Option {
+	return func(s *Service) { s.backoff = d }
+}
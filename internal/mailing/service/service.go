@@ -3,14 +3,13 @@
 package service
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
-	"github.com/nats-io/nats.go"
-
 	"github.com/hyphengolang/noughts-and-crosses/internal/conf"
 	"github.com/hyphengolang/noughts-and-crosses/internal/events"
 	"github.com/hyphengolang/noughts-and-crosses/internal/service"
@@ -29,33 +28,49 @@ type Service struct {
 	m    service.Router
 	smtp smtp.Mailer
 	e    events.Broker
+
+	backoff []time.Duration
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
-func New(smtp smtp.Mailer, e events.Broker) *Service {
+func New(smtp smtp.Mailer, e events.Broker, opts ...Option) (*Service, error) {
 	s := &Service{
-		m:    service.NewRouter(),
-		smtp: smtp,
-		e:    e,
+		m:       service.NewRouter(),
+		smtp:    smtp,
+		e:       e,
+		backoff: events.DefaultBackoff,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if err := s.listen(); err != nil {
+		return nil, err
 	}
-	go s.listen()
 	s.routes()
-	return s
+	return s, nil
 }
 
 func (s *Service) routes() {
 	// s.mux.Post("/send", s.handleSend())
 }
 
-func (s *Service) listen() {
-	s.e.Conn().QueueSubscribe(events.EventSendLoginConfirm, "workers", s.handleLoginConfirm())
-	s.e.Conn().QueueSubscribe(events.EventSendSignupConfirm, "workers", s.handleSignupConfirm())
+// listen sends the emails kept by the mail stream, which holds them while
+// no mailer is running. Emails that cannot be sent are retried, then left
+// on their dead letter subject.
+func (s *Service) listen() error {
+	if err := events.StreamMail.Add(s.e); err != nil {
+		return err
+	}
+	if err := events.TopicSendLoginConfirm.Durable(s.e, events.StreamMail, "mail-login", s.backoff, s.handleLoginConfirm()); err != nil {
+		return err
+	}
+	return events.TopicSendSignupConfirm.Durable(s.e, events.StreamMail, "mail-signup", s.backoff, s.handleSignupConfirm())
 }
 
-func (s *Service) handleSignupConfirm() nats.Handler {
+func (s *Service) handleSignupConfirm() func(ctx context.Context, msg *events.DataEmail) error {
 
 	type Args struct {
 		Href string
@@ -79,38 +94,29 @@ func (s *Service) handleSignupConfirm() nats.Handler {
 		return s.smtp.Send(mail)
 	}
 
-	parseToken := func(msg *events.DataEmail) (email string, token []byte, err error) {
-		type Data struct{ events.Data[[]byte] }
-		var response Data
-
-		err = s.e.Conn().Request(events.EventGenerateSignupToken, msg, &response, 5*time.Second)
+	parseToken := func(ctx context.Context, msg *events.DataEmail) (email string, token []byte, err error) {
+		token, err = events.EndpointGenerateSignupToken.Request(ctx, s.e, *msg)
 		if err != nil {
 			return
 		}
 
-		if err = response.Err; err != nil {
-			return
-		}
-
-		return msg.Email, response.Value, response.Err
+		return msg.Email, token, nil
 	}
 
-	return func(msg *events.DataEmail) {
-		_, token, err := parseToken(msg)
+	return func(ctx context.Context, msg *events.DataEmail) error {
+		_, token, err := parseToken(ctx, msg)
 		if err != nil {
-			log.Printf("request result: %v", err)
-			return
+			return fmt.Errorf("request result: %w", err)
 		}
 
 		if err := send(msg.Email, token); err != nil {
-
-			log.Printf("sending email: %v", err)
-			return
+			return fmt.Errorf("sending email: %w", err)
 		}
+		return nil
 	}
 }
 
-func (s *Service) handleLoginConfirm() nats.Handler {
+func (s *Service) handleLoginConfirm() func(ctx context.Context, msg *events.DataLoginConfirm) error {
 
 	type Args struct {
 		Href string
@@ -134,11 +140,10 @@ func (s *Service) handleLoginConfirm() nats.Handler {
 		return s.smtp.Send(mail)
 	}
 
-	return func(msg *events.DataLoginConfirm) {
+	return func(ctx context.Context, msg *events.DataLoginConfirm) error {
 		if err := send(msg.Email, msg.Token); err != nil {
-			log.Printf("sending login email: %v", err)
-
-			return
+			return fmt.Errorf("sending login email: %w", err)
 		}
+		return nil
 	}
 }
@@ -0,0 +1,173 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	srv "github.com/hyphengolang/noughts-and-crosses/internal/mailing/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// mailer fails the next `fail` emails, and sends the rest to `sent`
+type mailer struct {
+	mu       sync.Mutex
+	fail     int
+	attempts int
+	sent     chan *smtp.Mail
+}
+
+func (m *mailer) Send(mail *smtp.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	if m.fail > 0 {
+		m.fail--
+		return errors.New("smtp is down")
+	}
+	m.sent <- mail
+	return nil
+}
+
+// failNext fails the next `n` emails and resets the attempts
+func (m *mailer) failNext(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fail, m.attempts = n, 0
+}
+
+func (m *mailer) tries() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.attempts
+}
+
+func newJetStreamBroker(t *testing.T) events.Broker {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	ns := natsserver.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.NewClient(ec)
+}
+
+func TestMailing(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	b := newJetStreamBroker(t)
+	m := &mailer{sent: make(chan *smtp.Mail, 1)}
+
+	backoff := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+	_, err := srv.New(m, b, srv.WithBackoff(backoff...))
+	is.NoErr(err) // start mailing
+
+	js, err := b.Conn().Conn.JetStream()
+	is.NoErr(err) // jetstream
+
+	// waiting is how many emails the stream still keeps
+	waiting := func() uint64 {
+		info, err := js.StreamInfo(events.StreamMail.Name)
+		is.NoErr(err) // stream info
+		return info.State.Msgs
+	}
+
+	sent := func() *smtp.Mail {
+		select {
+		case mail := <-m.sent:
+			return mail
+		case <-time.After(2 * time.Second):
+			t.Fatal("email was not sent")
+			return nil
+		}
+	}
+
+	t.Run("sent emails are acked", func(t *testing.T) {
+		is.NoErr(events.TopicSendLoginConfirm.Store(ctx, b, events.DataLoginConfirm{Email: "john@doe.com", Token: []byte("token")}))
+
+		mail := sent()
+		is.Equal(mail.To, []string{"john@doe.com"})         // sent to the user
+		is.True(bytes.Contains(mail.Body, []byte("token"))) // with the login link
+
+		for deadline := time.Now().Add(time.Second); waiting() > 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("email was not acked")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		is.Equal(m.tries(), 1) // sent once
+	})
+
+	t.Run("a failed email is retried", func(t *testing.T) {
+		m.failNext(1)
+
+		is.NoErr(events.TopicSendLoginConfirm.Store(ctx, b, events.DataLoginConfirm{Email: "jane@doe.com", Token: []byte("token")}))
+
+		mail := sent()
+		is.Equal(mail.To, []string{"jane@doe.com"}) // sent on the retry
+		is.Equal(m.tries(), 2)                      // after one failure
+	})
+
+	t.Run("signup asks auth for a token", func(t *testing.T) {
+		m.failNext(0)
+
+		err := events.EndpointGenerateSignupToken.Handle(b, func(ctx context.Context, q events.DataEmail) ([]byte, error) {
+			return []byte("signup-token"), nil
+		})
+		is.NoErr(err) // stands in for auth
+
+		is.NoErr(events.TopicSendSignupConfirm.Store(ctx, b, events.DataEmail{Email: "john@doe.com"}))
+
+		mail := sent()
+		is.Equal(mail.To, []string{"john@doe.com"})                // sent to the user
+		is.True(bytes.Contains(mail.Body, []byte("signup-token"))) // with the signup link
+	})
+
+	t.Run("an email that keeps failing is dead lettered", func(t *testing.T) {
+		m.failNext(len(backoff) + 1)
+
+		dead := make(chan *nats.Msg, 1)
+		sub, err := b.Conn().Conn.ChanSubscribe(events.DeadLetterSubject(events.EventSendLoginConfirm), dead)
+		is.NoErr(err) // watch dead letters
+		t.Cleanup(func() { sub.Unsubscribe() })
+
+		is.NoErr(events.TopicSendLoginConfirm.Store(ctx, b, events.DataLoginConfirm{Email: "bob@doe.com", Token: []byte("token")}))
+
+		select {
+		case msg := <-dead:
+			is.True(msg.Header.Get(events.HeaderError) != "") // why it failed
+
+			var v events.DataLoginConfirm
+			is.NoErr(b.Conn().Enc.Decode(msg.Subject, msg.Data, &v)) // original email
+			is.Equal(v.Email, "bob@doe.com")
+		case <-time.After(2 * time.Second):
+			t.Fatal("no dead letter")
+		}
+
+		is.Equal(m.tries(), len(backoff)+1) // one attempt and a retry for each backoff
+		is.Equal(len(m.sent), 0)            // never sent
+	})
+}
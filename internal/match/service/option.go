@@ -0,0 +1,16 @@
+package service
+
+import "time"
+
+type Option func(*Service)
+
+// WithHoldPeriod sets how long a worker keeps an unmatched ticket before
+// passing it back to the queue group.
+func WithHoldPeriod(d time.Duration) Option {
+	return func(s *Service) { s.hold = d }
+}
+
+// WithWaitTimeout sets how long a request to find a game waits for an opponent.
+func WithWaitTimeout(d time.Duration) Option {
+	return func(s *Service) { s.wait = d }
+}
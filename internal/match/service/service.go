@@ -0,0 +1,304 @@
+// Package service pairs players who are looking for a game.
+//
+// Tickets are shared between instances with a NATS queue group, so each
+// ticket is held by exactly one worker at a time and cannot be paired twice.
+// A worker that has no opponent for a ticket passes it back to the queue
+// after a short hold, letting tickets held by different instances meet.
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+)
+
+type Service struct {
+	m service.Router
+	e events.Broker
+	t token.Client
+
+	hold time.Duration
+	wait time.Duration
+
+	mu sync.Mutex
+	// waiting holds the tickets this worker is trying to pair, oldest first
+	waiting []*events.DataTicket
+	// cancelled remembers cancelled tickets until they expire, since
+	// a ticket may be on its way between workers when it is cancelled
+	cancelled map[uuid.UUID]time.Time
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.ServeHTTP(w, r)
+}
+
+func New(e events.Broker, t token.Client, opts ...Option) (*Service, error) {
+	s := &Service{
+		m:         service.NewRouter(),
+		e:         e,
+		t:         t,
+		hold:      2 * time.Second,
+		wait:      25 * time.Second,
+		cancelled: make(map[uuid.UUID]time.Time),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+	s.routes()
+	return s, nil
+}
+
+func (s *Service) routes() {
+	s.m.With(service.Authenticate(s.t), s.m.RequireScope(reg.ScopePlay)).Post("/", s.handleFindGame())
+}
+
+func (s *Service) listen() error {
+	if err := events.TopicMatchTicket.QueueSubscribe(s.e, "workers", s.handleTicket()); err != nil {
+		return err
+	}
+	// every worker hears a cancellation as any of them may hold the ticket
+	return events.TopicMatchCancel.Subscribe(s.e, s.handleCancel())
+}
+
+// handleFindGame queues the caller and waits for an opponent. If none is found
+// in time the ticket is cancelled and the response has no content, so the
+// client should ask again.
+func (s *Service) handleFindGame() http.HandlerFunc {
+	type Q struct {
+		Variant game.Variant `json:"variant"`
+		Rows    int          `json:"rows"`
+		Cols    int          `json:"cols"`
+		K       int          `json:"k"`
+		// Band is the widest rating difference the caller
+		// will accept from an opponent, 0 for any
+		Band int `json:"band"`
+	}
+
+	type P struct {
+		GameID uuid.UUID `json:"gameId"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		uid := caller.ID
+
+		// the body is optional
+		var q Q
+		if err := s.m.Decode(w, r, &q); err != nil && !errors.Is(err, io.EOF) {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		c, err := game.Config{Variant: q.Variant, Rows: q.Rows, Cols: q.Cols, K: q.K}.Normalize()
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if q.Band < 0 {
+			s.m.Respond(w, r, errs.New(errs.InvalidArgument, "band must not be negative"), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		t := events.DataTicket{
+			ID:      uuid.New(),
+			Player:  uid,
+			Config:  c,
+			Rating:  s.rating(r.Context(), uid, c.Variant),
+			Band:    q.Band,
+			Queued:  now,
+			Expires: now.Add(s.wait),
+		}
+
+		// listen for the game before queueing so the reply cannot be missed
+		ch := make(chan *events.DataMatch, 1)
+		sub, err := events.TicketTopic(t.ID).Bind(s.e, ch)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		defer sub.Unsubscribe()
+
+		if err := events.TopicMatchTicket.Publish(s.e, t); err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		timer := time.NewTimer(s.wait)
+		defer timer.Stop()
+
+		select {
+		case d := <-ch:
+			s.m.SetLocation(w, r, "/games/"+d.ID.String())
+			s.m.Respond(w, r, P{GameID: d.ID}, http.StatusOK)
+		case <-timer.C:
+			s.cancel(t)
+			s.m.Respond(w, r, nil, http.StatusNoContent)
+		case <-r.Context().Done():
+			s.cancel(t)
+		}
+	}
+}
+
+// rating asks the registry for the player's rating. Matchmaking carries on
+// with the default rating if the registry cannot be reached.
+func (s *Service) rating(ctx context.Context, uid uuid.UUID, v game.Variant) int {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	rating, err := events.EndpointGetRating.Request(ctx, s.e, events.DataRatingQuery{ID: uid, Variant: v})
+	if err != nil {
+		s.m.Logf("get rating for %s: %v", uid, err)
+		return reg.DefaultRating
+	}
+	return rating
+}
+
+func (s *Service) cancel(t events.DataTicket) {
+	if err := events.TopicMatchCancel.Publish(s.e, t); err != nil {
+		s.m.Logf("cancel ticket %s: %v", t.ID, err)
+	}
+}
+
+// handleTicket pairs the ticket with the longest waiting compatible ticket
+// held by this worker, or holds on to it until one arrives.
+func (s *Service) handleTicket() func(t *events.DataTicket) {
+	return func(t *events.DataTicket) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if !s.live(t) {
+			return
+		}
+
+		for i, o := range s.waiting {
+			if o.Player == t.Player {
+				// a newer ticket from the same player replaces the old one
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				break
+			}
+		}
+
+		for i, o := range s.waiting {
+			if !compatible(o, t) {
+				continue
+			}
+
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			s.pair(o, t)
+			return
+		}
+
+		s.waiting = append(s.waiting, t)
+		time.AfterFunc(s.hold, func() { s.release(t) })
+	}
+}
+
+// pair publishes the match for the game service to create. The player
+// who has waited longest plays X.
+func (s *Service) pair(a, b *events.DataTicket) {
+	if b.Queued.Before(a.Queued) {
+		a, b = b, a
+	}
+
+	d := events.DataMatch{
+		ID:      uuid.New(),
+		Config:  a.Config,
+		X:       a.Player,
+		O:       b.Player,
+		Tickets: [2]uuid.UUID{a.ID, b.ID},
+	}
+
+	if err := events.TopicMatchFound.Publish(s.e, d); err != nil {
+		s.m.Logf("publish match: %v", err)
+	}
+}
+
+// release passes a ticket that is still unmatched back to the queue group
+func (s *Service) release(t *events.DataTicket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, o := range s.waiting {
+		if o != t {
+			continue
+		}
+
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+		if !s.live(t) {
+			return
+		}
+
+		if err := events.TopicMatchTicket.Publish(s.e, *t); err != nil {
+			s.m.Logf("release ticket %s: %v", t.ID, err)
+		}
+		return
+	}
+}
+
+func (s *Service) handleCancel() func(t *events.DataTicket) {
+	return func(t *events.DataTicket) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		now := time.Now()
+		for id, exp := range s.cancelled {
+			if now.After(exp) {
+				delete(s.cancelled, id)
+			}
+		}
+		s.cancelled[t.ID] = t.Expires
+
+		for i, o := range s.waiting {
+			if o.ID == t.ID {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// live reports whether the ticket can still be paired. The caller must hold s.mu.
+func (s *Service) live(t *events.DataTicket) bool {
+	if _, ok := s.cancelled[t.ID]; ok {
+		return false
+	}
+	return time.Now().Before(t.Expires)
+}
+
+// compatible reports whether two tickets can be paired: they belong to
+// different players, want the same board, and each rating is within
+// the other player's band.
+func compatible(a, b *events.DataTicket) bool {
+	return a.Player != b.Player &&
+		a.Config == b.Config &&
+		within(a, b.Rating) &&
+		within(b, a.Rating)
+}
+
+func within(t *events.DataTicket, rating int) bool {
+	d := t.Rating - rating
+	if d < 0 {
+		d = -d
+	}
+	return t.Band == 0 || d <= t.Band
+}
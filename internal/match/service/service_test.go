@@ -0,0 +1,244 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	srv "github.com/hyphengolang/noughts-and-crosses/internal/match/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func newBroker(t *testing.T) (*server.Server, *nats.EncodedConn) {
+	ns := natsserver.RunRandClientPortServer()
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns, ec
+}
+
+// waitForSubscriptions gives services time to subscribe in the background
+func waitForSubscriptions(t *testing.T, ns *server.Server, n uint32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for ns.NumSubscriptions() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscriptions, got %d", n, ns.NumSubscriptions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func accessToken(t *testing.T, tk token.Client, uid uuid.UUID) string {
+	p, err := tk.SignToken(context.Background(), token.WithEnd(time.Minute), token.WithSubject(uid.String()), token.WithClaims(token.PrivateClaims{"scope": reg.ScopePlay}), token.WithPurpose(token.PurposeAccess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func findGame(t *testing.T, url, tk string, body any) *http.Response {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+
+	req, _ := http.NewRequest(http.MethodPost, url, &buf)
+	req.Header.Set("Authorization", "Bearer "+tk)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// expectMatch waits for a single match to be found
+func expectMatch(t *testing.T, ch chan *events.DataMatch, timeout time.Duration) *events.DataMatch {
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestMatchmaking(t *testing.T) {
+	is := is.New(t)
+
+	ns, ec := newBroker(t)
+	tk := token.NewTokenClient()
+
+	// the server has subscriptions of its own
+	n := ns.NumSubscriptions()
+
+	// two instances share the queue
+	sa, err := srv.New(events.NewClient(ec), tk, srv.WithHoldPeriod(20*time.Millisecond))
+	is.NoErr(err) // subscribe
+	a := httptest.NewServer(sa)
+	t.Cleanup(a.Close)
+	sb, err := srv.New(events.NewClient(ec), tk, srv.WithHoldPeriod(20*time.Millisecond))
+	is.NoErr(err) // subscribe
+	b := httptest.NewServer(sb)
+	t.Cleanup(b.Close)
+
+	found := make(chan *events.DataMatch, 8)
+	_, err = ec.Subscribe(events.EventMatchFound, func(d *events.DataMatch) { found <- d })
+	is.NoErr(err) // watch for matches
+
+	// four subscriptions for the instances, one for the test
+	waitForSubscriptions(t, ns, n+5)
+
+	t.Run("players on different instances are paired once", func(t *testing.T) {
+		// stands in for the game service
+		sub, err := ec.QueueSubscribe(events.EventMatchFound, "workers", func(d *events.DataMatch) {
+			for _, id := range d.Tickets {
+				ec.Publish(events.TicketSubject(id), d)
+			}
+		})
+		is.NoErr(err) // create games
+		defer sub.Unsubscribe()
+
+		john, jane := uuid.New(), uuid.New()
+
+		var wg sync.WaitGroup
+		ids := make([]uuid.UUID, 2)
+		for i, p := range []struct {
+			url string
+			uid uuid.UUID
+		}{{a.URL, john}, {b.URL, jane}} {
+			wg.Add(1)
+			go func(i int, url string, uid uuid.UUID) {
+				defer wg.Done()
+
+				res := findGame(t, url+"/", accessToken(t, tk, uid), map[string]string{"variant": "classic"})
+				is.Equal(res.StatusCode, http.StatusOK) // opponent found
+
+				var p struct {
+					GameID uuid.UUID `json:"gameId"`
+				}
+				is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+				ids[i] = p.GameID
+			}(i, p.url, p.uid)
+		}
+		wg.Wait()
+
+		is.Equal(ids[0], ids[1]) // same game
+
+		d := expectMatch(t, found, time.Second)
+		is.True(d != nil)                                                     // match published
+		is.True((d.X == john && d.O == jane) || (d.X == jane && d.O == john)) // both players seated
+		is.True(expectMatch(t, found, 200*time.Millisecond) == nil)           // paired only once
+	})
+
+	// each subtest plays on its own board so that tickets
+	// left over from another cannot be paired with its own
+	ticket := func(c game.Config, rating, band int) events.DataTicket {
+		now := time.Now()
+		return events.DataTicket{
+			ID:      uuid.New(),
+			Player:  uuid.New(),
+			Config:  c,
+			Rating:  rating,
+			Band:    band,
+			Queued:  now,
+			Expires: now.Add(time.Minute),
+		}
+	}
+
+	t.Run("ratings must be within each band", func(t *testing.T) {
+		x := ticket(game.DefaultConfig, 1500, 100)
+		is.NoErr(ec.Publish(events.EventMatchTicket, x))
+
+		far := ticket(game.DefaultConfig, 1900, 0)
+		is.NoErr(ec.Publish(events.EventMatchTicket, far))
+		is.True(expectMatch(t, found, 200*time.Millisecond) == nil) // outside the first band
+
+		near := ticket(game.DefaultConfig, 1550, 50)
+		is.NoErr(ec.Publish(events.EventMatchTicket, near))
+
+		d := expectMatch(t, found, time.Second)
+		is.True(d != nil)                                // match published
+		is.Equal(d.Tickets, [2]uuid.UUID{x.ID, near.ID}) // earliest ticket plays X
+
+		// clear the unmatched ticket
+		is.NoErr(ec.Publish(events.EventMatchCancel, far))
+	})
+
+	t.Run("boards must match", func(t *testing.T) {
+		x := ticket(game.Config{Variant: game.MNK, Rows: 9, Cols: 9, K: 3}, 1500, 0)
+		is.NoErr(ec.Publish(events.EventMatchTicket, x))
+
+		o := ticket(game.Config{Variant: game.Ultimate, Rows: 9, Cols: 9, K: 3}, 1500, 0)
+		is.NoErr(ec.Publish(events.EventMatchTicket, o))
+		is.True(expectMatch(t, found, 200*time.Millisecond) == nil) // different variants
+
+		is.NoErr(ec.Publish(events.EventMatchCancel, x))
+		is.NoErr(ec.Publish(events.EventMatchCancel, o))
+	})
+
+	t.Run("cancelled tickets are not paired", func(t *testing.T) {
+		c := game.Config{Variant: game.MNK, Rows: 5, Cols: 5, K: 4}
+
+		x := ticket(c, 1500, 0)
+		is.NoErr(ec.Publish(events.EventMatchTicket, x))
+		is.NoErr(ec.Publish(events.EventMatchCancel, x))
+
+		// the cancellation is not ordered with tickets on the queue
+		time.Sleep(50 * time.Millisecond)
+
+		o := ticket(c, 1500, 0)
+		is.NoErr(ec.Publish(events.EventMatchTicket, o))
+		is.True(expectMatch(t, found, 200*time.Millisecond) == nil) // nobody to play
+
+		is.NoErr(ec.Publish(events.EventMatchCancel, o))
+	})
+
+	t.Run("no opponent in time", func(t *testing.T) {
+		sc, err := srv.New(events.NewClient(ec), tk, srv.WithWaitTimeout(100*time.Millisecond))
+		is.NoErr(err) // subscribe
+		c := httptest.NewServer(sc)
+		defer c.Close()
+
+		// stands in for the registry
+		registry, err := ec.Subscribe(events.EventGetRating, func(subj, reply string, q *events.DataRatingQuery) {
+			ec.Publish(reply, events.Data[int]{Value: 1800})
+		})
+		is.NoErr(err) // answer rating requests
+		defer registry.Unsubscribe()
+
+		tickets := make(chan *events.DataTicket, 1)
+		watch, err := ec.BindRecvChan(events.EventMatchTicket, tickets)
+		is.NoErr(err) // watch tickets
+		defer watch.Unsubscribe()
+
+		res := findGame(t, c.URL+"/", accessToken(t, tk, uuid.New()), map[string]string{"variant": "ultimate"})
+		is.Equal(res.StatusCode, http.StatusNoContent) // ask again later
+
+		select {
+		case d := <-tickets:
+			is.Equal(d.Rating, 1800) // rating from the registry
+		case <-time.After(time.Second):
+			t.Fatal("ticket was not queued")
+		}
+	})
+}
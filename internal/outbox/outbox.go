@@ -0,0 +1,249 @@
+// Package outbox stores events in Postgres in the same transaction as the
+// writes that cause them, and relays them to NATS once they are committed.
+// An event is published at least once; a relay that fails after publishing
+// a batch publishes it again.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+)
+
+// Schema creates the outbox table. It belongs with the schema of every
+// database whose repositories enqueue events.
+const Schema = `
+	CREATE SCHEMA IF NOT EXISTS outbox;
+
+	CREATE TABLE IF NOT EXISTS outbox.messages (
+		id UUID PRIMARY KEY,
+		subject TEXT NOT NULL,
+		version INT NOT NULL DEFAULT 1,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS messages_created_at ON outbox.messages (created_at, id);
+	`
+
+// Message is an event waiting in the outbox to be published
+type Message struct {
+	ID      uuid.UUID
+	Subject string
+	Version int
+	Payload json.RawMessage
+}
+
+// NewMessage prepares `v` to be published on the topic
+func NewMessage[T any](t events.Topic[T], v T) (Message, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return Message{}, fmt.Errorf("encode %s: %w", t, err)
+	}
+
+	m := Message{ID: uuid.New(), Subject: string(t), Version: 1, Payload: p}
+	if v, ok := any(v).(events.Versioner); ok {
+		m.Version = v.SchemaVersion()
+	}
+	return m, nil
+}
+
+func (m Message) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":      m.ID,
+		"subject": m.Subject,
+		"version": m.Version,
+		"payload": []byte(m.Payload),
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// Execer is a transaction, or a pool for a message that is not part of one
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Enqueue stores the `Message` in `args`. It is published
+// once the transaction of `db` commits.
+func Enqueue(ctx context.Context, db Execer, args pgx.QueryRewriter) error {
+	const q = `
+	INSERT INTO outbox.messages (id, subject, version, payload)
+	VALUES (@id, @subject, @version, @payload)`
+
+	_, err := db.Exec(ctx, q, args)
+	return err
+}
+
+// Relay publishes the messages in the outbox, oldest first. Any number of
+// relays may share an outbox as each skips the rows locked by the others.
+type Relay struct {
+	conn *pgxpool.Pool
+	e    events.Broker
+
+	batch   int
+	every   time.Duration
+	streams []events.Stream
+}
+
+type Option func(*Relay)
+
+// WithBatchSize sets how many messages are published in each transaction
+func WithBatchSize(n int) Option {
+	return func(r *Relay) { r.batch = n }
+}
+
+// WithInterval sets how long the relay waits when the outbox is empty
+func WithInterval(d time.Duration) Option {
+	return func(r *Relay) { r.every = d }
+}
+
+// WithStreams makes the relay wait for JetStream to store the messages of
+// the streams' subjects, rather than only for them to reach NATS
+func WithStreams(ss ...events.Stream) Option {
+	return func(r *Relay) { r.streams = ss }
+}
+
+func NewRelay(conn *pgxpool.Pool, e events.Broker, opts ...Option) *Relay {
+	r := &Relay{
+		conn:  conn,
+		e:     e,
+		batch: 100,
+		every: time.Second,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+// Run relays messages until `ctx` is done
+func (r *Relay) Run(ctx context.Context) error {
+	t := time.NewTicker(r.every)
+	defer t.Stop()
+
+	for {
+		n, err := r.Flush(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("relay outbox: %v", err)
+		}
+
+		// a full batch means there may be more waiting
+		if err == nil && n == r.batch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+type batchArgs struct {
+	Limit int
+}
+
+func (a batchArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"limit": a.Limit,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// Flush publishes one batch of messages and removes them from the
+// outbox, returning how many there were
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	const next = `
+	SELECT id, subject, version, payload
+	FROM outbox.messages
+	ORDER BY created_at, id
+	LIMIT @limit
+	FOR UPDATE SKIP LOCKED`
+
+	const done = `
+	DELETE FROM outbox.messages
+	WHERE id = ANY($1)`
+
+	// a batch is published inside the transaction, so it is not run again
+	// on a serialization failure; the next flush picks up what is left
+	var n int
+	err := pg.WithTx(ctx, r.conn, func(tx pgx.Tx) error {
+		ms, err := pg.QueryTx(ctx, tx, func(row pgx.Rows, m *Message) error {
+			var p []byte
+			err := row.Scan(&m.ID, &m.Subject, &m.Version, &p)
+			m.Payload = p
+			return err
+		}, next, batchArgs{Limit: r.batch})
+		if err != nil || len(ms) == 0 {
+			return err
+		}
+
+		ids := make([]uuid.UUID, len(ms))
+		for i, m := range ms {
+			if err := r.publish(m); err != nil {
+				return fmt.Errorf("publish %s: %w", m.ID, err)
+			}
+			ids[i] = m.ID
+		}
+
+		// the other messages must reach NATS before they are forgotten
+		if err := r.e.Conn().Conn.FlushWithContext(ctx); err != nil {
+			return err
+		}
+
+		if _, err := pg.ExecTx(ctx, tx, done, ids); err != nil {
+			return err
+		}
+		n = len(ms)
+		return nil
+	}, pg.WithRetries(0))
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// publish sends the message to NATS. A message for a stream is only
+// published once JetStream acknowledges storing it; its id lets
+// JetStream drop the copy sent again after a failed batch.
+func (r *Relay) publish(m *Message) error {
+	raw := events.Raw{Payload: m.Payload, Version: m.Version}
+	if !r.stored(m.Subject) {
+		return r.e.Conn().Publish(m.Subject, raw)
+	}
+
+	p, err := r.e.Conn().Enc.Encode(m.Subject, raw)
+	if err != nil {
+		return err
+	}
+
+	js, err := r.e.Conn().Conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	_, err = js.PublishMsg(&nats.Msg{Subject: m.Subject, Data: p}, nats.MsgId(m.ID.String()))
+	return err
+}
+
+func (r *Relay) stored(subject string) bool {
+	for _, s := range r.streams {
+		if s.Captures(subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/docker"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5/pgxpool"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	conn      *pgxpool.Pool
+	container *docker.PostgresContainer
+)
+
+func init() {
+	ctx := context.TODO()
+
+	var err error
+	container, conn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, outbox.Schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newBroker(t *testing.T) events.Broker {
+	ns := natsserver.RunRandClientPortServer()
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events.NewClient(ec)
+}
+
+func TestRelay(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	b := newBroker(t)
+
+	received := make(chan *events.DataEmail, 100)
+	err := events.TopicSendSignupConfirm.Subscribe(b, func(v *events.DataEmail) { received <- v })
+	is.NoErr(err) // subscribe
+	is.NoErr(b.Conn().Flush())
+
+	enqueue := func(email string, commit bool) {
+		m, err := outbox.NewMessage(events.TopicSendSignupConfirm, events.DataEmail{Email: email})
+		is.NoErr(err) // new message
+
+		tx, err := conn.Begin(ctx)
+		is.NoErr(err) // begin
+		defer tx.Rollback(ctx)
+
+		is.NoErr(outbox.Enqueue(ctx, tx, m)) // enqueue
+		if commit {
+			is.NoErr(tx.Commit(ctx)) // commit
+		}
+	}
+
+	t.Run("rolled back messages are not published", func(t *testing.T) {
+		enqueue("jane@doe.com", false)
+
+		n, err := outbox.NewRelay(conn, b).Flush(ctx)
+		is.NoErr(err)  // flush
+		is.Equal(n, 0) // nothing to send
+	})
+
+	t.Run("committed messages are published", func(t *testing.T) {
+		enqueue("john@doe.com", true)
+
+		n, err := outbox.NewRelay(conn, b).Flush(ctx)
+		is.NoErr(err)  // flush
+		is.Equal(n, 1) // sent
+
+		select {
+		case v := <-received:
+			is.Equal(v.Email, "john@doe.com") // payload
+		case <-time.After(time.Second):
+			t.Fatal("message was not published")
+		}
+
+		n, err = outbox.NewRelay(conn, b).Flush(ctx)
+		is.NoErr(err)  // flush again
+		is.Equal(n, 0) // removed once sent
+	})
+
+	t.Run("relays do not publish the same message", func(t *testing.T) {
+		const total = 50
+		for i := 0; i < total; i++ {
+			enqueue("john@doe.com", true)
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := outbox.NewRelay(conn, b, outbox.WithBatchSize(5), outbox.WithInterval(10*time.Millisecond))
+				if err := r.Run(ctx); !errors.Is(err, context.Canceled) {
+					t.Error(err)
+				}
+			}()
+		}
+
+		for i := 0; i < total; i++ {
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %d of %d messages", i, total)
+			}
+		}
+
+		cancel()
+		wg.Wait()
+
+		is.NoErr(b.Conn().Flush())
+		time.Sleep(50 * time.Millisecond)
+		is.Equal(len(received), 0) // each message was published once
+	})
+}
+
+func TestRelayStream(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	ns := natsserver.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+	b := events.NewClient(ec)
+
+	r := outbox.NewRelay(conn, b, outbox.WithStreams(events.StreamMail))
+
+	m, err := outbox.NewMessage(events.TopicSendSignupConfirm, events.DataEmail{Email: "john@doe.com"})
+	is.NoErr(err)                          // new message
+	is.NoErr(outbox.Enqueue(ctx, conn, m)) // enqueue
+	waiting := func() (n int) {
+		err := conn.QueryRow(ctx, `SELECT count(*) FROM outbox.messages WHERE id = $1`, m.ID).Scan(&n)
+		is.NoErr(err) // count outbox
+		return n
+	}
+
+	t.Run("kept until the stream stores it", func(t *testing.T) {
+		_, err := r.Flush(ctx)
+		is.True(err != nil)    // no stream to store the email
+		is.Equal(waiting(), 1) // still in the outbox
+	})
+
+	t.Run("removed once stored", func(t *testing.T) {
+		is.NoErr(events.StreamMail.Add(b)) // add stream
+
+		n, err := r.Flush(ctx)
+		is.NoErr(err)          // flush
+		is.Equal(n, 1)         // published
+		is.Equal(waiting(), 0) // removed from the outbox
+
+		js, err := nc.JetStream()
+		is.NoErr(err) // jetstream
+		info, err := js.StreamInfo(events.StreamMail.Name)
+		is.NoErr(err)                        // stream info
+		is.Equal(info.State.Msgs, uint64(1)) // stored by the stream
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -17,11 +18,21 @@ type Writer[T any] interface {
 	QueryContext(ctx context.Context, scanner func(row pgx.Rows, t *T) error, query string, args pgx.QueryRewriter) ([]*T, error)
 }
 
+// TxHandler runs the queries of a `Conn` in a transaction
+// begun by the `WithTx` of any `Conn` on the same pool
+type TxHandler[T any] interface {
+	WithTx(ctx context.Context, fn func(tx pgx.Tx) error, opts ...TxOption) error
+	ExecTx(ctx context.Context, tx pgx.Tx, query string, args pgx.QueryRewriter) (count int64, err error)
+	QueryRowTx(ctx context.Context, tx pgx.Tx, scanner func(row pgx.Row, t *T) error, query string, args pgx.QueryRewriter) (*T, error)
+	QueryTx(ctx context.Context, tx pgx.Tx, scanner func(row pgx.Rows, t *T) error, query string, args pgx.QueryRewriter) ([]*T, error)
+}
+
 type Conn[T any] interface {
 	Conn() *pgxpool.Pool
 
 	Reader
 	Writer[T]
+	TxHandler[T]
 }
 
 type connHandler[T any] struct {
@@ -48,6 +59,22 @@ func (h *connHandler[T]) QueryContext(ctx context.Context, scanner func(row pgx.
 	return QueryContext(ctx, h.conn, scanner, query, args)
 }
 
+func (h *connHandler[T]) WithTx(ctx context.Context, fn func(tx pgx.Tx) error, opts ...TxOption) error {
+	return WithTx(ctx, h.conn, fn, opts...)
+}
+
+func (h *connHandler[T]) ExecTx(ctx context.Context, tx pgx.Tx, query string, args pgx.QueryRewriter) (int64, error) {
+	return ExecTx(ctx, tx, query, args)
+}
+
+func (h *connHandler[T]) QueryRowTx(ctx context.Context, tx pgx.Tx, scanner func(row pgx.Row, t *T) error, query string, args pgx.QueryRewriter) (*T, error) {
+	return QueryRowTx(ctx, tx, scanner, query, args)
+}
+
+func (h *connHandler[T]) QueryTx(ctx context.Context, tx pgx.Tx, scanner func(row pgx.Rows, t *T) error, query string, args pgx.QueryRewriter) ([]*T, error) {
+	return QueryTx(ctx, tx, scanner, query, args)
+}
+
 func ExecContext(ctx context.Context, q *pgxpool.Pool, query string, args ...any) (int64, error) {
 	tag, err := q.Exec(ctx, query, args...)
 	return tag.RowsAffected(), err
@@ -78,3 +105,9 @@ func QueryContext[T any](ctx context.Context, q *pgxpool.Pool, scanner func(r pg
 }
 
 var ErrNoRowsAffected = errors.New("no rows affected in result set")
+
+// IsUniqueViolation reports whether the error was raised by a unique constraint
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
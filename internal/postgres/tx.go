@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultRetries is how many times a transaction is run again
+// after it lost a race with another
+const DefaultRetries = 3
+
+type txConfig struct {
+	opts    pgx.TxOptions
+	retries int
+}
+
+type TxOption func(*txConfig)
+
+// WithIsolation sets the isolation level of the transaction,
+// which is read committed unless given
+func WithIsolation(level pgx.TxIsoLevel) TxOption {
+	return func(c *txConfig) { c.opts.IsoLevel = level }
+}
+
+// WithRetries sets how many times a transaction that failed to
+// serialize is run again
+func WithRetries(n int) TxOption {
+	return func(c *txConfig) { c.retries = n }
+}
+
+// WithTx runs `fn` in a transaction, committing it if `fn` returns nil. A
+// transaction that fails to serialize or is chosen to break a deadlock is
+// run again, so `fn` may be called more than once and should only change
+// the database through `tx`.
+func WithTx(ctx context.Context, q *pgxpool.Pool, fn func(tx pgx.Tx) error, opts ...TxOption) error {
+	c := txConfig{retries: DefaultRetries}
+	for _, o := range opts {
+		o(&c)
+	}
+
+	for i := 0; ; i++ {
+		err := runTx(ctx, q, c.opts, fn)
+		if err == nil || i == c.retries || !IsSerializationFailure(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func runTx(ctx context.Context, q *pgxpool.Pool, opts pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+	tx, err := q.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// IsSerializationFailure reports whether the transaction lost a race
+// with another and may succeed if it is run again
+func IsSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+func ExecTx(ctx context.Context, tx pgx.Tx, query string, args ...any) (int64, error) {
+	tag, err := tx.Exec(ctx, query, args...)
+	return tag.RowsAffected(), err
+}
+
+func QueryRowTx[T any](ctx context.Context, tx pgx.Tx, scanner func(r pgx.Row, t *T) error, query string, args ...any) (*T, error) {
+	var t T
+	err := scanner(tx.QueryRow(ctx, query, args...), &t)
+	return &t, err
+}
+
+func QueryTx[T any](ctx context.Context, tx pgx.Tx, scanner func(r pgx.Rows, v *T) error, query string, args ...any) ([]*T, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vs []*T
+	for rows.Next() {
+		var v T
+		err = scanner(rows, &v)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, &v)
+	}
+	return vs, rows.Err()
+}
@@ -0,0 +1,138 @@
+package postgres_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/docker"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	conn      *pgxpool.Pool
+	container *docker.PostgresContainer
+)
+
+func init() {
+	ctx := context.TODO()
+
+	m := `
+	CREATE TABLE IF NOT EXISTS counters (
+		id INT PRIMARY KEY,
+		n INT NOT NULL
+	);`
+
+	var err error
+	container, conn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func scanCount(r pgx.Row, n *int) error { return r.Scan(n) }
+
+func TestWithTx(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	reset := func(id int) {
+		_, err := pg.ExecContext(ctx, conn, `INSERT INTO counters (id, n) VALUES ($1, 0) ON CONFLICT (id) DO UPDATE SET n = 0`, id)
+		is.NoErr(err) // reset counter
+	}
+
+	count := func(id int) int {
+		n, err := pg.QueryRowContext(ctx, conn, scanCount, `SELECT n FROM counters WHERE id = $1`, id)
+		is.NoErr(err) // read counter
+		return *n
+	}
+
+	// increment reads the counter then writes it back one higher,
+	// letting `between` run another transaction in the meantime
+	increment := func(id int, between func()) func(tx pgx.Tx) error {
+		return func(tx pgx.Tx) error {
+			n, err := pg.QueryRowTx(ctx, tx, scanCount, `SELECT n FROM counters WHERE id = $1`, id)
+			if err != nil {
+				return err
+			}
+
+			between()
+
+			_, err = pg.ExecTx(ctx, tx, `UPDATE counters SET n = $2 WHERE id = $1`, id, *n+1)
+			return err
+		}
+	}
+
+	serializable := pg.WithIsolation(pgx.Serializable)
+
+	t.Run("the loser of a race is run again and commits", func(t *testing.T) {
+		reset(1)
+
+		var attempts int
+		err := pg.WithTx(ctx, conn, increment(1, func() {
+			if attempts++; attempts == 1 {
+				// the winner commits after the loser has read the counter
+				is.NoErr(pg.WithTx(ctx, conn, increment(1, func() {}), serializable)) // winner
+			}
+		}), serializable)
+		is.NoErr(err)         // loser commits
+		is.Equal(attempts, 2) // loser was run again
+		is.Equal(count(1), 2) // both increments are kept
+	})
+
+	t.Run("retries run out", func(t *testing.T) {
+		reset(2)
+
+		var attempts int
+		err := pg.WithTx(ctx, conn, increment(2, func() {
+			attempts++
+			is.NoErr(pg.WithTx(ctx, conn, increment(2, func() {}), serializable)) // winner
+		}), serializable, pg.WithRetries(1))
+		is.True(pg.IsSerializationFailure(err)) // 40001 is returned
+		is.Equal(attempts, 2)                   // run once and retried once
+		is.Equal(count(2), 2)                   // only the winners commit
+	})
+
+	t.Run("an error rolls back", func(t *testing.T) {
+		reset(3)
+
+		errStop := errors.New("stop")
+		var attempts int
+		err := pg.WithTx(ctx, conn, func(tx pgx.Tx) error {
+			attempts++
+			if err := increment(3, func() {})(tx); err != nil {
+				return err
+			}
+			return errStop
+		}, serializable)
+		is.True(errors.Is(err, errStop)) // error is returned
+		is.Equal(attempts, 1)            // not run again
+		is.Equal(count(3), 0)            // increment is rolled back
+	})
+
+	t.Run("a panic rolls back", func(t *testing.T) {
+		reset(4)
+
+		func() {
+			defer func() { is.True(recover() != nil) }() // panic reaches the caller
+
+			pg.WithTx(ctx, conn, func(tx pgx.Tx) error {
+				if err := increment(4, func() {})(tx); err != nil {
+					return err
+				}
+				panic("stop")
+			})
+		}()
+
+		is.Equal(count(4), 0) // increment is rolled back
+
+		vs, err := pg.QueryContext(ctx, conn, func(r pgx.Rows, n *int) error { return r.Scan(n) }, `SELECT n FROM counters WHERE id = $1 FOR UPDATE NOWAIT`, 4)
+		is.NoErr(err)        // row is not left locked
+		is.Equal(len(vs), 1) // row
+	})
+}
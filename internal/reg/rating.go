@@ -0,0 +1,38 @@
+package reg
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultRating is given to a player before their first rated game
+	DefaultRating = 1500
+	// K is the most a rating can change after a single game
+	K = 32
+)
+
+// Rating is a player's Elo rating in one variant
+type Rating struct {
+	Variant string
+	Rating  int
+	Games   int
+}
+
+// Standing is a player's place on the leaderboard for a variant
+type Standing struct {
+	Rank     int
+	ID       uuid.UUID
+	Username string
+	Rating   int
+	Games    int
+}
+
+// RatingChange records how a rating moved after a game
+type RatingChange struct {
+	GameID   uuid.UUID
+	Rating   int
+	Change   int
+	PlayedAt time.Time
+}
@@ -2,8 +2,12 @@ package repo
 
 import (
 	"context"
+	"errors"
 
 	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
 	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
 	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
 	"github.com/jackc/pgx/v5"
@@ -22,13 +26,27 @@ type User struct {
 type Repo interface {
 	SetProfile(ctx context.Context, args pgx.QueryRewriter) error
 	GetProfile(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error)
+	GetProfileByEmail(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error)
+	GetProfiles(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Profile, error)
 	UnsetProfile(ctx context.Context, args pgx.QueryRewriter) error
+	BanProfile(ctx context.Context, args pgx.QueryRewriter) error
 	UpdateProfile(ctx context.Context, args pgx.QueryRewriter) error
 	SetPhotoURL(ctx context.Context, args pgx.QueryRewriter) error
+	// Enqueue stores an `outbox.Message` to be published
+	Enqueue(ctx context.Context, args pgx.QueryRewriter) error
+
+	SetResult(ctx context.Context, args pgx.QueryRewriter) error
+	GetRating(ctx context.Context, args pgx.QueryRewriter) (*reg.Rating, error)
+	GetRatings(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Rating, error)
+	GetLeaderboard(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Standing, error)
+	GetRatingHistory(ctx context.Context, args pgx.QueryRewriter) ([]*reg.RatingChange, error)
 }
 
 type repo struct {
 	c pg.Conn[reg.Profile]
+	r pg.Conn[reg.Rating]
+	s pg.Conn[reg.Standing]
+	h pg.Conn[reg.RatingChange]
 }
 
 type UUIDArgs struct {
@@ -46,12 +64,51 @@ func (a UUIDArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string,
 // GetProfile implements Repo
 func (r *repo) GetProfile(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error) {
 	const q = `
-	SELECT id, email, username
+	SELECT id, email, username, COALESCE(bio, ''), COALESCE(photo_url, ''), role, banned_at
 	FROM registry.profiles
 	WHERE id = @id`
 
 	return r.c.QueryRowContext(ctx, func(r pgx.Row, u *reg.Profile) error {
-		return r.Scan(&u.ID, &u.Email, &u.Username)
+		return r.Scan(&u.ID, &u.Email, &u.Username, &u.Bio, &u.PhotoURL, &u.Role, &u.BannedAt)
+	}, q, args)
+}
+
+type EmailArgs struct {
+	Email string
+}
+
+func (a EmailArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"email": a.Email,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// GetProfileByEmail finds the profile a login is for. Emails are
+// case-insensitive so any casing the user typed will match.
+func (r *repo) GetProfileByEmail(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error) {
+	const q = `
+	SELECT id, email, username, COALESCE(photo_url, ''), role, banned_at
+	FROM registry.profiles
+	WHERE email = @email`
+
+	return r.c.QueryRowContext(ctx, func(r pgx.Row, u *reg.Profile) error {
+		return r.Scan(&u.ID, &u.Email, &u.Username, &u.PhotoURL, &u.Role, &u.BannedAt)
+	}, q, args)
+}
+
+// GetProfiles returns a page of every profile, ordered by username. Only
+// the `Limit` and `Offset` of `PageArgs` are used.
+func (r *repo) GetProfiles(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Profile, error) {
+	const q = `
+	SELECT id, email, username, role, banned_at
+	FROM registry.profiles
+	ORDER BY username, id
+	LIMIT @limit OFFSET @offset`
+
+	return r.c.QueryContext(ctx, func(r pgx.Rows, u *reg.Profile) error {
+		return r.Scan(&u.ID, &u.Email, &u.Username, &u.Role, &u.BannedAt)
 	}, q, args)
 }
 
@@ -72,26 +129,106 @@ func (a SetProfileArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql st
 	return na.RewriteQuery(ctx, conn, sql, args)
 }
 
+// SetProfile creates the profile together with its initial rating
+// in the classic variant, so a new player is on its leaderboard
 func (r *repo) SetProfile(ctx context.Context, args pgx.QueryRewriter) error {
 	const q = `
 	INSERT INTO registry.profiles (id, email, username, bio)
-	VALUES (@id, @email, @username, NULLIF(@bio,''))`
-
-	_, err := r.c.ExecContext(ctx, q, args)
-	return err
+	VALUES (@id, @email, @username, NULLIF(@bio,''))
+	RETURNING id`
+
+	const rate = `
+	INSERT INTO registry.ratings (profile_id, variant, rating)
+	VALUES (@id, @variant, @default_rating)`
+
+	return r.c.WithTx(ctx, func(tx pgx.Tx) error {
+		p, err := r.c.QueryRowTx(ctx, tx, func(r pgx.Row, u *reg.Profile) error {
+			return r.Scan(&u.ID)
+		}, q, args)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.r.ExecTx(ctx, tx, rate, RatingArgs{ID: p.ID, Variant: string(game.Classic)})
+		return err
+	})
 }
 
+// UnsetProfile deletes the profile in `UUIDArgs`, and
+// enqueues `events.TopicProfileClosed` for its sessions to end
 func (r *repo) UnsetProfile(ctx context.Context, args pgx.QueryRewriter) error {
 	const q = `
 	DELETE FROM registry.profiles
+	WHERE id = @id
+	RETURNING id`
+
+	return r.closeProfile(ctx, q, args)
+}
+
+// BanProfile bans the profile in `UUIDArgs`, and enqueues
+// `events.TopicProfileClosed` for its sessions to end. Banning
+// a profile that is already banned affects no rows, and banning
+// one that does not exist returns pgx.ErrNoRows.
+func (r *repo) BanProfile(ctx context.Context, args pgx.QueryRewriter) error {
+	const find = `
+	SELECT id, banned_at
+	FROM registry.profiles
+	WHERE id = @id
+	FOR UPDATE`
+
+	const q = `
+	UPDATE registry.profiles
+	SET banned_at = now()
 	WHERE id = @id`
 
-	count, err := r.c.ExecContext(ctx, q, args)
-	if count == 0 {
-		return pg.ErrNoRowsAffected
+	return r.c.WithTx(ctx, func(tx pgx.Tx) error {
+		p, err := r.c.QueryRowTx(ctx, tx, func(r pgx.Row, u *reg.Profile) error {
+			return r.Scan(&u.ID, &u.BannedAt)
+		}, find, args)
+		if err != nil {
+			return err
+		}
+
+		if p.BannedAt != nil {
+			return pg.ErrNoRowsAffected
+		}
+
+		if _, err := r.c.ExecTx(ctx, tx, q, args); err != nil {
+			return err
+		}
+		return profileClosed(ctx, tx, p.ID)
+	})
+}
+
+// closeProfile runs `q`, which returns the id of the profile it
+// closed, in the same transaction as the event that says so
+func (r *repo) closeProfile(ctx context.Context, q string, args pgx.QueryRewriter) error {
+	return r.c.WithTx(ctx, func(tx pgx.Tx) error {
+		p, err := r.c.QueryRowTx(ctx, tx, func(r pgx.Row, u *reg.Profile) error {
+			return r.Scan(&u.ID)
+		}, q, args)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pg.ErrNoRowsAffected
+		}
+		if err != nil {
+			return err
+		}
+		return profileClosed(ctx, tx, p.ID)
+	})
+}
+
+// profileClosed enqueues `events.TopicProfileClosed` in the transaction
+func profileClosed(ctx context.Context, tx pgx.Tx, id uuid.UUID) error {
+	m, err := outbox.NewMessage(events.TopicProfileClosed, events.DataProfileClosed{ID: id})
+	if err != nil {
+		return err
 	}
 
-	return err
+	return outbox.Enqueue(ctx, tx, m)
+}
+
+func (r *repo) Enqueue(ctx context.Context, args pgx.QueryRewriter) error {
+	return outbox.Enqueue(ctx, r.c.Conn(), args)
 }
 
 func (r *repo) SetBio(ctx context.Context, args pgx.QueryRewriter) error {
@@ -101,11 +238,14 @@ func (r *repo) SetBio(ctx context.Context, args pgx.QueryRewriter) error {
 	WHERE id = @id`
 
 	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
 	if count == 0 {
 		return pg.ErrNoRowsAffected
 	}
-
-	return err
+	return nil
 }
 
 type SetPhotoURLArgs struct {
@@ -129,11 +269,14 @@ func (r *repo) SetPhotoURL(ctx context.Context, args pgx.QueryRewriter) error {
 	WHERE id = @id`
 
 	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
 	if count == 0 {
 		return pg.ErrNoRowsAffected
 	}
-
-	return err
+	return nil
 }
 
 type UpdateProfileArgs struct {
@@ -156,18 +299,187 @@ func (r *repo) UpdateProfile(ctx context.Context, args pgx.QueryRewriter) error
 	const q = `
 	UPDATE registry.profiles
 	SET username = @username,
-		bio = NULLIF(@bio,''),
-		WHERE id = @id`
+		bio = NULLIF(@bio,'')
+	WHERE id = @id`
 
 	count, err := r.c.ExecContext(ctx, q, args)
+	if err != nil {
+		return err
+	}
+
 	if count == 0 {
 		return pg.ErrNoRowsAffected
 	}
+	return nil
+}
+
+type SetResultArgs struct {
+	GameID  uuid.UUID
+	Variant string
+	X, O    uuid.UUID
+	// Score is 1 when X won, 0 when O won and 0.5 for a draw
+	Score float64
+}
+
+func (a SetResultArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"game_id":        a.GameID,
+		"variant":        a.Variant,
+		"x":              a.X,
+		"o":              a.O,
+		"score":          a.Score,
+		"k":              reg.K,
+		"default_rating": reg.DefaultRating,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// SetResult updates both players' ratings and their history in a single
+// transaction. Recording the same game twice violates the primary key of
+// `registry.rating_history`, so a result is only ever counted once. Games
+// that share a player are rated one after another, as each waits for
+// the other to release that player's rows.
+func (r *repo) SetResult(ctx context.Context, args pgx.QueryRewriter) error {
+	const seed = `
+	INSERT INTO registry.ratings (profile_id, variant, rating)
+	VALUES (@x, @variant, @default_rating), (@o, @variant, @default_rating)
+	ON CONFLICT DO NOTHING`
+
+	// rows are locked in the same order by every transaction to avoid deadlocks
+	const lock = `
+	SELECT profile_id
+	FROM registry.ratings
+	WHERE variant = @variant AND profile_id IN (@x, @o)
+	ORDER BY profile_id
+	FOR UPDATE`
+
+	// X gains what O loses
+	const update = `
+	WITH d AS (
+		SELECT round(@k * (@score - 1 / (1 + power(10, (o.rating - x.rating) / 400.0))))::INT AS delta
+		FROM registry.ratings x, registry.ratings o
+		WHERE x.profile_id = @x AND x.variant = @variant
+		AND o.profile_id = @o AND o.variant = @variant
+	), u AS (
+		UPDATE registry.ratings r
+		SET rating = r.rating + CASE WHEN r.profile_id = @x THEN d.delta ELSE -d.delta END,
+			games = r.games + 1,
+			updated_at = now()
+		FROM d
+		WHERE r.variant = @variant AND r.profile_id IN (@x, @o)
+		RETURNING r.profile_id, r.rating, CASE WHEN r.profile_id = @x THEN d.delta ELSE -d.delta END AS change
+	)
+	INSERT INTO registry.rating_history (profile_id, variant, game_id, rating, change)
+	SELECT profile_id, @variant, @game_id, rating, change FROM u`
+
+	return r.r.WithTx(ctx, func(tx pgx.Tx) error {
+		for _, q := range []string{seed, lock, update} {
+			if _, err := r.r.ExecTx(ctx, tx, q, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type RatingArgs struct {
+	ID      uuid.UUID
+	Variant string
+}
+
+func (a RatingArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":             a.ID,
+		"variant":        a.Variant,
+		"default_rating": reg.DefaultRating,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
+
+// GetRating returns the player's rating in a variant. Players
+// who have not been rated yet return pgx.ErrNoRows.
+func (r *repo) GetRating(ctx context.Context, args pgx.QueryRewriter) (*reg.Rating, error) {
+	const q = `
+	SELECT variant, rating, games
+	FROM registry.ratings
+	WHERE profile_id = @id AND variant = @variant`
+
+	return r.r.QueryRowContext(ctx, func(r pgx.Row, v *reg.Rating) error {
+		return r.Scan(&v.Variant, &v.Rating, &v.Games)
+	}, q, args)
+}
+
+// GetRatings returns every rating held by the profile in `UUIDArgs`
+func (r *repo) GetRatings(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Rating, error) {
+	const q = `
+	SELECT variant, rating, games
+	FROM registry.ratings
+	WHERE profile_id = @id
+	ORDER BY variant`
+
+	return r.r.QueryContext(ctx, func(r pgx.Rows, v *reg.Rating) error {
+		return r.Scan(&v.Variant, &v.Rating, &v.Games)
+	}, q, args)
+}
+
+type PageArgs struct {
+	// ID is the profile for a rating history and ignored otherwise
+	ID uuid.UUID
+	// Variant is ignored when listing profiles
+	Variant string
+	Limit   int
+	Offset  int
+}
+
+func (a PageArgs) RewriteQuery(ctx context.Context, conn *pgx.Conn, sql string, args []any) (newSQL string, newArgs []any, err error) {
+	na := pgx.NamedArgs{
+		"id":      a.ID,
+		"variant": a.Variant,
+		"limit":   a.Limit,
+		"offset":  a.Offset,
+	}
+
+	return na.RewriteQuery(ctx, conn, sql, args)
+}
 
-	return err
+// GetLeaderboard returns a page of the highest rated players in a variant.
+// Players with the same rating share a rank.
+func (r *repo) GetLeaderboard(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Standing, error) {
+	const q = `
+	SELECT rank() OVER (ORDER BY r.rating DESC), p.id, p.username, r.rating, r.games
+	FROM registry.ratings r
+	JOIN registry.profiles p ON p.id = r.profile_id
+	WHERE r.variant = @variant
+	ORDER BY r.rating DESC, p.username
+	LIMIT @limit OFFSET @offset`
+
+	return r.s.QueryContext(ctx, func(r pgx.Rows, v *reg.Standing) error {
+		return r.Scan(&v.Rank, &v.ID, &v.Username, &v.Rating, &v.Games)
+	}, q, args)
+}
+
+// GetRatingHistory returns a page of rating changes, most recent first
+func (r *repo) GetRatingHistory(ctx context.Context, args pgx.QueryRewriter) ([]*reg.RatingChange, error) {
+	const q = `
+	SELECT game_id, rating, change, played_at
+	FROM registry.rating_history
+	WHERE profile_id = @id AND variant = @variant
+	ORDER BY played_at DESC, game_id
+	LIMIT @limit OFFSET @offset`
+
+	return r.h.QueryContext(ctx, func(r pgx.Rows, v *reg.RatingChange) error {
+		return r.Scan(&v.GameID, &v.Rating, &v.Change, &v.PlayedAt)
+	}, q, args)
 }
 
 func New(rwc *pgxpool.Pool) Repo {
-	r := &repo{c: pg.NewConn[reg.Profile](rwc)}
+	r := &repo{
+		c: pg.NewConn[reg.Profile](rwc),
+		r: pg.NewConn[reg.Rating](rwc),
+		s: pg.NewConn[reg.Standing](rwc),
+		h: pg.NewConn[reg.RatingChange](rwc),
+	}
 	return r
 }
@@ -8,6 +8,10 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/hyphengolang/noughts-and-crosses/internal/docker"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
 	repo "github.com/hyphengolang/noughts-and-crosses/internal/reg/repository"
 	"github.com/hyphengolang/prelude/testing/is"
 	"github.com/jackc/pgx/v5"
@@ -16,6 +20,7 @@ import (
 
 var (
 	regRepo   repo.Repo
+	regConn   *pgxpool.Pool
 	container *docker.PostgresContainer
 )
 
@@ -33,22 +38,42 @@ func init() {
 		email CITEXT UNIQUE NOT NULL CHECK (email ~ '^[a-zA-Z0-9.!#$%&’*+/=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,253}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,253}[a-zA-Z0-9])?)*$'),
 		username VARCHAR(15) UNIQUE NOT NULL CHECK (username <> ''),
 		bio VARCHAR(160),
-		photo_url TEXT
+		photo_url TEXT,
+		role VARCHAR(16) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+		banned_at TIMESTAMPTZ
 	);
-	`
 
-	var (
-		conn *pgxpool.Pool
-		err  error
-	)
+	CREATE TABLE IF NOT EXISTS registry.ratings (
+		profile_id UUID NOT NULL REFERENCES registry.profiles (id) ON DELETE CASCADE,
+		variant VARCHAR(16) NOT NULL,
+		rating INT NOT NULL,
+		games INT NOT NULL DEFAULT 0 CHECK (games >= 0),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (profile_id, variant)
+	);
+
+	CREATE INDEX IF NOT EXISTS ratings_leaderboard ON registry.ratings (variant, rating DESC);
+
+	CREATE TABLE IF NOT EXISTS registry.rating_history (
+		profile_id UUID NOT NULL,
+		variant VARCHAR(16) NOT NULL,
+		game_id UUID NOT NULL,
+		rating INT NOT NULL,
+		change INT NOT NULL,
+		played_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (profile_id, game_id),
+		FOREIGN KEY (profile_id, variant) REFERENCES registry.ratings (profile_id, variant) ON DELETE CASCADE
+	);
+	` + outbox.Schema
 
-	container, conn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, m)
+	var err error
+	container, regConn, err = docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, m)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// initialize test repo
-	regRepo = repo.New(conn)
+	regRepo = repo.New(regConn)
 }
 
 func TestUserRepository(t *testing.T) {
@@ -67,6 +92,11 @@ func TestUserRepository(t *testing.T) {
 
 		err := regRepo.SetProfile(ctx, args)
 		is.NoErr(err) // create a new profile
+
+		rating, err := regRepo.GetRating(ctx, repo.RatingArgs{ID: johnDoe, Variant: "classic"})
+		is.NoErr(err)                              // created in the same transaction
+		is.Equal(rating.Rating, reg.DefaultRating) // initial rating
+		is.Equal(rating.Games, 0)                  // no games yet
 	})
 
 	t.Run("update photo_url for created user", func(t *testing.T) {
@@ -100,6 +130,163 @@ func TestUserRepository(t *testing.T) {
 		is.Equal(user.Email, "john@doe.com") // email is correct
 	})
 
+	janeDoe := uuid.New()
+
+	t.Run("create a new row for an opponent", func(t *testing.T) {
+		args := pgx.NamedArgs{
+			"id":       janeDoe,
+			"email":    "jane@doe.com",
+			"username": "jane123doe",
+		}
+
+		err := regRepo.SetProfile(ctx, args)
+		is.NoErr(err) // create a new profile
+	})
+
+	t.Run("update profile for 'john doe'", func(t *testing.T) {
+		err := regRepo.UpdateProfile(ctx, repo.UpdateProfileArgs{ID: johnDoe, Username: "john123doe", Bio: "plays noughts"})
+		is.NoErr(err) // update profile
+
+		user, err := regRepo.GetProfile(ctx, repo.UUIDArgs{ID: johnDoe})
+		is.NoErr(err)                                                // get profile
+		is.Equal(user.Bio, "plays noughts")                          // bio is updated
+		is.Equal(user.PhotoURL, "https://link/to/bucket.com/someId") // photo url is kept
+	})
+
+	t.Run("usernames and emails are unique", func(t *testing.T) {
+		err := regRepo.UpdateProfile(ctx, repo.UpdateProfileArgs{ID: johnDoe, Username: "jane123doe"})
+		is.True(pg.IsUniqueViolation(err)) // username taken by jane
+
+		err = regRepo.SetProfile(ctx, repo.SetProfileArgs{Email: "JANE@doe.com", Username: "jane456doe"})
+		is.True(pg.IsUniqueViolation(err)) // email taken by jane
+	})
+
+	t.Run("unknown profiles are not found", func(t *testing.T) {
+		_, err := regRepo.GetProfile(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.Equal(err, pgx.ErrNoRows) // get
+
+		err = regRepo.UpdateProfile(ctx, repo.UpdateProfileArgs{ID: uuid.New(), Username: "nobody"})
+		is.Equal(err, pg.ErrNoRowsAffected) // update
+
+		err = regRepo.UnsetProfile(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.Equal(err, pg.ErrNoRowsAffected) // delete
+	})
+
+	gameID := uuid.New()
+
+	t.Run("rate a finished game", func(t *testing.T) {
+		args := repo.SetResultArgs{
+			GameID:  gameID,
+			Variant: "classic",
+			X:       johnDoe,
+			O:       janeDoe,
+			Score:   1,
+		}
+
+		err := regRepo.SetResult(ctx, args)
+		is.NoErr(err) // john beat jane
+
+		john, err := regRepo.GetRating(ctx, repo.RatingArgs{ID: johnDoe, Variant: "classic"})
+		is.NoErr(err)               // get rating
+		is.Equal(john.Rating, 1516) // evenly matched players move by half of K
+		is.Equal(john.Games, 1)     // one game played
+
+		jane, err := regRepo.GetRating(ctx, repo.RatingArgs{ID: janeDoe, Variant: "classic"})
+		is.NoErr(err)               // get rating
+		is.Equal(jane.Rating, 1484) // jane lost what john won
+	})
+
+	t.Run("a game is only rated once", func(t *testing.T) {
+		args := repo.SetResultArgs{
+			GameID:  gameID,
+			Variant: "classic",
+			X:       johnDoe,
+			O:       janeDoe,
+			Score:   1,
+		}
+
+		err := regRepo.SetResult(ctx, args)
+		is.True(pg.IsUniqueViolation(err)) // already rated
+
+		john, err := regRepo.GetRating(ctx, repo.RatingArgs{ID: johnDoe, Variant: "classic"})
+		is.NoErr(err)               // get rating
+		is.Equal(john.Rating, 1516) // rolled back
+	})
+
+	t.Run("ratings are kept per variant", func(t *testing.T) {
+		_, err := regRepo.GetRating(ctx, repo.RatingArgs{ID: johnDoe, Variant: "ultimate"})
+		is.Equal(err, pgx.ErrNoRows) // not rated in ultimate
+
+		ratings, err := regRepo.GetRatings(ctx, repo.UUIDArgs{ID: johnDoe})
+		is.NoErr(err)             // get ratings
+		is.Equal(len(ratings), 1) // classic only
+	})
+
+	t.Run("leaderboard", func(t *testing.T) {
+		page, err := regRepo.GetLeaderboard(ctx, repo.PageArgs{Variant: "classic", Limit: 1})
+		is.NoErr(err)                            // first page
+		is.Equal(len(page), 1)                   // one player per page
+		is.Equal(page[0].Username, "john123doe") // john is top
+		is.Equal(page[0].Rank, 1)                // first place
+
+		page, err = regRepo.GetLeaderboard(ctx, repo.PageArgs{Variant: "classic", Limit: 1, Offset: 1})
+		is.NoErr(err)                 // second page
+		is.Equal(page[0].ID, janeDoe) // jane is second
+		is.Equal(page[0].Rank, 2)     // second place
+	})
+
+	t.Run("rating history", func(t *testing.T) {
+		h, err := regRepo.GetRatingHistory(ctx, repo.PageArgs{ID: janeDoe, Variant: "classic", Limit: 10})
+		is.NoErr(err)                 // get history
+		is.Equal(len(h), 1)           // one game
+		is.Equal(h[0].GameID, gameID) // the game john won
+		is.Equal(h[0].Change, -16)    // jane lost 16
+	})
+
+	t.Run("get profile by email", func(t *testing.T) {
+		user, err := regRepo.GetProfileByEmail(ctx, repo.EmailArgs{Email: "John@Doe.com"})
+		is.NoErr(err)                                                // get profile
+		is.Equal(user.ID, johnDoe)                                   // emails are case-insensitive
+		is.Equal(user.PhotoURL, "https://link/to/bucket.com/someId") // photo url is set
+
+		_, err = regRepo.GetProfileByEmail(ctx, repo.EmailArgs{Email: "nobody@doe.com"})
+		is.Equal(err, pgx.ErrNoRows) // no profile
+	})
+
+	t.Run("profiles start as users", func(t *testing.T) {
+		user, err := regRepo.GetProfile(ctx, repo.UUIDArgs{ID: johnDoe})
+		is.NoErr(err)                     // get profile
+		is.Equal(user.Role, reg.RoleUser) // default role
+		is.True(user.BannedAt == nil)     // not banned
+	})
+
+	t.Run("list profiles", func(t *testing.T) {
+		page, err := regRepo.GetProfiles(ctx, repo.PageArgs{Limit: 1, Offset: 1})
+		is.NoErr(err)                            // second page
+		is.Equal(len(page), 1)                   // one profile per page
+		is.Equal(page[0].Username, "john123doe") // ordered by username
+	})
+
+	t.Run("ban profile for 'jane doe'", func(t *testing.T) {
+		err := regRepo.BanProfile(ctx, repo.UUIDArgs{ID: janeDoe})
+		is.NoErr(err) // ban profile
+
+		user, err := regRepo.GetProfileByEmail(ctx, repo.EmailArgs{Email: "jane@doe.com"})
+		is.NoErr(err)                 // get profile
+		is.True(user.BannedAt != nil) // banned
+
+		err = regRepo.BanProfile(ctx, repo.UUIDArgs{ID: janeDoe})
+		is.Equal(err, pg.ErrNoRowsAffected) // already banned
+
+		err = regRepo.BanProfile(ctx, repo.UUIDArgs{ID: uuid.New()})
+		is.Equal(err, pgx.ErrNoRows) // no such profile
+
+		var n int
+		err = regConn.QueryRow(ctx, `SELECT count(*) FROM outbox.messages WHERE subject = $1`, events.EventProfileClosed).Scan(&n)
+		is.NoErr(err)  // count outbox
+		is.Equal(n, 1) // closed once, in the same transaction
+	})
+
 	t.Run("delete profile for 'john doe'", func(t *testing.T) {
 		args := pgx.NamedArgs{
 			"id": johnDoe,
@@ -0,0 +1,30 @@
+package reg
+
+// Role is stored with the profile and decides the scopes of its access tokens
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Scopes that an access token can grant
+const (
+	ScopePlay        = "games:play"
+	ScopeUsersRead   = "users:read"
+	ScopeUsersBan    = "users:ban"
+	ScopeUsersDelete = "users:delete"
+)
+
+// Scopes returns what the role may do. Unknown roles are treated as users.
+func (r Role) Scopes() []string {
+	switch r {
+	case RoleAdmin:
+		return []string{ScopePlay, ScopeUsersRead, ScopeUsersBan, ScopeUsersDelete}
+	case RoleModerator:
+		return []string{ScopePlay, ScopeUsersRead, ScopeUsersBan}
+	default:
+		return []string{ScopePlay}
+	}
+}
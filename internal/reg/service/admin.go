@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/reg/repository"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+)
+
+// adminRoutes are for staff, whose access tokens carry the scopes of their role
+func (s *Service) adminRoutes() {
+	a := s.m.With(service.Authenticate(s.t))
+	a.With(s.m.RequireScope(reg.ScopeUsersRead)).Get("/admin/users", s.handleListUsers())
+
+	r := a.With(service.PathParam("uuid", uuidParser))
+	r.With(s.m.RequireScope(reg.ScopeUsersBan)).Post("/admin/users/{uuid}/ban", s.handleBan())
+	r.With(s.m.RequireScope(reg.ScopeUsersDelete)).Delete("/admin/users/{uuid}", s.handleTermination())
+}
+
+func (s *Service) handleListUsers() http.HandlerFunc {
+	type E struct {
+		ID       uuid.UUID `json:"id"`
+		Email    string    `json:"email"`
+		Username string    `json:"username"`
+		Role     reg.Role  `json:"role"`
+		Banned   bool      `json:"banned"`
+	}
+
+	type P struct {
+		Users []E  `json:"users"`
+		Next  *int `json:"next"` // offset of the next page
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := pageFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		profiles, err := s.r.GetProfiles(r.Context(), repo.PageArgs{Limit: limit, Offset: offset})
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		p := P{Users: make([]E, len(profiles)), Next: nextOffset(len(profiles), limit, offset)}
+		for i, v := range profiles {
+			p.Users[i] = E{ID: v.ID, Email: v.Email, Username: v.Username, Role: v.Role, Banned: v.BannedAt != nil}
+		}
+
+		s.m.Respond(w, r, p, http.StatusOK)
+	}
+}
+
+// handleBan stops the user logging in. The repository tells `auth`
+// to end their sessions. Banning a user twice is not an error, but
+// banning one who does not exist is.
+func (s *Service) handleBan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := uuidFromRequest(r)
+
+		args := repo.UUIDArgs{ID: uid}
+		if err := s.r.BanProfile(r.Context(), args); err != nil && !errors.Is(err, pg.ErrNoRowsAffected) {
+			s.m.Respond(w, r, err, errs.Status(err))
+			return
+		}
+
+		s.m.Respond(w, r, nil, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,11 @@
+package service
+
+import "time"
+
+type Option func(*Service)
+
+// WithBackoff sets how long to wait before each retry of a game
+// result that could not be rated
+func WithBackoff(d ...time.Duration) Option {
+	return func(s *Service) { s.backoff = d }
+}
@@ -1,16 +1,26 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
 	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
 	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
 	repo "github.com/hyphengolang/noughts-and-crosses/internal/reg/repository"
 	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
 	"github.com/hyphengolang/noughts-and-crosses/pkg/parse"
+	"github.com/jackc/pgx/v5"
 )
 
 func uuidParser(r *http.Request, key string) (uuid.UUID, error) {
@@ -21,10 +31,31 @@ func uuidFromRequest(r *http.Request) (uuid.UUID, error) {
 	return service.PathParamFromRequest[uuid.UUID](r)
 }
 
+// ownerOnly is a middleware that only lets users change their own
+// profile. It must run after `Authenticate`.
+func ownerOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			service.WriteProblem(w, r, err, http.StatusUnauthorized)
+			return
+		}
+
+		if uid, _ := uuidFromRequest(r); uid != p.ID {
+			service.WriteProblem(w, r, errs.New(errs.PermissionDenied, "not the owner of this profile"), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 type Service struct {
 	m service.Router
 	e events.Broker
+	t token.Client
 	r repo.Repo
+
+	backoff []time.Duration
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -32,15 +63,22 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // events.Client should be a dependency
-func New(e events.Broker, r repo.Repo) *Service {
+func New(e events.Broker, t token.Client, r repo.Repo, opts ...Option) (*Service, error) {
 	s := &Service{
-		m: service.NewRouter(),
-		e: e,
-		r: r,
+		m:       service.NewRouter(),
+		e:       e,
+		t:       t,
+		r:       r,
+		backoff: events.DefaultBackoff,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if err := s.listen(); err != nil {
+		return nil, err
 	}
-	go s.listen()
 	s.routes()
-	return s
+	return s, nil
 }
 
 func (s *Service) routes() {
@@ -50,24 +88,22 @@ func (s *Service) routes() {
 
 	s.m.Post("/users", s.handleRegisterProfile())
 
-	// r := s.m.With(service.PathParam("uuid", uuidParser))
-	// r.Delete("/users/{uuid}", s.handleTermination())
-	// r.Get("/users/{uuid}/profile", s.handleGetProfile())
-	// r.Post("/users/{uuid}/profile", s.handleSetProfile())
-	// r.Put("/users/{uuid}/profile/photo-url", s.handleSetPhotoURL())
-}
+	s.m.Get("/leaderboard/{variant}", s.handleLeaderboard())
 
-func (s *Service) handleVerifySignup() http.HandlerFunc {
-	parseEmail := func(r *http.Request, token []byte, timeout time.Duration) (email string, err error) {
-		var reply struct{ events.Data[string] }
-		err = s.e.Conn().Request(events.EventVerifySignupToken, events.DataToken{Token: token}, &reply, 5*time.Second)
-		if err != nil {
-			return
-		}
+	r := s.m.With(service.PathParam("uuid", uuidParser))
+	r.Get("/users/{uuid}/profile", s.handleGetProfile())
+	r.Get("/users/{uuid}/ratings/{variant}", s.handleRatingHistory())
 
-		return reply.Value, reply.Err
-	}
+	// signed in users may only change their own profile
+	a := r.With(service.Authenticate(s.t), ownerOnly)
+	a.Delete("/users/{uuid}", s.handleTermination())
+	a.Post("/users/{uuid}/profile", s.handleSetProfile())
+	a.Put("/users/{uuid}/profile/photo-url", s.handleSetPhotoURL())
+
+	s.adminRoutes()
+}
 
+func (s *Service) handleVerifySignup() http.HandlerFunc {
 	type P struct {
 		Email string `json:"email"`
 	}
@@ -76,15 +112,16 @@ func (s *Service) handleVerifySignup() http.HandlerFunc {
 
 		if err != nil {
 			// log.Printf("parsing header")
-			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			s.m.Respond(w, r, errs.Wrap(errs.Unauthenticated, err), http.StatusUnauthorized)
 			return
 		}
 
-		email, err := parseEmail(r, token, 5*time.Second)
+		email, err := events.EndpointVerifySignupToken.Request(r.Context(), s.e, events.DataToken{Token: token})
 
 		if err != nil {
-			// log.Printf("parsing token")
-			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			// `auth` says whether the link expired, was forged or was
+			// already used, and NATS whether `auth` is unavailable
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -110,7 +147,14 @@ func (s *Service) handleSignUp() http.HandlerFunc {
 			return
 		}
 
-		if err := s.e.Conn().Publish(events.EventSendSignupConfirm, events.DataEmail{Email: q.Email}); err != nil {
+		// the outbox sends the email even if NATS is down right now
+		m, err := outbox.NewMessage(events.TopicSendSignupConfirm, events.DataEmail{Email: q.Email})
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.r.Enqueue(r.Context(), m); err != nil {
 			s.m.Respond(w, r, err, http.StatusInternalServerError)
 			return
 		}
@@ -138,38 +182,13 @@ func (s *Service) handleRegisterProfile() http.HandlerFunc {
 	}
 
 	auth := func(w http.ResponseWriter, r *http.Request, email string) error {
-		type D struct{ events.Data[struct{}] }
-
 		token, err := parse.ParseToken(r)
 		if err != nil {
-			return err
-		}
-
-		var data D
-		err = s.e.Conn().Request(events.EventCreateProfileValidation, events.DataAuthToken{Token: token, Email: email}, &data, 5*time.Second)
-		if err != nil {
-			return err
+			return errs.Wrap(errs.Unauthenticated, err)
 		}
 
-		return data.Err
-
-		// msg, err := events.NewCreateProfileValidationMsg(email, token)
-		// if err != nil {
-		// 	return err
-		// }
-
-		// // this will be an a gob encoded message so needs to be decoded
-		// p, err := s.e.Request(msg, 5*time.Second)
-		// if err != nil {
-		// 	return err
-		// }
-
-		// var auth Data
-		// if err := events.Unmarshal(p, &auth); err != nil {
-		// 	return err
-		// }
-
-		// return auth.Err
+		_, err = events.EndpointCreateProfileValidation.Request(r.Context(), s.e, events.DataAuthToken{Token: token, Email: email})
+		return err
 	}
 
 	type P struct {
@@ -184,7 +203,7 @@ func (s *Service) handleRegisterProfile() http.HandlerFunc {
 		}
 
 		if err := auth(w, r, q.Email); err != nil {
-			s.m.Respond(w, r, err, http.StatusUnauthorized)
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -195,7 +214,7 @@ func (s *Service) handleRegisterProfile() http.HandlerFunc {
 		}
 
 		if err := s.r.SetProfile(r.Context(), args); err != nil {
-			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -204,7 +223,6 @@ func (s *Service) handleRegisterProfile() http.HandlerFunc {
 		s.m.Respond(w, r, P{
 			Username:   q.Username,
 			ProfileURL: s.m.ClientURI() + "/todo",
-
 		}, http.StatusCreated)
 	}
 }
@@ -215,7 +233,7 @@ func (s *Service) handleTermination() http.HandlerFunc {
 
 		args := repo.UUIDArgs{ID: uid}
 		if err := s.r.UnsetProfile(r.Context(), args); err != nil {
-			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -223,21 +241,53 @@ func (s *Service) handleTermination() http.HandlerFunc {
 	}
 }
 
+// handleGetProfile is public, so the email, role and moderation
+// state of the profile are left out
 func (s *Service) handleGetProfile() http.HandlerFunc {
+	type R struct {
+		Variant string `json:"variant"`
+		Rating  int    `json:"rating"`
+		Games   int    `json:"games"`
+	}
+
+	type V struct {
+		ID       uuid.UUID `json:"id"`
+		Username string    `json:"username"`
+		Bio      string    `json:"bio"`
+		PhotoURL string    `json:"photoUrl"`
+		Ratings  []R       `json:"ratings"`
+	}
+
 	type P struct {
-		Profile *reg.Profile `json:"profile"`
+		Profile V `json:"profile"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		uid, _ := uuidFromRequest(r)
 
 		args := repo.UUIDArgs{ID: uid}
 		profile, err := s.r.GetProfile(r.Context(), args)
+		if err != nil {
+			s.m.Respond(w, r, err, errs.Status(err))
+			return
+		}
+
+		ratings, err := s.r.GetRatings(r.Context(), args)
 		if err != nil {
 			s.m.Respond(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		p := P{Profile: profile}
+		p := P{Profile: V{
+			ID:       profile.ID,
+			Username: profile.Username,
+			Bio:      profile.Bio,
+			PhotoURL: profile.PhotoURL,
+			Ratings:  []R{},
+		}}
+		for _, v := range ratings {
+			p.Profile.Ratings = append(p.Profile.Ratings, R{Variant: v.Variant, Rating: v.Rating, Games: v.Games})
+		}
+
 		s.m.Respond(w, r, p, http.StatusOK)
 	}
 }
@@ -262,7 +312,7 @@ func (s *Service) handleSetPhotoURL() http.HandlerFunc {
 		}
 
 		if err := s.r.SetPhotoURL(r.Context(), args); err != nil {
-			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -293,7 +343,7 @@ func (s *Service) handleSetProfile() http.HandlerFunc {
 		}
 
 		if err := s.r.UpdateProfile(r.Context(), args); err != nil {
-			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			s.m.Respond(w, r, err, errs.Status(err))
 			return
 		}
 
@@ -302,8 +352,238 @@ func (s *Service) handleSetProfile() http.HandlerFunc {
 	}
 }
 
+// variantFromRequest reads a variant that ratings are kept for
+func variantFromRequest(r *http.Request) (string, error) {
+	switch v := chi.URLParam(r, "variant"); game.Variant(v) {
+	case game.Classic, game.MNK, game.Ultimate:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown variant %q", v)
+	}
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageFromRequest reads the `limit` and `offset` query parameters
+func pageFromRequest(r *http.Request) (limit, offset int, err error) {
+	limit, offset = defaultPageSize, 0
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must not be negative")
+		}
+	}
+	return limit, offset, nil
+}
+
+// nextOffset is where the following page starts, or nil after the last page
+func nextOffset(n, limit, offset int) *int {
+	if n < limit {
+		return nil
+	}
+
+	next := offset + limit
+	return &next
+}
+
+func (s *Service) handleLeaderboard() http.HandlerFunc {
+	type E struct {
+		Rank     int       `json:"rank"`
+		ID       uuid.UUID `json:"id"`
+		Username string    `json:"username"`
+		Rating   int       `json:"rating"`
+		Games    int       `json:"games"`
+	}
+
+	type P struct {
+		Variant string `json:"variant"`
+		Entries []E    `json:"entries"`
+		Next    *int   `json:"next"` // offset of the next page
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		variant, err := variantFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusNotFound)
+			return
+		}
+
+		limit, offset, err := pageFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		args := repo.PageArgs{Variant: variant, Limit: limit, Offset: offset}
+		standings, err := s.r.GetLeaderboard(r.Context(), args)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		p := P{Variant: variant, Entries: make([]E, len(standings)), Next: nextOffset(len(standings), limit, offset)}
+		for i, v := range standings {
+			p.Entries[i] = E{Rank: v.Rank, ID: v.ID, Username: v.Username, Rating: v.Rating, Games: v.Games}
+		}
+
+		s.m.Respond(w, r, p, http.StatusOK)
+	}
+}
+
+func (s *Service) handleRatingHistory() http.HandlerFunc {
+	type E struct {
+		GameID   uuid.UUID `json:"gameId"`
+		Rating   int       `json:"rating"`
+		Change   int       `json:"change"`
+		PlayedAt time.Time `json:"playedAt"`
+	}
+
+	type P struct {
+		Variant string `json:"variant"`
+		Rating  int    `json:"rating"`
+		Games   int    `json:"games"`
+		History []E    `json:"history"`
+		Next    *int   `json:"next"` // offset of the next page
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := uuidFromRequest(r)
+
+		variant, err := variantFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusNotFound)
+			return
+		}
+
+		limit, offset, err := pageFromRequest(r)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		p := P{Variant: variant, Rating: reg.DefaultRating, History: []E{}}
+
+		rating, err := s.r.GetRating(r.Context(), repo.RatingArgs{ID: uid, Variant: variant})
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			// not rated yet
+			s.m.Respond(w, r, p, http.StatusOK)
+			return
+		case err != nil:
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		args := repo.PageArgs{ID: uid, Variant: variant, Limit: limit, Offset: offset}
+		changes, err := s.r.GetRatingHistory(r.Context(), args)
+		if err != nil {
+			s.m.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		p.Rating, p.Games, p.Next = rating.Rating, rating.Games, nextOffset(len(changes), limit, offset)
+		for _, v := range changes {
+			p.History = append(p.History, E{GameID: v.GameID, Rating: v.Rating, Change: v.Change, PlayedAt: v.PlayedAt})
+		}
+
+		s.m.Respond(w, r, p, http.StatusOK)
+	}
+}
+
 //  Events
 
-func (s *Service) listen() {
-	// listen to events
+func (s *Service) listen() error {
+	// the game stream keeps each result until one instance has rated it
+	if err := events.StreamGames.Add(s.e); err != nil {
+		return err
+	}
+	if err := events.TopicGameFinished.Durable(s.e, events.StreamGames, "registry-rate", s.backoff, s.handleGameFinished()); err != nil {
+		return err
+	}
+	// responds back to `match`
+	if err := events.EndpointGetRating.Handle(s.e, s.getRating()); err != nil {
+		return err
+	}
+	// responds back to `auth`
+	return events.EndpointGetProfileByEmail.Handle(s.e, s.getProfileByEmail())
+}
+
+func (s *Service) getProfileByEmail() func(ctx context.Context, q events.DataEmail) (events.DataProfile, error) {
+	return func(ctx context.Context, q events.DataEmail) (events.DataProfile, error) {
+		var d events.DataProfile
+
+		profile, err := s.r.GetProfileByEmail(ctx, repo.EmailArgs{Email: q.Email})
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			// an empty profile tells `auth` there is nobody to log in
+			return d, nil
+		case err != nil:
+			return d, fmt.Errorf("failed to get profile: %w", err)
+		}
+
+		d = events.DataProfile{
+			ID:       profile.ID,
+			Username: profile.Username,
+			Scopes:   profile.Role.Scopes(),
+			Banned:   profile.BannedAt != nil,
+		}
+		if profile.PhotoURL != "" {
+			d.PhotoURL = &profile.PhotoURL
+		}
+		return d, nil
+	}
+}
+
+// handleGameFinished rates the players of a game. A result that could not
+// be stored is returned as an error for the game stream to redeliver it,
+// while one that was already rated is done with.
+func (s *Service) handleGameFinished() func(ctx context.Context, d *events.DataGameResult) error {
+	return func(ctx context.Context, d *events.DataGameResult) error {
+		args := repo.SetResultArgs{
+			GameID:  d.ID,
+			Variant: string(d.Variant),
+			X:       d.X,
+			O:       d.O,
+			Score:   0.5,
+		}
+
+		switch d.Winner {
+		case game.X:
+			args.Score = 1
+		case game.O:
+			args.Score = 0
+		}
+
+		err := s.r.SetResult(ctx, args)
+		if pg.IsUniqueViolation(err) {
+			// delivered again after it was rated
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("rate game %s: %w", d.ID, err)
+		}
+		return nil
+	}
+}
+
+func (s *Service) getRating() func(ctx context.Context, q events.DataRatingQuery) (int, error) {
+	return func(ctx context.Context, q events.DataRatingQuery) (int, error) {
+		rating, err := s.r.GetRating(ctx, repo.RatingArgs{ID: q.ID, Variant: string(q.Variant)})
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return reg.DefaultRating, nil
+		case err != nil:
+			return 0, fmt.Errorf("failed to get rating: %w", err)
+		}
+		return rating.Rating, nil
+	}
 }
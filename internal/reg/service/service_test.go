@@ -0,0 +1,613 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/events"
+	"github.com/hyphengolang/noughts-and-crosses/internal/game"
+	"github.com/hyphengolang/noughts-and-crosses/internal/outbox"
+	pg "github.com/hyphengolang/noughts-and-crosses/internal/postgres"
+	"github.com/hyphengolang/noughts-and-crosses/internal/reg"
+	repo "github.com/hyphengolang/noughts-and-crosses/internal/reg/repository"
+	srv "github.com/hyphengolang/noughts-and-crosses/internal/reg/service"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// memRepo is an in-memory stand-in for the Postgres repository. Only
+// profiles, the outbox and the results rated are kept; ratings are
+// never found.
+type memRepo struct {
+	mu       sync.Mutex
+	profiles map[uuid.UUID]*reg.Profile
+	outbox   []outbox.Message
+	results  []repo.SetResultArgs
+	// rateErrs are returned by the next calls to SetResult
+	rateErrs []error
+}
+
+func newMemRepo(profiles ...reg.Profile) *memRepo {
+	m := &memRepo{profiles: map[uuid.UUID]*reg.Profile{}}
+	for _, p := range profiles {
+		p := p
+		m.profiles[p.ID] = &p
+	}
+	return m
+}
+
+var errUnique = &pgconn.PgError{Code: "23505"}
+
+// taken reports whether another profile has the username
+func (m *memRepo) taken(id uuid.UUID, username string) bool {
+	for _, p := range m.profiles {
+		if p.ID != id && p.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memRepo) SetProfile(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetProfileArgs)
+	if m.taken(uuid.Nil, a.Username) {
+		return errUnique
+	}
+
+	id := uuid.New()
+	m.profiles[id] = &reg.Profile{ID: id, Email: a.Email, Username: a.Username, Bio: a.Bio, Role: reg.RoleUser}
+	return nil
+}
+
+func (m *memRepo) GetProfile(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.profiles[args.(repo.UUIDArgs).ID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	v := *p
+	return &v, nil
+}
+
+func (m *memRepo) GetProfileByEmail(ctx context.Context, args pgx.QueryRewriter) (*reg.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.profiles {
+		if strings.EqualFold(p.Email, args.(repo.EmailArgs).Email) {
+			v := *p
+			return &v, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (m *memRepo) GetProfiles(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ps []*reg.Profile
+	for _, p := range m.profiles {
+		v := *p
+		ps = append(ps, &v)
+	}
+	return ps, nil
+}
+
+func (m *memRepo) UnsetProfile(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := args.(repo.UUIDArgs).ID
+	if _, ok := m.profiles[id]; !ok {
+		return pg.ErrNoRowsAffected
+	}
+	delete(m.profiles, id)
+	return m.closed(id)
+}
+
+func (m *memRepo) BanProfile(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.profiles[args.(repo.UUIDArgs).ID]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if p.BannedAt != nil {
+		return pg.ErrNoRowsAffected
+	}
+	now := time.Now()
+	p.BannedAt = &now
+	return m.closed(p.ID)
+}
+
+// closed enqueues the event that ends the sessions of the profile
+func (m *memRepo) closed(id uuid.UUID) error {
+	msg, err := outbox.NewMessage(events.TopicProfileClosed, events.DataProfileClosed{ID: id})
+	if err != nil {
+		return err
+	}
+	m.outbox = append(m.outbox, msg)
+	return nil
+}
+
+func (m *memRepo) Enqueue(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outbox = append(m.outbox, args.(outbox.Message))
+	return nil
+}
+
+// enqueued returns the messages sent to the subject
+func (m *memRepo) enqueued(subject string) []outbox.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ms []outbox.Message
+	for _, msg := range m.outbox {
+		if msg.Subject == subject {
+			ms = append(ms, msg)
+		}
+	}
+	return ms
+}
+
+func (m *memRepo) UpdateProfile(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.UpdateProfileArgs)
+	p, ok := m.profiles[a.ID]
+	if !ok {
+		return pg.ErrNoRowsAffected
+	}
+	if m.taken(a.ID, a.Username) {
+		return errUnique
+	}
+	p.Username, p.Bio = a.Username, a.Bio
+	return nil
+}
+
+func (m *memRepo) SetPhotoURL(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := args.(repo.SetPhotoURLArgs)
+	p, ok := m.profiles[a.ID]
+	if !ok {
+		return pg.ErrNoRowsAffected
+	}
+	p.PhotoURL = a.PhotoURL
+	return nil
+}
+
+func (m *memRepo) SetResult(ctx context.Context, args pgx.QueryRewriter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.rateErrs) > 0 {
+		err := m.rateErrs[0]
+		m.rateErrs = m.rateErrs[1:]
+		return err
+	}
+	m.results = append(m.results, args.(repo.SetResultArgs))
+	return nil
+}
+
+// rated returns the results stored for the game
+func (m *memRepo) rated(id uuid.UUID) []repo.SetResultArgs {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rs []repo.SetResultArgs
+	for _, r := range m.results {
+		if r.GameID == id {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// failRate makes the next calls to SetResult return `errs`
+func (m *memRepo) failRate(errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rateErrs = errs
+}
+
+// rateFailures is how many errors SetResult has still to return
+func (m *memRepo) rateFailures() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.rateErrs)
+}
+
+func (m *memRepo) GetRating(ctx context.Context, args pgx.QueryRewriter) (*reg.Rating, error) {
+	return nil, pgx.ErrNoRows
+}
+
+func (m *memRepo) GetRatings(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Rating, error) {
+	return nil, nil
+}
+
+func (m *memRepo) GetLeaderboard(ctx context.Context, args pgx.QueryRewriter) ([]*reg.Standing, error) {
+	return nil, nil
+}
+
+func (m *memRepo) GetRatingHistory(ctx context.Context, args pgx.QueryRewriter) ([]*reg.RatingChange, error) {
+	return nil, nil
+}
+
+func accessToken(t *testing.T, tk token.Client, uid uuid.UUID, role reg.Role) string {
+	p, err := tk.SignToken(context.Background(), token.WithEnd(time.Minute), token.WithSubject(uid.String()), token.WithClaims(token.PrivateClaims{"scope": strings.Join(role.Scopes(), " ")}), token.WithPurpose(token.PurposeAccess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func do(t *testing.T, method, url, tk string, body any) *http.Response {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req, _ := http.NewRequest(method, url, &buf)
+	if tk != "" {
+		req.Header.Set("Authorization", "Bearer "+tk)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// runJetStream starts a NATS server with JetStream, which keeps game results
+func runJetStream(t *testing.T) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	ns := natsserver.RunServer(&opts)
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func TestProfile(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	johnDoe, janeDoe := uuid.New(), uuid.New()
+	mem := newMemRepo(
+		reg.Profile{ID: johnDoe, Email: "john@doe.com", Username: "john123doe", Role: reg.RoleUser},
+		reg.Profile{ID: janeDoe, Email: "jane@doe.com", Username: "jane123doe", Role: reg.RoleUser},
+	)
+
+	tk := token.NewTokenClient()
+	s, err := srv.New(events.NewClient(ec), tk, mem)
+	is.NoErr(err) // subscribe
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	john := accessToken(t, tk, johnDoe, reg.RoleUser)
+	profile := ts.URL + "/users/" + johnDoe.String() + "/profile"
+
+	t.Run("get a profile", func(t *testing.T) {
+		res := do(t, http.MethodGet, profile, "", nil)
+		is.Equal(res.StatusCode, http.StatusOK) // anyone can read
+
+		var body struct {
+			Profile map[string]any `json:"profile"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&body))
+		is.Equal(body.Profile["username"], "john123doe") // public fields
+		_, ok := body.Profile["email"]
+		is.True(!ok) // email is private
+		_, ok = body.Profile["role"]
+		is.True(!ok) // and so is the role
+		_, ok = body.Profile["bannedAt"]
+		is.True(!ok) // and moderation
+
+		res = do(t, http.MethodGet, ts.URL+"/users/"+uuid.NewString()+"/profile", "", nil)
+		is.Equal(res.StatusCode, http.StatusNotFound) // unknown profile
+	})
+
+	t.Run("update your own profile", func(t *testing.T) {
+		res := do(t, http.MethodPost, profile, john, map[string]string{"username": "john456doe", "bio": "plays noughts"})
+		is.Equal(res.StatusCode, http.StatusOK) // updated
+
+		p, err := mem.GetProfile(context.Background(), repo.UUIDArgs{ID: johnDoe})
+		is.NoErr(err)                      // get profile
+		is.Equal(p.Username, "john456doe") // username changed
+		is.Equal(p.Bio, "plays noughts")   // bio changed
+	})
+
+	t.Run("only the owner can change a profile", func(t *testing.T) {
+		res := do(t, http.MethodPost, profile, "", map[string]string{"username": "hacked"})
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // not signed in
+
+		jane := accessToken(t, tk, janeDoe, reg.RoleUser)
+		res = do(t, http.MethodPost, profile, jane, map[string]string{"username": "hacked"})
+		is.Equal(res.StatusCode, http.StatusForbidden) // not john
+
+		res = do(t, http.MethodDelete, ts.URL+"/users/"+johnDoe.String(), jane, nil)
+		is.Equal(res.StatusCode, http.StatusForbidden) // not john
+	})
+
+	t.Run("usernames are unique", func(t *testing.T) {
+		res := do(t, http.MethodPost, profile, john, map[string]string{"username": "jane123doe"})
+		is.Equal(res.StatusCode, http.StatusConflict) // taken by jane
+	})
+
+	t.Run("delete your own profile", func(t *testing.T) {
+		res := do(t, http.MethodDelete, ts.URL+"/users/"+johnDoe.String(), john, nil)
+		is.Equal(res.StatusCode, http.StatusOK) // deleted
+
+		res = do(t, http.MethodDelete, ts.URL+"/users/"+johnDoe.String(), john, nil)
+		is.Equal(res.StatusCode, http.StatusNotFound) // already deleted
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	johnDoe := uuid.New()
+	mem := newMemRepo(reg.Profile{ID: johnDoe, Email: "john@doe.com", Username: "john123doe", Role: reg.RoleUser})
+
+	tk := token.NewTokenClient()
+	s, err := srv.New(events.NewClient(ec), tk, mem)
+	is.NoErr(err) // subscribe
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	user := accessToken(t, tk, uuid.New(), reg.RoleUser)
+	moderator := accessToken(t, tk, uuid.New(), reg.RoleModerator)
+	admin := accessToken(t, tk, uuid.New(), reg.RoleAdmin)
+
+	t.Run("list users", func(t *testing.T) {
+		res := do(t, http.MethodGet, ts.URL+"/admin/users", user, nil)
+		is.Equal(res.StatusCode, http.StatusForbidden) // users cannot
+
+		res = do(t, http.MethodGet, ts.URL+"/admin/users", moderator, nil)
+		is.Equal(res.StatusCode, http.StatusOK) // moderators can
+	})
+
+	t.Run("ban a user", func(t *testing.T) {
+		res := do(t, http.MethodPost, ts.URL+"/admin/users/"+johnDoe.String()+"/ban", user, nil)
+		is.Equal(res.StatusCode, http.StatusForbidden) // users cannot
+
+		res = do(t, http.MethodPost, ts.URL+"/admin/users/"+johnDoe.String()+"/ban", moderator, nil)
+		is.Equal(res.StatusCode, http.StatusNoContent) // banned
+
+		ms := mem.enqueued(events.EventProfileClosed)
+		is.Equal(len(ms), 1) // sessions are ended
+
+		var d events.DataProfileClosed
+		is.NoErr(json.Unmarshal(ms[0].Payload, &d)) // decode event
+		is.Equal(d.ID, johnDoe)                     // of the banned user
+
+		res = do(t, http.MethodPost, ts.URL+"/admin/users/"+johnDoe.String()+"/ban", moderator, nil)
+		is.Equal(res.StatusCode, http.StatusNoContent)            // banning twice is not an error
+		is.Equal(len(mem.enqueued(events.EventProfileClosed)), 1) // nor closes the profile again
+
+		res = do(t, http.MethodPost, ts.URL+"/admin/users/"+uuid.NewString()+"/ban", moderator, nil)
+		is.Equal(res.StatusCode, http.StatusNotFound) // no such user
+	})
+
+	t.Run("delete any user", func(t *testing.T) {
+		res := do(t, http.MethodDelete, ts.URL+"/admin/users/"+johnDoe.String(), moderator, nil)
+		is.Equal(res.StatusCode, http.StatusForbidden) // moderators cannot
+
+		res = do(t, http.MethodDelete, ts.URL+"/admin/users/"+johnDoe.String(), admin, nil)
+		is.Equal(res.StatusCode, http.StatusOK)                   // deleted
+		is.Equal(len(mem.enqueued(events.EventProfileClosed)), 2) // sessions are ended
+	})
+}
+
+func TestVerifySignup(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	tk := token.NewTokenClient()
+	s, err := srv.New(events.NewClient(ec), tk, newMemRepo())
+	is.NoErr(err) // subscribe
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	verify := func(link string) (*http.Response, service.Problem) {
+		res := do(t, http.MethodGet, ts.URL+"/signup", link, nil)
+
+		var p service.Problem
+		if res.StatusCode != http.StatusOK {
+			is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+		}
+		return res, p
+	}
+
+	t.Run("auth is unavailable", func(t *testing.T) {
+		res, p := verify("link")
+		is.Equal(res.StatusCode, http.StatusServiceUnavailable) // nobody answered
+		is.Equal(p.Code, errs.Unavailable)                      // code
+	})
+
+	// stands in for auth
+	sub, err := ec.Subscribe(events.EventVerifySignupToken, func(subj, reply string, q *events.DataToken) {
+		var d events.Data[string]
+
+		switch string(q.Token) {
+		case "expired":
+			ec.Publish(reply, d.Fail(errs.New(errs.TokenExpired, "token expired")))
+		case "used":
+			ec.Publish(reply, d.Fail(errs.New(errs.TokenInvalid, "link was already used")))
+		default:
+			d.Value = "john@doe.com"
+			ec.Publish(reply, d)
+		}
+	})
+	is.NoErr(err) // answer verify requests
+	t.Cleanup(func() { sub.Unsubscribe() })
+	is.NoErr(nc.Flush())
+
+	t.Run("the link expired", func(t *testing.T) {
+		res, p := verify("expired")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // status
+		is.Equal(p.Code, errs.TokenExpired)               // told apart from other failures
+	})
+
+	t.Run("the link was used", func(t *testing.T) {
+		res, p := verify("used")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // status
+		is.Equal(p.Code, errs.TokenInvalid)               // code
+	})
+
+	t.Run("the link is valid", func(t *testing.T) {
+		res, _ := verify("valid")
+		is.Equal(res.StatusCode, http.StatusOK) // verified
+	})
+}
+
+func TestSignUp(t *testing.T) {
+	is := is.New(t)
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+
+	mem := newMemRepo()
+	s, err := srv.New(events.NewClient(ec), token.NewTokenClient(), mem)
+	is.NoErr(err) // subscribe
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	// nobody is listening for the email, the outbox keeps it
+	res := do(t, http.MethodPost, ts.URL+"/signup", "", map[string]string{"email": "john@doe.com"})
+	is.Equal(res.StatusCode, http.StatusAccepted) // accepted
+
+	ms := mem.enqueued(events.EventSendSignupConfirm)
+	is.Equal(len(ms), 1) // email is waiting in the outbox
+
+	var v events.DataEmail
+	is.NoErr(json.Unmarshal(ms[0].Payload, &v)) // payload
+	is.Equal(v.Email, "john@doe.com")
+}
+
+func TestGameFinished(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	ns := runJetStream(t)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	is.NoErr(err) // connect to nats
+	t.Cleanup(nc.Close)
+
+	ec, err := nats.NewEncodedConn(nc, events.JSON_ENCODER)
+	is.NoErr(err) // encoded connection
+	b := events.NewClient(ec)
+
+	mem := newMemRepo()
+	_, err = srv.New(b, token.NewTokenClient(), mem, srv.WithBackoff(10*time.Millisecond, 20*time.Millisecond))
+	is.NoErr(err) // subscribe
+
+	finish := func(winner game.Player) uuid.UUID {
+		d := events.DataGameResult{ID: uuid.New(), Variant: game.Classic, X: uuid.New(), O: uuid.New(), Winner: winner}
+		is.NoErr(events.TopicGameFinished.Store(ctx, b, d)) // publish result
+		return d.ID
+	}
+
+	waitFor := func(done func() bool) {
+		for deadline := time.Now().Add(2 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("result was not handled")
+			}
+		}
+	}
+
+	t.Run("rate the players", func(t *testing.T) {
+		id := finish(game.X)
+		waitFor(func() bool { return len(mem.rated(id)) > 0 })
+
+		rs := mem.rated(id)
+		is.Equal(len(rs), 1)       // rated once
+		is.Equal(rs[0].Score, 1.0) // X won
+	})
+
+	t.Run("retry a result that could not be stored", func(t *testing.T) {
+		mem.failRate(errs.New(errs.Unavailable, "database is down"))
+
+		id := finish(game.NoPlayer)
+		waitFor(func() bool { return len(mem.rated(id)) > 0 })
+
+		rs := mem.rated(id)
+		is.Equal(len(rs), 1)       // rated on the retry
+		is.Equal(rs[0].Score, 0.5) // a draw
+	})
+
+	t.Run("a result already rated is done with", func(t *testing.T) {
+		mem.failRate(errUnique)
+
+		id := finish(game.O)
+		waitFor(func() bool { return mem.rateFailures() == 0 })
+
+		// a retry would be stored, as there are no more failures
+		time.Sleep(100 * time.Millisecond)
+		is.Equal(len(mem.rated(id)), 0) // not delivered again
+	})
+}
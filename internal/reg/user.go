@@ -1,6 +1,10 @@
 package reg
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Profile struct {
 	ID       uuid.UUID
@@ -8,4 +12,7 @@ type Profile struct {
 	Username string
 	Bio      string
 	PhotoURL string
+	Role     Role
+	// BannedAt is nil unless the user has been banned
+	BannedAt *time.Time
 }
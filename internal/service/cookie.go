@@ -0,0 +1,100 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Cookies set when a session uses cookies instead of bearer tokens.
+// Only the CSRF cookie can be read by scripts, so that they can copy
+// it into the `CSRFHeader` of requests that change something.
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFCookie         = "csrf_token"
+	CSRFHeader         = "X-CSRF-Token"
+)
+
+var ErrCSRF = errs.New(errs.Unauthenticated, "missing or invalid CSRF token")
+
+// NewCSRFToken returns a random value for the double-submit CSRF check
+func NewCSRFToken() (string, error) {
+	p := make([]byte, 32)
+	if _, err := rand.Read(p); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(p), nil
+}
+
+// NewCookie returns a Secure, HttpOnly cookie that lasts for `ttl`. A
+// negative `ttl` deletes the cookie.
+func NewCookie(name, value string, ttl time.Duration) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if ttl < 0 {
+		c.MaxAge = -1
+	} else {
+		c.MaxAge = int(ttl.Seconds())
+	}
+	return c
+}
+
+// VerifyCSRF checks that the `CSRFHeader` matches the `CSRFCookie`. A page
+// on another site can make the browser send the cookie, but cannot read
+// it to set the header.
+func VerifyCSRF(r *http.Request) error {
+	c, err := r.Cookie(CSRFCookie)
+	if err != nil || c.Value == "" {
+		return ErrCSRF
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.Header.Get(CSRFHeader))) != 1 {
+		return ErrCSRF
+	}
+	return nil
+}
+
+// ParseRequest reads the token from the `Authorization` header or, if there
+// is none, from the named cookie. Requests using the cookie that are not safe
+// to repeat must pass the CSRF check.
+func ParseRequest(t token.Client, r *http.Request, cookieName string, opts ...jwt.ParseOption) (jwt.Token, error) {
+	if r.Header.Get("Authorization") != "" {
+		tk, err := t.ParseRequest(r, opts...)
+		return tk, errs.Token(err)
+	}
+
+	if !HasCookie(r, cookieName) {
+		return nil, errs.Errorf(errs.Unauthenticated, "no bearer token or %s cookie", cookieName)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if err := VerifyCSRF(r); err != nil {
+			return nil, err
+		}
+	}
+
+	tk, err := t.ParseCookie(r, cookieName, opts...)
+	return tk, errs.Token(err)
+}
+
+// HasCookie reports whether the request carries the named cookie
+func HasCookie(r *http.Request, name string) bool {
+	_, err := r.Cookie(name)
+	return err == nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
 )
 
 // PathParam is a middleware that parses a path parameter and stores it in the request context.
@@ -15,7 +18,7 @@ func PathParam[T any](key string, parser func(r *http.Request, key string) (T, e
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			value, err := parser(r, key)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				WriteProblem(w, r, err, http.StatusBadRequest)
 				return
 			}
 
@@ -44,12 +47,12 @@ func UUIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uid, err := uuid.Parse(chi.URLParam(r, "uuid"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			WriteProblem(w, r, err, http.StatusBadRequest)
 			return
 		}
 
 		if uid == uuid.Nil {
-			http.Error(w, "invalid uuid", http.StatusBadRequest)
+			WriteProblem(w, r, errs.New(errs.InvalidArgument, "invalid uuid"), http.StatusBadRequest)
 			return
 		}
 
@@ -70,11 +73,96 @@ func UUIDFromContext(ctx context.Context) (uuid.UUID, error) {
 	return uid, nil
 }
 
+// Principal is the verified user making a request
+type Principal struct {
+	ID       uuid.UUID
+	Username string
+	Scopes   []string
+}
+
+// Authenticate is a middleware that verifies the access token, sent either as
+// a bearer token or as a cookie, and stores the `Principal` in the request context.
+func Authenticate(t token.Client) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tk, err := ParseRequest(t, r, AccessTokenCookie, token.RequirePurpose(token.PurposeAccess))
+			if err != nil {
+				WriteProblem(w, r, err, http.StatusUnauthorized)
+				return
+			}
+
+			uid, err := uuid.Parse(tk.Subject())
+			if err != nil || uid == uuid.Nil {
+				WriteProblem(w, r, errs.New(errs.TokenInvalid, "invalid subject"), http.StatusUnauthorized)
+				return
+			}
+
+			p := &Principal{ID: uid}
+			p.Username, _ = tk.PrivateClaims()["username"].(string)
+			// space separated, as in RFC 8693
+			if scope, _ := tk.PrivateClaims()["scope"].(string); scope != "" {
+				p.Scopes = strings.Fields(scope)
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasScope reports whether the user was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope implements Router. Requests without a `Principal` are
+// unauthorized and those missing a scope are forbidden.
+func (rh *routerHandler) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := PrincipalFromRequest(r)
+			if err != nil {
+				WriteProblem(w, r, err, http.StatusUnauthorized)
+				return
+			}
+
+			for _, scope := range scopes {
+				if !p.HasScope(scope) {
+					WriteProblem(w, r, errs.Errorf(errs.PermissionDenied, "missing scope %q", scope), http.StatusForbidden)
+					return
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PrincipalFromRequest retrieves the verified user from the request context.
+func PrincipalFromRequest(r *http.Request) (*Principal, error) {
+	return PrincipalFromContext(r.Context())
+}
+
+// PrincipalFromContext retrieves the verified user from the request context.
+func PrincipalFromContext(ctx context.Context) (*Principal, error) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	if !ok {
+		return nil, fmt.Errorf("principal not found in context")
+	}
+	return p, nil
+}
+
 type contextKey string
 
 const (
 	uuidKey      = contextKey("uuid")
 	pathParamKey = contextKey("path-param")
+	principalKey = contextKey("principal")
 )
 
 func (k contextKey) String() string {
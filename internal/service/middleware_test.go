@@ -0,0 +1,133 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	token "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestAuthenticate(t *testing.T) {
+	is := is.New(t)
+
+	tk := token.NewTokenClient()
+
+	mux := service.NewRouter()
+	mux.With(service.Authenticate(tk)).Post("/", func(w http.ResponseWriter, r *http.Request) {
+		p, err := service.PrincipalFromRequest(r)
+		if err != nil {
+			mux.Respond(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		mux.Respond(w, r, p, http.StatusOK)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	johnDoe := uuid.New()
+	sign := func(purpose token.Purpose) string {
+		p, err := tk.SignToken(context.Background(),
+			token.WithEnd(time.Minute),
+			token.WithSubject(johnDoe.String()),
+			token.WithClaims(token.PrivateClaims{"username": "john123doe", "scope": "games:play registry:read"}),
+			token.WithPurpose(purpose),
+		)
+		is.NoErr(err) // sign token
+		return string(p)
+	}
+
+	do := func(req *http.Request) *http.Response {
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err) // send request
+		return res
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+sign(token.PurposeAccess))
+
+		res := do(req)
+		is.Equal(res.StatusCode, http.StatusOK) // authenticated
+
+		var p service.Principal
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+		is.Equal(p.ID, johnDoe)                                     // subject
+		is.Equal(p.Username, "john123doe")                          // username
+		is.Equal(p.Scopes, []string{"games:play", "registry:read"}) // scopes
+	})
+
+	t.Run("cookie with the CSRF header", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.AddCookie(&http.Cookie{Name: service.AccessTokenCookie, Value: sign(token.PurposeAccess)})
+		req.AddCookie(&http.Cookie{Name: service.CSRFCookie, Value: "secret"})
+		req.Header.Set(service.CSRFHeader, "secret")
+
+		res := do(req)
+		is.Equal(res.StatusCode, http.StatusOK) // authenticated
+	})
+
+	t.Run("reject a missing token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+
+		res := do(req)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // no token
+	})
+
+	t.Run("reject a refresh token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+sign(token.PurposeRefresh))
+
+		res := do(req)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // wrong purpose
+	})
+
+	t.Run("no principal without the middleware", func(t *testing.T) {
+		_, err := service.PrincipalFromContext(context.Background())
+		is.True(err != nil) // not authenticated
+	})
+}
+
+func TestRequireScope(t *testing.T) {
+	is := is.New(t)
+
+	tk := token.NewTokenClient()
+
+	mux := service.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	mux.With(mux.RequireScope("games:play")).Get("/anonymous", ok)
+	a := mux.With(service.Authenticate(tk))
+	a.With(mux.RequireScope("games:play")).Get("/play", ok)
+	a.With(mux.RequireScope("users:read", "users:ban")).Get("/ban", ok)
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	p, err := tk.SignToken(context.Background(),
+		token.WithEnd(time.Minute),
+		token.WithSubject(uuid.NewString()),
+		token.WithClaims(token.PrivateClaims{"scope": "games:play users:read"}),
+		token.WithPurpose(token.PurposeAccess),
+	)
+	is.NoErr(err) // sign token
+
+	get := func(path string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+string(p))
+
+		res, err := http.DefaultClient.Do(req)
+		is.NoErr(err) // send request
+		return res.StatusCode
+	}
+
+	is.Equal(get("/play"), http.StatusNoContent)         // has the scope
+	is.Equal(get("/ban"), http.StatusForbidden)          // needs every scope
+	is.Equal(get("/anonymous"), http.StatusUnauthorized) // not authenticated
+}
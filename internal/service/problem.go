@@ -0,0 +1,64 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+)
+
+// ContentTypeProblem is the media type of a `Problem`
+const ContentTypeProblem = "application/problem+json"
+
+// Problem is the body of a failed response, as in RFC 7807. Code is an
+// extension member that clients can rely on, unlike Detail.
+type Problem struct {
+	Type     string    `json:"type"`
+	Title    string    `json:"title"`
+	Status   int       `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Code     errs.Code `json:"code"`
+}
+
+// NewProblem describes `err` for a response with the status. An error
+// without a code is given the one that matches the status, while an error
+// with a code replaces a catch-all 500 with the status of the code. The
+// detail of internal errors is logged rather than shown to the client.
+func NewProblem(r *http.Request, err error, status int) *Problem {
+	e := errs.From(err)
+	switch {
+	case e.Code == errs.Internal:
+		e.Code = errs.CodeFor(status)
+	case status == http.StatusInternalServerError:
+		status = e.Code.Status()
+	}
+
+	p := &Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   e.Msg,
+		Instance: r.URL.Path,
+		Code:     e.Code,
+	}
+
+	if status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		p.Detail = ""
+	}
+	return p
+}
+
+// WriteProblem responds with the `Problem` for `err`. Middleware
+// that cannot reach a `Router` use it in place of `http.Error`.
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error, status int) {
+	p := NewProblem(r, err, status)
+
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Printf("write problem: %v", err)
+	}
+}
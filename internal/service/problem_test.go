@@ -0,0 +1,63 @@
+package service_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hyphengolang/noughts-and-crosses/internal/errs"
+	"github.com/hyphengolang/noughts-and-crosses/internal/service"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestProblem(t *testing.T) {
+	is := is.New(t)
+
+	mux := service.NewRouter()
+	mux.Get("/missing", func(w http.ResponseWriter, r *http.Request) {
+		mux.Respond(w, r, errors.New("no such thing"), http.StatusNotFound)
+	})
+	mux.Get("/expired", func(w http.ResponseWriter, r *http.Request) {
+		mux.Respond(w, r, errs.New(errs.TokenExpired, "token expired"), http.StatusInternalServerError)
+	})
+	mux.Get("/broken", func(w http.ResponseWriter, r *http.Request) {
+		mux.Respond(w, r, errors.New("password=hunter2"), http.StatusInternalServerError)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	get := func(path string) (*http.Response, service.Problem) {
+		res, err := http.Get(ts.URL + path)
+		is.NoErr(err) // send request
+
+		var p service.Problem
+		is.NoErr(json.NewDecoder(res.Body).Decode(&p))
+		return res, p
+	}
+
+	t.Run("errors without a code take it from the status", func(t *testing.T) {
+		res, p := get("/missing")
+		is.Equal(res.Header.Get("Content-Type"), service.ContentTypeProblem) // problem+json
+		is.Equal(res.StatusCode, http.StatusNotFound)                        // status
+		is.Equal(p.Status, http.StatusNotFound)                              // status in the body
+		is.Equal(p.Code, errs.NotFound)                                      // code
+		is.Equal(p.Detail, "no such thing")                                  // detail
+		is.Equal(p.Instance, "/missing")                                     // instance
+	})
+
+	t.Run("errors with a code replace a catch-all status", func(t *testing.T) {
+		res, p := get("/expired")
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // status of the code
+		is.Equal(p.Code, errs.TokenExpired)               // code
+	})
+
+	t.Run("internal errors are not shown", func(t *testing.T) {
+		res, p := get("/broken")
+		is.Equal(res.StatusCode, http.StatusInternalServerError) // status
+		is.Equal(p.Code, errs.Internal)                          // code
+		is.Equal(p.Detail, "")                                   // hidden
+	})
+}
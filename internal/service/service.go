@@ -12,12 +12,18 @@ import (
 type Router interface {
 	chi.Router
 
+	// Respond writes `data` as JSON. Errors are written as a `Problem`,
+	// see `NewProblem` for how the status and code are chosen.
 	Respond(w http.ResponseWriter, r *http.Request, data any, status int)
 	Decode(w http.ResponseWriter, r *http.Request, data any) error
 
 	SetLocation(w http.ResponseWriter, r *http.Request, location string)
 	SetCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie)
 
+	// RequireScope is a middleware that only lets through a `Principal`
+	// with every one of the scopes. It must run after `Authenticate`.
+	RequireScope(scopes ...string) func(http.Handler) http.Handler
+
 	Log(v ...any)
 	Logf(format string, v ...any)
 
@@ -30,7 +36,12 @@ func (*routerHandler) Decode(w http.ResponseWriter, r *http.Request, data any) e
 	return h.Decode(w, r, data)
 }
 
+// Respond writes `data` as JSON, or as a `Problem` if it is an error
 func (*routerHandler) Respond(w http.ResponseWriter, r *http.Request, data any, status int) {
+	if err, ok := data.(error); ok {
+		WriteProblem(w, r, err, status)
+		return
+	}
 	h.Respond(w, r, data, status)
 }
 
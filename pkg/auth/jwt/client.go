@@ -2,10 +2,17 @@ package jsonwebtoken
 
 import (
 	"context"
+	"errors"
 	"io"
+	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 
 	keys "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt/jwk"
@@ -14,86 +21,363 @@ import (
 type ClientOption func(*tokenClient)
 
 func WithRandReader(r io.Reader) ClientOption {
-	var err error
 	return func(c *tokenClient) {
-		c.key, err = keys.ES256Key(r)
+		src, err := keys.Generate(jwa.ES256, r)
 		if err != nil {
 			panic(err)
 		}
+		c.src = src
 	}
 }
 
 func WithPEM(s string) ClientOption {
-	var err error
 	return func(c *tokenClient) {
-		c.key, err = keys.FromPEM(s)
+		src, err := keys.PEM(s)
 		if err != nil {
 			panic(err)
 		}
+		c.src = src
 	}
 }
 
+// WithSource reads the signing keys from `src`, such as a file that
+// may change. When the first key of the source changes, the old key
+// is rotated out as if by `Rotate`. The other keys of the source
+// verify tokens for as long as the source has them.
+func WithSource(src keys.Source) ClientOption {
+	return func(c *tokenClient) { c.src = src }
+}
+
+// WithRotation replaces the signing key with a new one every `d`. A key
+// that is rotated out keeps verifying for `maxAge`, which should be the
+// longest lifetime of any token it signed. New keys are generated by each
+// client and never shared, so rotation only suits a single instance; several
+// instances should share a `WithSource`, such as a `keys.SetFile` whose
+// keys are rotated by replacing the file.
+func WithRotation(d, maxAge time.Duration) ClientOption {
+	return func(c *tokenClient) {
+		c.rotate = d
+		c.maxAge = maxAge
+	}
+}
+
+// WithIssuer sets the `iss` claim of signed tokens, and the issuer
+// that parsed tokens must have
+func WithIssuer(iss string) ClientOption {
+	return func(c *tokenClient) { c.iss = iss }
+}
+
+// WithAudience sets the `aud` claim of signed tokens, and the
+// audience that parsed tokens must include
+func WithAudience(aud string) ClientOption {
+	return func(c *tokenClient) { c.aud = aud }
+}
+
+// WithAlgorithms sets the only signature algorithms that parsed tokens
+// may use. By default any algorithm of a known key is accepted.
+func WithAlgorithms(algs ...jwa.SignatureAlgorithm) ClientOption {
+	return func(c *tokenClient) { c.algs = algs }
+}
+
+// WithLeeway allows for clocks of different machines being out by up to `d`
+// when checking the `exp`, `nbf` and `iat` claims of parsed tokens.
+func WithLeeway(d time.Duration) ClientOption {
+	return func(c *tokenClient) { c.leeway = d }
+}
+
+// Client signs and parses tokens. Parsing checks the signature, the time
+// claims, the issuer and the audience; options such as `RequirePurpose`
+// add further checks.
 type Client interface {
-	ParseToken(token []byte) (jwt.Token, error)
+	ParseToken(token []byte, opts ...jwt.ParseOption) (jwt.Token, error)
 	// ParseRequest parses the request and returns the token
 	// if the token is valid, and returns an error otherwise
-	ParseRequest(r *http.Request) (jwt.Token, error)
+	ParseRequest(r *http.Request, opts ...jwt.ParseOption) (jwt.Token, error)
 	// ParseCookie parses the cookie and returns the token
 	// if the token is valid, and returns an error otherwise
-	ParseCookie(r *http.Request, cookieName string) (jwt.Token, error)
+	ParseCookie(r *http.Request, cookieName string, opts ...jwt.ParseOption) (jwt.Token, error)
 	// SignToken generates a token with the given duration
 	// and subject. The token is signed with the key provided
 	SignToken(ctx context.Context, opts ...BuildOption) ([]byte, error)
+	// PublicKeys returns the keys that tokens are verified with,
+	// identified by the `kid` in each token's header
+	PublicKeys() jwk.Set
+	// Rotate signs new tokens with a new key. Tokens signed
+	// with the old key can still be verified for a while.
+	Rotate() error
 }
 
 type tokenClient struct {
+	src keys.Source
+	// from is the `kid` of the key the source last gave to sign with
+	from string
+	// verify are the other keys the source last gave
+	verify []jwk.Key
+
+	mu  sync.RWMutex
 	key jwk.Key
+	set jwk.Set
+	// retired maps the `kid` of each rotated out key to when it was rotated
+	retired map[string]time.Time
+
+	rotate, maxAge time.Duration
+
+	iss, aud string
+	algs     []jwa.SignatureAlgorithm
+	leeway   time.Duration
 }
 
+var ErrAlgorithm = errors.New("token is signed with an algorithm that is not accepted")
+
 // ValidateRequest implements TokenClient
-func (c *tokenClient) ParseRequest(r *http.Request) (jwt.Token, error) {
-	key, err := c.key.PublicKey()
-	if err != nil {
-		return nil, err
+func (c *tokenClient) ParseRequest(r *http.Request, opts ...jwt.ParseOption) (jwt.Token, error) {
+	v := strings.TrimSpace(r.Header.Get("Authorization"))
+	if v == "" {
+		return nil, errors.New(`empty header (Authorization)`)
 	}
 
-	return ParseRequest(r, key)
+	return c.ParseToken([]byte(strings.TrimSpace(strings.TrimPrefix(v, "Bearer"))), opts...)
 }
 
-func (c *tokenClient) ParseToken(token []byte) (jwt.Token, error) {
-	key, err := c.key.PublicKey()
-	if err != nil {
+func (c *tokenClient) ParseToken(token []byte, opts ...jwt.ParseOption) (jwt.Token, error) {
+	if len(c.algs) > 0 {
+		msg, err := jws.Parse(token)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sig := range msg.Signatures() {
+			if !c.accepts(sig.ProtectedHeaders().Algorithm()) {
+				return nil, ErrAlgorithm
+			}
+		}
+	}
+
+	if err := c.refresh(); err != nil {
 		return nil, err
 	}
 
-	return ParseToken(token, key)
+	// selects the key by the `kid` of the token. Tokens signed
+	// before keys had ids are tried against every key.
+	po := []jwt.ParseOption{
+		jwt.WithKeySet(c.PublicKeys(), jws.WithRequireKid(false)),
+		jwt.WithIssuer(c.iss),
+		jwt.WithAudience(c.aud),
+		jwt.WithAcceptableSkew(c.leeway),
+	}
+
+	return jwt.Parse(token, append(po, opts...)...)
 }
 
-func (c *tokenClient) ParseCookie(r *http.Request, cookieName string) (jwt.Token, error) {
-	key, err := c.key.PublicKey()
+func (c *tokenClient) ParseCookie(r *http.Request, cookieName string, opts ...jwt.ParseOption) (jwt.Token, error) {
+	ck, err := r.Cookie(cookieName)
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseCookie(r, key, cookieName)
+	return c.ParseToken([]byte(ck.Value), opts...)
+}
+
+func (c *tokenClient) accepts(alg jwa.SignatureAlgorithm) bool {
+	for _, a := range c.algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
 }
 
 // GenerateToken implements TokenClient
 func (c *tokenClient) SignToken(ctx context.Context, opts ...BuildOption) ([]byte, error) {
-	return SignToken(ctx, c.key, opts...)
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	key := c.key
+	c.mu.RUnlock()
+
+	// the caller cannot override who the token is from and for
+	opts = append(opts, issuer(c.iss), audience(c.aud))
+	return SignToken(ctx, key, opts...)
+}
+
+func (c *tokenClient) PublicKeys() jwk.Set {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.set
+}
+
+// Rotate generates a key that signs with the same algorithm as the current one
+func (c *tokenClient) Rotate() error {
+	c.mu.RLock()
+	alg, err := keys.Algorithm(c.key)
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	key, err := keys.NewKey(alg, nil)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.sign(key); err != nil {
+		return err
+	}
+	return c.rebuild()
+}
+
+// refresh starts signing with the first key of the source if it has changed.
+// The other keys of the source replace those it gave before to verify tokens.
+func (c *tokenClient) refresh() error {
+	ks, err := c.src.Keys()
+	if err != nil {
+		return err
+	}
+
+	if len(ks) == 0 {
+		return keys.ErrNoKeys
+	}
+
+	c.mu.RLock()
+	same := c.unchanged(ks)
+	c.mu.RUnlock()
+	if same {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.unchanged(ks) {
+		// another goroutine got here first
+		return nil
+	}
+
+	if ks[0].KeyID() != c.from {
+		if err := c.sign(ks[0]); err != nil {
+			return err
+		}
+	}
+
+	c.from = ks[0].KeyID()
+	c.verify = ks[1:]
+	return c.rebuild()
+}
+
+// unchanged reports whether the source gave the same keys as last time.
+// The caller must hold c.mu.
+func (c *tokenClient) unchanged(ks []jwk.Key) bool {
+	if ks[0].KeyID() != c.from || len(ks)-1 != len(c.verify) {
+		return false
+	}
+	for i, k := range ks[1:] {
+		if k.KeyID() != c.verify[i].KeyID() {
+			return false
+		}
+	}
+	return true
+}
+
+// sign makes the key sign new tokens, retiring the current key.
+// The caller must hold c.mu unless no other goroutine can see the client.
+func (c *tokenClient) sign(key jwk.Key) error {
+	if err := keys.Identify(key); err != nil {
+		return err
+	}
+
+	if c.key != nil {
+		c.retired[c.key.KeyID()] = time.Now()
+	}
+	c.key = key
+	return nil
+}
+
+// rebuild makes the public keys that verify tokens those of the signing key,
+// the other keys of the source and the retired keys that have not outlived
+// `maxAge`. The caller must hold c.mu unless no other goroutine can see the
+// client.
+func (c *tokenClient) rebuild() error {
+	ctx := context.Background()
+	now := time.Now()
+
+	// a new set, as the current one may be in use by a parse
+	set := jwk.NewSet()
+	add := func(k jwk.Key) error {
+		if _, ok := set.LookupKeyID(k.KeyID()); ok {
+			return nil
+		}
+
+		pub, err := k.PublicKey()
+		if err != nil {
+			return err
+		}
+		return set.AddKey(pub)
+	}
+
+	for _, k := range append([]jwk.Key{c.key}, c.verify...) {
+		if err := add(k); err != nil {
+			return err
+		}
+	}
+
+	for it := c.set.Keys(ctx); it.Next(ctx); {
+		k := it.Pair().Value.(jwk.Key)
+		at, ok := c.retired[k.KeyID()]
+		if !ok {
+			continue
+		}
+
+		if now.Sub(at) >= c.maxAge {
+			delete(c.retired, k.KeyID())
+			continue
+		}
+
+		if err := add(k); err != nil {
+			return err
+		}
+	}
+
+	c.set = set
+	return nil
+}
+
+func (c *tokenClient) rotateEvery(d time.Duration) {
+	for range time.Tick(d) {
+		if err := c.Rotate(); err != nil {
+			log.Printf("rotate signing key: %v", err)
+		}
+	}
 }
 
 func NewTokenClient(opts ...ClientOption) Client {
-	c := &tokenClient{}
+	c := &tokenClient{
+		set:     jwk.NewSet(),
+		retired: map[string]time.Time{},
+		// long enough for a refresh token
+		maxAge: 7 * 24 * time.Hour,
+		iss:    "https://example.com",
+		aud:    "https://example.com",
+	}
 	for _, opt := range opts {
 		opt(c)
 	}
 
-	if c.key == nil {
-		var err error
-		if c.key, err = keys.ES256Key(nil); err != nil {
-			panic(err)
-		}
+	if c.src == nil {
+		WithRandReader(nil)(c)
+	}
+
+	if err := c.refresh(); err != nil {
+		panic(err)
+	}
+
+	if c.rotate > 0 {
+		go c.rotateEvery(c.rotate)
 	}
 
 	return c
@@ -1,23 +1,53 @@
 package jsonwebkey
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
 // https://pawamoy.github.io/posts/pass-makefile-args-as-typed-in-command-line/
 // https://www.cyberciti.biz/faq/linux-unix-formatting-dates-for-display/
 
+var ErrUnsupported = errors.New(`unsupported encryption`)
+
 func ES256Key(r io.Reader) (jwk.Key, error) {
+	return ecdsaKey(elliptic.P256(), r)
+}
+
+func ES384Key(r io.Reader) (jwk.Key, error) {
+	return ecdsaKey(elliptic.P384(), r)
+}
+
+func ecdsaKey(c elliptic.Curve, r io.Reader) (jwk.Key, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	raw, err := ecdsa.GenerateKey(c, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwk.FromRaw(raw)
+}
+
+func Ed25519Key(r io.Reader) (jwk.Key, error) {
 	if r == nil {
 		r = rand.Reader
 	}
 
-	raw, err := ecdsa.GenerateKey(elliptic.P256(), r)
+	_, raw, err := ed25519.GenerateKey(r)
 	if err != nil {
 		return nil, err
 	}
@@ -25,6 +55,109 @@ func ES256Key(r io.Reader) (jwk.Key, error) {
 	return jwk.FromRaw(raw)
 }
 
+// RSAKey generates a 2048 bit key that signs with `alg`, either RS256 or PS256
+func RSAKey(r io.Reader, alg jwa.SignatureAlgorithm) (jwk.Key, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	raw, err := rsa.GenerateKey(r, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, key.Set(jwk.AlgorithmKey, alg)
+}
+
+// NewKey generates a key that signs with `alg`
+func NewKey(alg jwa.SignatureAlgorithm, r io.Reader) (jwk.Key, error) {
+	switch alg {
+	case jwa.ES256:
+		return ES256Key(r)
+	case jwa.ES384:
+		return ES384Key(r)
+	case jwa.EdDSA:
+		return Ed25519Key(r)
+	case jwa.RS256, jwa.PS256:
+		return RSAKey(r, alg)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, alg)
+	}
+}
+
 func FromPEM(s string) (jwk.Key, error) {
 	return jwk.ParseKey([]byte(s), jwk.WithPEM(true))
 }
+
+// Algorithm returns the algorithm a key signs with. It is the `alg` of the
+// key if it has one, which is the only way to choose PS256 over RS256 for
+// an RSA key, or else the algorithm that suits the type of key.
+func Algorithm(key jwk.Key) (jwa.SignatureAlgorithm, error) {
+	var alg jwa.SignatureAlgorithm
+	if v := key.Algorithm(); v != nil && v.String() != "" {
+		if err := alg.Accept(v.String()); err != nil {
+			return "", err
+		}
+		return alg, nil
+	}
+
+	switch key := key.(type) {
+	case jwk.RSAPrivateKey, jwk.RSAPublicKey:
+		return jwa.RS256, nil
+	case jwk.ECDSAPrivateKey:
+		return curveAlgorithm(key.Crv())
+	case jwk.ECDSAPublicKey:
+		return curveAlgorithm(key.Crv())
+	case jwk.OKPPrivateKey:
+		return okpAlgorithm(key.Crv())
+	case jwk.OKPPublicKey:
+		return okpAlgorithm(key.Crv())
+	default:
+		return "", ErrUnsupported
+	}
+}
+
+func curveAlgorithm(crv jwa.EllipticCurveAlgorithm) (jwa.SignatureAlgorithm, error) {
+	switch crv {
+	case jwa.P256:
+		return jwa.ES256, nil
+	case jwa.P384:
+		return jwa.ES384, nil
+	default:
+		return "", fmt.Errorf("%w: curve %s", ErrUnsupported, crv)
+	}
+}
+
+func okpAlgorithm(crv jwa.EllipticCurveAlgorithm) (jwa.SignatureAlgorithm, error) {
+	if crv != jwa.Ed25519 {
+		return "", fmt.Errorf("%w: curve %s", ErrUnsupported, crv)
+	}
+	return jwa.EdDSA, nil
+}
+
+// Identify sets the `kid` of a key to its thumbprint, unless it already has
+// one, and sets the `alg` it signs with, so that it can be found in a key set.
+func Identify(key jwk.Key) error {
+	if key.KeyID() == "" {
+		p, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return err
+		}
+
+		if err := key.Set(jwk.KeyIDKey, base64.RawURLEncoding.EncodeToString(p)); err != nil {
+			return err
+		}
+	}
+
+	alg, err := Algorithm(key)
+	if err != nil {
+		return err
+	}
+
+	return key.Set(jwk.AlgorithmKey, alg)
+}
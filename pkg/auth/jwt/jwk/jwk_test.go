@@ -4,10 +4,16 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	keys "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt/jwk"
 	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
@@ -46,3 +52,92 @@ func TestGenerateFromSecret(t *testing.T) {
 		is.Equal(k1, k2) // keys are not equal
 	})
 }
+
+func TestAlgorithm(t *testing.T) {
+	is := is.New(t)
+
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.ES256, jwa.ES384, jwa.EdDSA, jwa.RS256, jwa.PS256} {
+		key, err := keys.NewKey(alg, nil)
+		is.NoErr(err) // generate key
+
+		got, err := keys.Algorithm(key)
+		is.NoErr(err)      // select algorithm
+		is.Equal(got, alg) // algorithm of the key
+
+		pub, err := key.PublicKey()
+		is.NoErr(err) // public key
+
+		got, err = keys.Algorithm(pub)
+		is.NoErr(err)      // select algorithm
+		is.Equal(got, alg) // public key signs with the same algorithm
+	}
+
+	_, err := keys.NewKey(jwa.HS256, nil)
+	is.True(errors.Is(err, keys.ErrUnsupported)) // no shared secrets
+}
+
+func TestFileSource(t *testing.T) {
+	is := is.New(t)
+
+	write := func(path string, key jwk.Key, mod time.Time) {
+		set := jwk.NewSet()
+		set.AddKey(key)
+
+		p, err := json.Marshal(set)
+		is.NoErr(err)                          // encode key set
+		is.NoErr(os.WriteFile(path, p, 0o600)) // write key set
+		is.NoErr(os.Chtimes(path, mod, mod))   // set modified time
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	first, err := keys.Ed25519Key(nil)
+	is.NoErr(err) // generate key
+	write(path, first, time.Now().Add(-time.Minute))
+
+	src := keys.SetFile(path, keys.WithCheckInterval(0))
+
+	ks, err := src.Keys()
+	is.NoErr(err)                // read key set
+	is.Equal(len(ks), 1)         // one key
+	is.True(ks[0].KeyID() != "") // key is identified
+	kid := ks[0].KeyID()
+
+	ks, err = src.Keys()
+	is.NoErr(err)                // read key set again
+	is.Equal(ks[0].KeyID(), kid) // unchanged
+
+	second, err := keys.ES384Key(nil)
+	is.NoErr(err) // generate key
+	write(path, second, time.Now())
+
+	ks, err = src.Keys()
+	is.NoErr(err)                 // read changed key set
+	is.True(ks[0].KeyID() != kid) // new key
+	kid = ks[0].KeyID()
+
+	alg, err := keys.Algorithm(ks[0])
+	is.NoErr(err)            // select algorithm
+	is.Equal(alg, jwa.ES384) // algorithm of the new key
+
+	is.NoErr(os.Remove(path)) // file is being replaced
+
+	ks, err = src.Keys()
+	is.NoErr(err)                // keys last read
+	is.Equal(ks[0].KeyID(), kid) // still the second key
+
+	t.Run("checked once per interval", func(t *testing.T) {
+		write(path, first, time.Now().Add(-time.Minute))
+		src := keys.SetFile(path, keys.WithCheckInterval(time.Hour))
+
+		ks, err := src.Keys()
+		is.NoErr(err) // read key set
+		kid := ks[0].KeyID()
+
+		write(path, second, time.Now())
+
+		ks, err = src.Keys()
+		is.NoErr(err)                // keys last read
+		is.Equal(ks[0].KeyID(), kid) // change is not seen until the next check
+	})
+}
@@ -0,0 +1,189 @@
+package jsonwebkey
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+var ErrNoKeys = errors.New("key source has no keys")
+
+// Source provides the private keys that sign tokens. The first key signs new
+// tokens and any others only verify them. Every key has a `kid`, so a change
+// to the first key can be noticed.
+type Source interface {
+	Keys() ([]jwk.Key, error)
+}
+
+type staticSource []jwk.Key
+
+func (s staticSource) Keys() ([]jwk.Key, error) { return s, nil }
+
+// Static is a source of keys that never change
+func Static(keys ...jwk.Key) (Source, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	for _, k := range keys {
+		if err := Identify(k); err != nil {
+			return nil, err
+		}
+	}
+	return staticSource(keys), nil
+}
+
+// Generate is a source of a single new key that signs with `alg`
+func Generate(alg jwa.SignatureAlgorithm, r io.Reader) (Source, error) {
+	key, err := NewKey(alg, r)
+	if err != nil {
+		return nil, err
+	}
+	return Static(key)
+}
+
+// PEM is a source of the keys in PEM blocks
+func PEM(s string) (Source, error) {
+	keys, err := parsePEM([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return Static(keys...)
+}
+
+// DefaultCheckInterval is how often a file source looks for changes
+// to its file, unless given `WithCheckInterval`
+const DefaultCheckInterval = 5 * time.Second
+
+type FileOption func(*fileSource)
+
+// WithCheckInterval sets how long the keys of a file are used before
+// the file is checked for changes. Every token signed or parsed asks
+// for the keys, so the file is not checked each time.
+func WithCheckInterval(d time.Duration) FileOption {
+	return func(s *fileSource) { s.every = d }
+}
+
+// PEMFile is a source of the keys in PEM blocks of a file. The file
+// is read again whenever it changes.
+func PEMFile(path string, opts ...FileOption) Source {
+	return newFileSource(path, parsePEM, opts)
+}
+
+// SetFile is a source of the keys in a JWK set file. The file
+// is read again whenever it changes.
+func SetFile(path string, opts ...FileOption) Source {
+	return newFileSource(path, parseSet, opts)
+}
+
+func newFileSource(path string, parse func(p []byte) ([]jwk.Key, error), opts []FileOption) *fileSource {
+	s := &fileSource{path: path, parse: parse, every: DefaultCheckInterval}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+func parsePEM(p []byte) ([]jwk.Key, error) {
+	set, err := jwk.Parse(p, jwk.WithPEM(true))
+	if err != nil {
+		return nil, err
+	}
+	return keysOf(set), nil
+}
+
+func parseSet(p []byte) ([]jwk.Key, error) {
+	set, err := jwk.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return keysOf(set), nil
+}
+
+func keysOf(set jwk.Set) []jwk.Key {
+	ctx := context.Background()
+
+	var keys []jwk.Key
+	for it := set.Keys(ctx); it.Next(ctx); {
+		keys = append(keys, it.Pair().Value.(jwk.Key))
+	}
+	return keys
+}
+
+type fileSource struct {
+	path  string
+	parse func(p []byte) ([]jwk.Key, error)
+	every time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	mod     time.Time
+	size    int64
+	keys    []jwk.Key
+}
+
+// Keys reads the file if it has changed since it was last checked. If it
+// cannot be read, perhaps because it is being replaced, the keys last read
+// are returned.
+func (s *fileSource) Keys() ([]jwk.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.keys != nil && now.Sub(s.checked) < s.every {
+		return s.keys, nil
+	}
+	s.checked = now
+
+	keys, err := s.read()
+	if err != nil && s.keys != nil {
+		log.Printf("read keys from %s: %v", s.path, err)
+		return s.keys, nil
+	}
+	return keys, err
+}
+
+// read is called with s.mu held
+func (s *fileSource) read() ([]jwk.Key, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.keys != nil && fi.ModTime().Equal(s.mod) && fi.Size() == s.size {
+		return s.keys, nil
+	}
+
+	// a file that cannot be used is not read again until it changes
+	s.mod, s.size = fi.ModTime(), fi.Size()
+
+	p, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.parse(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	for _, k := range keys {
+		if err := Identify(k); err != nil {
+			return nil, err
+		}
+	}
+
+	s.keys = keys
+	return keys, nil
+}
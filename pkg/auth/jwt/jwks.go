@@ -0,0 +1,24 @@
+package jsonwebtoken
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// JWKSHandler publishes the public keys of the client as a JWK set, so
+// that other services can verify its tokens without sharing the secret.
+// It is usually served at `/.well-known/jwks.json`.
+func JWKSHandler(c Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := json.Marshal(c.PublicKeys())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		// keys only change on rotation so verifiers may keep them for a while
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(p)
+	}
+}
@@ -2,20 +2,24 @@ package jsonwebtoken
 
 import (
 	"context"
-	"errors"
 	"net/http"
 	"time"
 
-	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jwt"
-)
 
-var (
-	iss = "http://server.example.com"
-	aud = []string{"client_a"}
+	keys "github.com/hyphengolang/noughts-and-crosses/pkg/auth/jwt/jwk"
 )
 
+// withKey selects the signature algorithm for the key, see `keys.Algorithm`
+func withKey(key jwk.Key) (jwt.SignEncryptParseOption, error) {
+	alg, err := keys.Algorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.WithKey(alg, key), nil
+}
+
 func SignToken(ctx context.Context, key jwk.Key, opts ...BuildOption) (Token, error) {
 	return Build(key, opts...)
 }
@@ -23,14 +27,9 @@ func SignToken(ctx context.Context, key jwk.Key, opts ...BuildOption) (Token, er
 // ParseRequest parses the request and returns the token
 // key must be a private key
 func Sign(tk jwt.Token, key jwk.Key) (Token, error) {
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPrivateKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPrivateKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+	sep, err := withKey(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return jwt.Sign(tk, sep)
@@ -48,28 +47,18 @@ func (t Token) String() string { return string(t) }
 // ParseRequest parses the request and returns the token
 // key must be a public key
 func ParseRequest(r *http.Request, key jwk.Key) (jwt.Token, error) {
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPublicKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPublicKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+	sep, err := withKey(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return jwt.ParseRequest(r, sep)
 }
 
 func ParseToken(token []byte, key jwk.Key) (jwt.Token, error) {
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPublicKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPublicKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+	sep, err := withKey(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return jwt.Parse(token, sep)
@@ -81,14 +70,9 @@ func ParseCookie(r *http.Request, key jwk.Key, cookieName string) (jwt.Token, er
 		return nil, err
 	}
 
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPublicKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPublicKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+	sep, err := withKey(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return jwt.Parse([]byte(c.Value), sep)
@@ -135,11 +119,22 @@ func (c PrivateClaims) Append(key string, value any) {
 	c[key] = value
 }
 
-func Build(key jwk.Key, opts ...BuildOption) ([]byte, error) {
-	iss := "https://example.com"
-	aud := []string{"https://example.com"}
+// issuer sets who issued the token
+func issuer(iss string) BuildOption {
+	return func(b *jwt.Builder) {
+		b.Issuer(iss)
+	}
+}
+
+// audience sets who the token is meant for
+func audience(aud ...string) BuildOption {
+	return func(b *jwt.Builder) {
+		b.Audience(aud)
+	}
+}
 
-	b := jwt.NewBuilder().Issuer(iss).Audience(aud).IssuedAt(time.Now())
+func Build(key jwk.Key, opts ...BuildOption) ([]byte, error) {
+	b := jwt.NewBuilder().IssuedAt(time.Now())
 	for _, opt := range opts {
 		opt(b)
 	}
@@ -149,14 +144,9 @@ func Build(key jwk.Key, opts ...BuildOption) ([]byte, error) {
 		return nil, err
 	}
 
-	var sep jwt.SignEncryptParseOption
-	switch key := key.(type) {
-	case jwk.RSAPrivateKey:
-		sep = jwt.WithKey(jwa.RS256, key)
-	case jwk.ECDSAPrivateKey:
-		sep = jwt.WithKey(jwa.ES256, key)
-	default:
-		return nil, errors.New(`unsupported encryption`)
+	sep, err := withKey(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return jwt.Sign(tk, sep)
@@ -0,0 +1,28 @@
+package jsonwebtoken
+
+import "github.com/lestrrat-go/jwx/v2/jwt"
+
+// Purpose says what a token may be used for, so that a token issued for
+// one thing, like a signup link, cannot be presented as another.
+type Purpose string
+
+const (
+	PurposeLogin   Purpose = "login"
+	PurposeSignup  Purpose = "signup"
+	PurposeAccess  Purpose = "access"
+	PurposeRefresh Purpose = "refresh"
+)
+
+const purposeClaim = "purpose"
+
+// WithPurpose sets the purpose of the token being built
+func WithPurpose(p Purpose) BuildOption {
+	return func(b *jwt.Builder) {
+		b.Claim(purposeClaim, string(p))
+	}
+}
+
+// RequirePurpose rejects a token being parsed unless it has the purpose
+func RequirePurpose(p Purpose) jwt.ParseOption {
+	return jwt.WithClaimValue(purposeClaim, string(p))
+}